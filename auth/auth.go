@@ -1,6 +1,9 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"log"
 	"time"
@@ -14,73 +17,141 @@ var (
 	ErrExpiredToken     = errors.New("token has expired")
 	ErrInvalidClaims    = errors.New("invalid token claims")
 	ErrTokenBlacklisted = errors.New("token has been blacklisted")
+	ErrAccountDisabled  = errors.New("account has been deleted or suspended")
+)
+
+const (
+	accessTokenDuration  = 15 * time.Minute
+	refreshTokenDuration = 7 * 24 * time.Hour
+)
+
+// Token types, carried in the typ claim. Both kinds are signed with the same
+// keys, so this is what stops one being used as the other.
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
 )
 
 type TokenPair struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+
+	// Bookkeeping for the session store, never serialized
+	SessionID        string    `json:"-"`
+	RefreshID        string    `json:"-"`
+	RefreshExpiresAt time.Time `json:"-"`
 }
 
 type Claims struct {
-	UserID  primitive.ObjectID `json:"user_id"`
-	Name    string             `json:"name"`
-	Surname string             `json:"surname"`
-	Role    string             `json:"role"`
+	UserID       primitive.ObjectID `json:"user_id"`
+	Name         string             `json:"name"`
+	Surname      string             `json:"surname"`
+	Role         string             `json:"role"`
+	SessionID    string             `json:"sid,omitempty"`
+	TokenType    string             `json:"typ"`
+	TokenVersion int                `json:"ver"`
 	jwt.RegisteredClaims
 }
 
-// GenerateTokenPair generates both access and refresh tokens
-func GenerateTokenPair(userID primitive.ObjectID, name, surname, role string, accessSecret, refreshSecret string) (*TokenPair, error) {
+// TokenSubject is the user a token pair is issued to, as currently stored
+type TokenSubject struct {
+	UserID       primitive.ObjectID
+	Name         string
+	Surname      string
+	Role         string
+	TokenVersion int
+}
+
+// SubjectLoader loads the current state of a token's user. It returns
+// ErrAccountDisabled when the user was deleted or suspended.
+type SubjectLoader func(ctx context.Context, userID primitive.ObjectID) (*TokenSubject, error)
+
+// newTokenID returns a random identifier suitable for a jti or session ID
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GenerateTokenPair generates both access and refresh tokens, starting a new session
+func GenerateTokenPair(keys *KeySet, subject *TokenSubject) (*TokenPair, error) {
+	sessionID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	return generateTokenPair(keys, subject, sessionID)
+}
+
+// generateTokenPair signs an access and refresh token belonging to the given session
+func generateTokenPair(keys *KeySet, subject *TokenSubject, sessionID string) (*TokenPair, error) {
+	accessID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	refreshID, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	refreshExpiresAt := now.Add(refreshTokenDuration)
+
 	// Generate access token (15 minutes)
 	accessClaims := Claims{
-		UserID:  userID,
-		Name:    name,
-		Surname: surname,
-		Role:    role,
+		UserID:       subject.UserID,
+		Name:         subject.Name,
+		Surname:      subject.Surname,
+		Role:         subject.Role,
+		SessionID:    sessionID,
+		TokenType:    TokenTypeAccess,
+		TokenVersion: subject.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        accessID,
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenDuration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenString, err := accessToken.SignedString([]byte(accessSecret))
+	accessTokenString, err := keys.sign(accessClaims)
 	if err != nil {
 		return nil, err
 	}
 
 	// Generate refresh token (7 days)
 	refreshClaims := Claims{
-		UserID: userID,
-		Role:   role,
+		UserID:       subject.UserID,
+		Role:         subject.Role,
+		SessionID:    sessionID,
+		TokenType:    TokenTypeRefresh,
+		TokenVersion: subject.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        refreshID,
+			ExpiresAt: jwt.NewNumericDate(refreshExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString([]byte(refreshSecret))
+	refreshTokenString, err := keys.sign(refreshClaims)
 	if err != nil {
 		return nil, err
 	}
 
 	return &TokenPair{
-		AccessToken:  accessTokenString,
-		RefreshToken: refreshTokenString,
+		AccessToken:      accessTokenString,
+		RefreshToken:     refreshTokenString,
+		SessionID:        sessionID,
+		RefreshID:        refreshID,
+		RefreshExpiresAt: refreshExpiresAt,
 	}, nil
 }
 
-// ValidateToken validates a token and returns the claims
-func ValidateToken(tokenString string, secretKey string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, ErrInvalidToken
-		}
-		return []byte(secretKey), nil
-	})
+// ValidateToken validates a token of the given type and returns the claims
+func ValidateToken(keys *KeySet, tokenString, tokenType string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keys.keyFunc)
 
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
@@ -90,6 +161,9 @@ func ValidateToken(tokenString string, secretKey string) (*Claims, error) {
 	}
 
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+		if claims.TokenType != tokenType {
+			return nil, ErrInvalidToken
+		}
 		log.Printf("ValidateToken: Successfully parsed claims with user_id: %s", claims.UserID.Hex())
 		return claims, nil
 	}
@@ -97,25 +171,3 @@ func ValidateToken(tokenString string, secretKey string) (*Claims, error) {
 	log.Printf("ValidateToken: Failed to parse claims or token is invalid")
 	return nil, ErrInvalidClaims
 }
-
-// RefreshAccessToken generates a new access token using a refresh token
-func RefreshAccessToken(refreshToken string, accessSecret, refreshSecret string) (string, error) {
-	claims, err := ValidateToken(refreshToken, refreshSecret)
-	if err != nil {
-		return "", err
-	}
-
-	// Generate new access token
-	accessClaims := Claims{
-		UserID: claims.UserID,
-		Role:   claims.Role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-		},
-	}
-
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	return accessToken.SignedString([]byte(accessSecret))
-}
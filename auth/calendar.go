@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// GenerateCalendarToken returns a random token for a user's calendar feed
+// URLs and the hash to store in its place. Calendar apps can't send an
+// Authorization header, so the token in the URL is the feed's only
+// credential.
+func GenerateCalendarToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, HashCalendarToken(token), nil
+}
+
+// HashCalendarToken returns the stored form of a calendar token. The token
+// is long and random, so a fast hash is enough to keep a database leak from
+// exposing usable feed URLs.
+func HashCalendarToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+const (
+	deniedTokenPrefix   = "access_denied:"
+	deniedSessionPrefix = "access_denied_session:"
+	deniedUserPrefix    = "access_denied_user:"
+)
+
+// Denylist cuts off access tokens before they expire. Entries only need to
+// outlive the longest access token, so they expire on their own.
+type Denylist struct {
+	kv KV
+}
+
+func NewDenylist(kv KV) *Denylist {
+	return &Denylist{kv: kv}
+}
+
+// RevokeToken denylists a single access token until it expires
+func (d *Denylist) RevokeToken(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return ErrInvalidClaims
+	}
+
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+	return d.kv.Set(ctx, deniedTokenPrefix+claims.ID, "1", ttl)
+}
+
+// RevokeSession denylists every access token issued to a session
+func (d *Denylist) RevokeSession(ctx context.Context, sessionID string) error {
+	return d.kv.Set(ctx, deniedSessionPrefix+sessionID, "1", accessTokenDuration)
+}
+
+// RevokeUser denylists every access token issued to the user with a token
+// version older than minVersion, the user's version after the revocation
+func (d *Denylist) RevokeUser(ctx context.Context, userID string, minVersion int) error {
+	return d.kv.Set(ctx, deniedUserPrefix+userID, strconv.Itoa(minVersion), accessTokenDuration)
+}
+
+// Check returns ErrTokenBlacklisted if the token has been revoked
+func (d *Denylist) Check(ctx context.Context, claims *Claims) error {
+	if claims.ID != "" {
+		if _, err := d.kv.Get(ctx, deniedTokenPrefix+claims.ID); err == nil {
+			return ErrTokenBlacklisted
+		} else if err != ErrKeyNotFound {
+			return err
+		}
+	}
+
+	if claims.SessionID != "" {
+		if _, err := d.kv.Get(ctx, deniedSessionPrefix+claims.SessionID); err == nil {
+			return ErrTokenBlacklisted
+		} else if err != ErrKeyNotFound {
+			return err
+		}
+	}
+
+	value, err := d.kv.Get(ctx, deniedUserPrefix+claims.UserID.Hex())
+	if err == ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	minVersion, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if claims.TokenVersion < minVersion {
+		return ErrTokenBlacklisted
+	}
+
+	return nil
+}
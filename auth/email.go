@@ -6,8 +6,6 @@ import (
 	"encoding/hex"
 	"errors"
 	"time"
-
-	"github.com/redis/go-redis/v9"
 )
 
 const (
@@ -20,19 +18,15 @@ var (
 	ErrTokenInvalid = errors.New("invalid verification token")
 )
 
-type EmailVerifier struct {
-	client *redis.Client
+// oneTimeTokens issues random tokens that resolve to a value exactly once
+type oneTimeTokens struct {
+	kv     KV
+	prefix string
+	ttl    time.Duration
 }
 
-func NewEmailVerifier(redisAddr string) *EmailVerifier {
-	client := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
-	return &EmailVerifier{client: client}
-}
-
-// GenerateToken creates a new verification token for the given email
-func (ev *EmailVerifier) GenerateToken(ctx context.Context, email string) (string, error) {
+// generate creates a new token for value and stores it with expiry
+func (t oneTimeTokens) generate(ctx context.Context, value string) (string, error) {
 	// Generate random token
 	tokenBytes := make([]byte, verificationTokenLength)
 	if _, err := rand.Read(tokenBytes); err != nil {
@@ -40,27 +34,40 @@ func (ev *EmailVerifier) GenerateToken(ctx context.Context, email string) (strin
 	}
 	token := hex.EncodeToString(tokenBytes)
 
-	// Store token in Redis with expiry
-	err := ev.client.Set(ctx, "email_verify:"+token, email, tokenExpiryDuration).Err()
-	if err != nil {
+	if err := t.kv.Set(ctx, t.prefix+token, value, t.ttl); err != nil {
 		return "", err
 	}
 
 	return token, nil
 }
 
-// VerifyToken validates the token and returns the associated email
-func (ev *EmailVerifier) VerifyToken(ctx context.Context, token string) (string, error) {
-	// Get email from Redis
-	email, err := ev.client.Get(ctx, "email_verify:"+token).Result()
-	if err == redis.Nil {
+// consume returns the value stored for token and deletes the token
+func (t oneTimeTokens) consume(ctx context.Context, token string) (string, error) {
+	value, err := t.kv.GetDel(ctx, t.prefix+token)
+	if err == ErrKeyNotFound {
 		return "", ErrTokenInvalid
 	} else if err != nil {
 		return "", err
 	}
+	return value, nil
+}
+
+type EmailVerifier struct {
+	tokens oneTimeTokens
+}
+
+func NewEmailVerifier(kv KV) *EmailVerifier {
+	return &EmailVerifier{
+		tokens: oneTimeTokens{kv: kv, prefix: "email_verify:", ttl: tokenExpiryDuration},
+	}
+}
 
-	// Delete token after use
-	ev.client.Del(ctx, "email_verify:"+token)
+// GenerateToken creates a new verification token for the given email
+func (ev *EmailVerifier) GenerateToken(ctx context.Context, email string) (string, error) {
+	return ev.tokens.generate(ctx, email)
+}
 
-	return email, nil
+// VerifyToken validates the token and returns the associated email
+func (ev *EmailVerifier) VerifyToken(ctx context.Context, token string) (string, error) {
+	return ev.tokens.consume(ctx, token)
 }
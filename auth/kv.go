@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// KV is the small subset of Redis the token stores rely on, so they can run
+// against an in-memory map when Redis isn't configured (dev and tests)
+type KV interface {
+	Get(ctx context.Context, key string) (string, error)
+	GetDel(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	// Incr increments a counter, starting its ttl when the counter is created
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	Del(ctx context.Context, keys ...string) error
+	SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error
+	SRem(ctx context.Context, key string, members ...string) error
+	SMembers(ctx context.Context, key string) ([]string, error)
+}
+
+// RedisKV implements KV on top of a Redis server
+type RedisKV struct {
+	client *redis.Client
+}
+
+func NewRedisKV(redisAddr string) *RedisKV {
+	client := redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+	})
+	return &RedisKV{client: client}
+}
+
+func (r *RedisKV) Get(ctx context.Context, key string) (string, error) {
+	value, err := r.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	return value, err
+}
+
+// GetDel returns the value of key and deletes it in one atomic step
+func (r *RedisKV) GetDel(ctx context.Context, key string) (string, error) {
+	value, err := r.client.GetDel(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	return value, err
+}
+
+func (r *RedisKV) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (r *RedisKV) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return r.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (r *RedisKV) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	pipe := r.client.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (r *RedisKV) Del(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return r.client.Del(ctx, keys...).Err()
+}
+
+// SAdd adds members to a set and pushes its expiry out to ttl
+func (r *RedisKV) SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error {
+	args := make([]interface{}, len(members))
+	for i, m := range members {
+		args[i] = m
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.SAdd(ctx, key, args...)
+	pipe.Expire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisKV) SRem(ctx context.Context, key string, members ...string) error {
+	args := make([]interface{}, len(members))
+	for i, m := range members {
+		args[i] = m
+	}
+	return r.client.SRem(ctx, key, args...).Err()
+}
+
+func (r *RedisKV) SMembers(ctx context.Context, key string) ([]string, error) {
+	return r.client.SMembers(ctx, key).Result()
+}
+
+type memoryEntry struct {
+	value     string
+	set       map[string]struct{}
+	expiresAt time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// MemoryKV implements KV in process memory. It is only suitable for a single
+// instance, since nothing is shared between processes.
+type MemoryKV struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+func NewMemoryKV() *MemoryKV {
+	return &MemoryKV{entries: make(map[string]*memoryEntry)}
+}
+
+// lookup returns the live entry for key, dropping it if it has expired.
+// Callers must hold m.mu.
+func (m *MemoryKV) lookup(key string) *memoryEntry {
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(time.Now()) {
+		delete(m.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func expiryFor(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func (m *MemoryKV) Get(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.lookup(key)
+	if entry == nil || entry.set != nil {
+		return "", ErrKeyNotFound
+	}
+	return entry.value, nil
+}
+
+func (m *MemoryKV) GetDel(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.lookup(key)
+	if entry == nil || entry.set != nil {
+		return "", ErrKeyNotFound
+	}
+	delete(m.entries, key)
+	return entry.value, nil
+}
+
+func (m *MemoryKV) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = &memoryEntry{value: value, expiresAt: expiryFor(ttl)}
+	return nil
+}
+
+func (m *MemoryKV) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lookup(key) != nil {
+		return false, nil
+	}
+	m.entries[key] = &memoryEntry{value: value, expiresAt: expiryFor(ttl)}
+	return true, nil
+}
+
+func (m *MemoryKV) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.lookup(key)
+	if entry == nil || entry.set != nil {
+		entry = &memoryEntry{value: "0", expiresAt: expiryFor(ttl)}
+		m.entries[key] = entry
+	}
+	count, err := strconv.ParseInt(entry.value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	count++
+	entry.value = strconv.FormatInt(count, 10)
+	return count, nil
+}
+
+func (m *MemoryKV) Del(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+func (m *MemoryKV) SAdd(ctx context.Context, key string, ttl time.Duration, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.lookup(key)
+	if entry == nil || entry.set == nil {
+		entry = &memoryEntry{set: make(map[string]struct{})}
+		m.entries[key] = entry
+	}
+	for _, member := range members {
+		entry.set[member] = struct{}{}
+	}
+	entry.expiresAt = expiryFor(ttl)
+	return nil
+}
+
+func (m *MemoryKV) SRem(ctx context.Context, key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.lookup(key)
+	if entry == nil || entry.set == nil {
+		return nil
+	}
+	for _, member := range members {
+		delete(entry.set, member)
+	}
+	return nil
+}
+
+func (m *MemoryKV) SMembers(ctx context.Context, key string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.lookup(key)
+	if entry == nil || entry.set == nil {
+		return []string{}, nil
+	}
+	members := make([]string, 0, len(entry.set))
+	for member := range entry.set {
+		members = append(members, member)
+	}
+	return members, nil
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	loginFailurePrefix = "login_failures:"
+	loginLockPrefix    = "login_locked:"
+
+	// loginFailureWindow is how long failures are remembered. The window starts
+	// at the first failure, so a lockout clears at the latest this long after it.
+	loginFailureWindow = 15 * time.Minute
+)
+
+var ErrLoginLocked = errors.New("too many failed login attempts")
+
+// loginLimits configures how quickly one kind of key is slowed down
+type loginLimits struct {
+	// backoffAfter failures each further failure doubles the wait, starting at
+	// one second
+	backoffAfter int64
+	// lockAfter failures the key is locked for the rest of the window
+	lockAfter int64
+}
+
+var (
+	// Per account: a handful of typos is fine, a guessing run is not
+	emailLimits = loginLimits{backoffAfter: 3, lockAfter: 10}
+	// Per IP: higher, since many users can share an address, but low enough to
+	// stop a single host stuffing credentials across accounts
+	ipLimits = loginLimits{backoffAfter: 20, lockAfter: 100}
+)
+
+// LoginGuard throttles password guessing by counting failed logins per
+// account and per client IP
+type LoginGuard struct {
+	kv KV
+}
+
+func NewLoginGuard(kv KV) *LoginGuard {
+	return &LoginGuard{kv: kv}
+}
+
+func emailKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns ErrLoginLocked, with how long to wait, if either the account
+// or the IP is currently locked
+func (g *LoginGuard) Check(ctx context.Context, email, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range []string{emailKey(email), ipKey(ip)} {
+		value, err := g.kv.Get(ctx, loginLockPrefix+key)
+		if err == ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		until, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		if remaining := time.Until(time.Unix(until, 0)); remaining > wait {
+			wait = remaining
+		}
+	}
+
+	if wait > 0 {
+		return wait, ErrLoginLocked
+	}
+	return 0, nil
+}
+
+// RecordFailure counts a failed login and locks the account or IP once it
+// passes the back-off threshold
+func (g *LoginGuard) RecordFailure(ctx context.Context, email, ip string) error {
+	if err := g.recordFailure(ctx, emailKey(email), emailLimits); err != nil {
+		return err
+	}
+	return g.recordFailure(ctx, ipKey(ip), ipLimits)
+}
+
+func (g *LoginGuard) recordFailure(ctx context.Context, key string, limits loginLimits) error {
+	count, err := g.kv.Incr(ctx, loginFailurePrefix+key, loginFailureWindow)
+	if err != nil {
+		return err
+	}
+
+	var lock time.Duration
+	switch {
+	case count >= limits.lockAfter:
+		lock = loginFailureWindow
+	case count >= limits.backoffAfter:
+		lock = time.Second << (count - limits.backoffAfter)
+		if lock > loginFailureWindow {
+			lock = loginFailureWindow
+		}
+	default:
+		return nil
+	}
+
+	until := strconv.FormatInt(time.Now().Add(lock).Unix(), 10)
+	return g.kv.Set(ctx, loginLockPrefix+key, until, lock)
+}
+
+// RecordSuccess clears the account's failures after a successful login. The
+// IP's count is kept, so one valid account can't be used to reset it.
+func (g *LoginGuard) RecordSuccess(ctx context.Context, email string) error {
+	return g.Unlock(ctx, email)
+}
+
+// Unlock clears an account's failures and lockout
+func (g *LoginGuard) Unlock(ctx context.Context, email string) error {
+	key := emailKey(email)
+	return g.kv.Del(ctx, loginFailurePrefix+key, loginLockPrefix+key)
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+const (
+	mfaChallengeExpiry = 5 * time.Minute
+	usedTOTPPrefix     = "totp_used:"
+)
+
+// MFAChallenges tracks logins that passed the password check and are waiting
+// for a second factor
+type MFAChallenges struct {
+	kv     KV
+	tokens oneTimeTokens
+}
+
+func NewMFAChallenges(kv KV) *MFAChallenges {
+	return &MFAChallenges{
+		kv:     kv,
+		tokens: oneTimeTokens{kv: kv, prefix: "mfa_challenge:", ttl: mfaChallengeExpiry},
+	}
+}
+
+// Issue creates a challenge token for the user
+func (m *MFAChallenges) Issue(ctx context.Context, userID string) (string, error) {
+	return m.tokens.generate(ctx, userID)
+}
+
+// Consume returns the user the challenge was issued to. A challenge can only
+// be answered once, right or wrong, so a failed code means logging in again.
+func (m *MFAChallenges) Consume(ctx context.Context, token string) (string, error) {
+	return m.tokens.consume(ctx, token)
+}
+
+// MarkCodeUsed records that the user has spent the code for a TOTP time step.
+// It returns false if the code was already used.
+func (m *MFAChallenges) MarkCodeUsed(ctx context.Context, userID string, counter uint64) (bool, error) {
+	key := usedTOTPPrefix + userID + ":" + strconv.FormatUint(counter, 10)
+	// Codes are accepted for totpSkew periods either side, so remember them
+	// for the whole window
+	return m.kv.SetNX(ctx, key, "1", time.Duration(2*totpSkew+1)*totpPeriod)
+}
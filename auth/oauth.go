@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const oauthStateExpiry = 10 * time.Minute
+
+var ErrOAuthFailed = errors.New("oauth login failed")
+
+// Identity is what an external provider tells us about the user who logged in
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Surname       string
+}
+
+// OAuthProvider is an external identity provider supporting the
+// authorization code flow with PKCE
+type OAuthProvider interface {
+	// AuthCodeURL is where the user is sent to log in
+	AuthCodeURL(state, nonce, codeChallenge string) string
+	// Exchange redeems the code returned to the callback for the user's identity
+	Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Identity, error)
+}
+
+// OAuthState is remembered between sending the user to the provider and
+// their return to the callback
+type OAuthState struct {
+	Provider     string `json:"provider"`
+	CodeVerifier string `json:"code_verifier"`
+	Nonce        string `json:"nonce"`
+}
+
+// CodeChallenge derives the S256 PKCE challenge sent with the authorization request
+func (s OAuthState) CodeChallenge() string {
+	sum := sha256.Sum256([]byte(s.CodeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// OAuthStates stores in-flight logins under their state parameter, so each
+// callback can be matched to the login that started it exactly once
+type OAuthStates struct {
+	tokens oneTimeTokens
+}
+
+func NewOAuthStates(kv KV) *OAuthStates {
+	return &OAuthStates{
+		tokens: oneTimeTokens{kv: kv, prefix: "oauth_state:", ttl: oauthStateExpiry},
+	}
+}
+
+// Start records a new login with the provider and returns its state parameter
+func (s *OAuthStates) Start(ctx context.Context, provider string) (string, *OAuthState, error) {
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := randomURLString(16)
+	if err != nil {
+		return "", nil, err
+	}
+
+	state := &OAuthState{Provider: provider, CodeVerifier: verifier, Nonce: nonce}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := s.tokens.generate(ctx, string(data))
+	if err != nil {
+		return "", nil, err
+	}
+	return token, state, nil
+}
+
+// Consume returns the login started with the given state parameter
+func (s *OAuthStates) Consume(ctx context.Context, token string) (*OAuthState, error) {
+	data, err := s.tokens.consume(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var state OAuthState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func randomURLString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// oauthClient holds the client registration shared by every provider type
+type oauthClient struct {
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	authURL      string
+	tokenURL     string
+	scopes       []string
+	httpClient   *http.Client
+}
+
+func (c *oauthClient) authCodeURL(state, codeChallenge string, extra url.Values) string {
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", c.clientID)
+	params.Set("redirect_uri", c.redirectURL)
+	params.Set("scope", strings.Join(c.scopes, " "))
+	params.Set("state", state)
+	params.Set("code_challenge", codeChallenge)
+	params.Set("code_challenge_method", "S256")
+	for key, values := range extra {
+		params[key] = values
+	}
+
+	separator := "?"
+	if strings.Contains(c.authURL, "?") {
+		separator = "&"
+	}
+	return c.authURL + separator + params.Encode()
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchange redeems an authorization code at the token endpoint
+func (c *oauthClient) exchange(ctx context.Context, code, codeVerifier string) (*tokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.redirectURL)
+	form.Set("client_id", c.clientID)
+	form.Set("client_secret", c.clientSecret)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var token tokenResponse
+	if err := c.do(req, &token); err != nil {
+		return nil, err
+	}
+	if token.Error != "" {
+		return nil, fmt.Errorf("%w: %s: %s", ErrOAuthFailed, token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("%w: no access token in response", ErrOAuthFailed)
+	}
+	return &token, nil
+}
+
+// getJSON fetches url, authenticating with accessToken when it's set
+func (c *oauthClient) getJSON(ctx context.Context, url, accessToken string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return c.do(req, v)
+}
+
+func (c *oauthClient) do(req *http.Request, v interface{}) error {
+	client := c.httpClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	// Token endpoints report errors as JSON with a 400, so let the caller see them
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("%w: %s returned %s", ErrOAuthFailed, req.URL.Host, resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwksRefreshInterval limits how often an unknown kid triggers a refetch of
+// the provider's keys
+const jwksRefreshInterval = time.Minute
+
+// OIDCProvider logs users in with an OpenID Connect provider such as Google,
+// trusting the identity in the signed ID token
+type OIDCProvider struct {
+	oauthClient
+	name    string
+	issuer  string
+	jwksURL string
+
+	mu        sync.Mutex
+	keys      map[string]*Key
+	fetchedAt time.Time
+}
+
+// NewOIDCProvider configures a provider from its discovery document at
+// issuer/.well-known/openid-configuration
+func NewOIDCProvider(ctx context.Context, name, issuer, clientID, clientSecret, redirectURL string) (*OIDCProvider, error) {
+	p := &OIDCProvider{
+		oauthClient: oauthClient{
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			redirectURL:  redirectURL,
+			scopes:       []string{"openid", "email", "profile"},
+		},
+		name:   name,
+		issuer: strings.TrimRight(issuer, "/"),
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", "", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("%w: discovery issuer %q does not match %q", ErrOAuthFailed, discovery.Issuer, p.issuer)
+	}
+
+	p.authURL = discovery.AuthorizationEndpoint
+	p.tokenURL = discovery.TokenEndpoint
+	p.jwksURL = discovery.JWKSURI
+	return p, nil
+}
+
+func (p *OIDCProvider) AuthCodeURL(state, nonce, codeChallenge string) string {
+	return p.authCodeURL(state, codeChallenge, url.Values{"nonce": {nonce}})
+}
+
+type idTokenClaims struct {
+	Email string `json:"email"`
+	// Some providers send email_verified as a string
+	EmailVerified interface{} `json:"email_verified"`
+	Nonce         string      `json:"nonce"`
+	GivenName     string      `json:"given_name"`
+	FamilyName    string      `json:"family_name"`
+	jwt.RegisteredClaims
+}
+
+func (p *OIDCProvider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Identity, error) {
+	token, err := p.exchange(ctx, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("%w: no ID token in response", ErrOAuthFailed)
+	}
+
+	var claims idTokenClaims
+	_, err = jwt.ParseWithClaims(token.IDToken, &claims,
+		func(t *jwt.Token) (interface{}, error) { return p.verificationKey(ctx, t) },
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.clientID),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token: %v", ErrOAuthFailed, err)
+	}
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: ID token has no expiry", ErrOAuthFailed)
+	}
+
+	// The nonce ties the ID token to the login we started
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: ID token nonce mismatch", ErrOAuthFailed)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: ID token has no subject", ErrOAuthFailed)
+	}
+
+	verified := claims.EmailVerified == true || claims.EmailVerified == "true"
+	return &Identity{
+		Provider:      p.name,
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: verified,
+		Name:          claims.GivenName,
+		Surname:       claims.FamilyName,
+	}, nil
+}
+
+// verificationKey finds the provider key that signed an ID token, refetching
+// the provider's JWKS when it has rotated to a key we haven't seen
+func (p *OIDCProvider) verificationKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[kid]
+	if !ok && time.Since(p.fetchedAt) > jwksRefreshInterval {
+		var set JWKS
+		if err := p.getJSON(ctx, p.jwksURL, "", &set); err != nil {
+			return nil, err
+		}
+
+		keys := make(map[string]*Key, len(set.Keys))
+		for _, jwk := range set.Keys {
+			// Skip keys we can't use rather than failing the whole set
+			if k, err := jwk.Key(); err == nil {
+				keys[jwk.Kid] = k
+			}
+		}
+		p.keys = keys
+		p.fetchedAt = time.Now()
+		key, ok = p.keys[kid]
+	}
+
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, ErrInvalidToken
+	}
+	return key.public, nil
+}
+
+// Key parses the public key described by the JWK. The key keeps the JWK's
+// own kid.
+func (j JWK) Key() (*Key, error) {
+	var key *Key
+	var err error
+
+	switch j.Kty {
+	case "RSA":
+		n, nErr := base64.RawURLEncoding.DecodeString(j.N)
+		e, eErr := base64.RawURLEncoding.DecodeString(j.E)
+		if nErr != nil || eErr != nil {
+			return nil, ErrUnsupportedKey
+		}
+		key, err = NewVerificationKey(&rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		})
+	case "OKP":
+		x, xErr := base64.RawURLEncoding.DecodeString(j.X)
+		if j.Crv != "Ed25519" || xErr != nil || len(x) != ed25519.PublicKeySize {
+			return nil, ErrUnsupportedKey
+		}
+		key, err = NewVerificationKey(ed25519.PublicKey(x))
+	default:
+		return nil, ErrUnsupportedKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if j.Alg != "" && j.Alg != key.method.Alg() {
+		return nil, ErrUnsupportedKey
+	}
+	if j.Kid != "" {
+		key.ID = j.Kid
+	}
+	return key, nil
+}
+
+// GitHubProvider logs users in with GitHub. GitHub only speaks OAuth 2, so
+// the identity comes from its API rather than an ID token.
+type GitHubProvider struct {
+	oauthClient
+	apiURL string
+}
+
+func NewGitHubProvider(clientID, clientSecret, redirectURL string) *GitHubProvider {
+	return &GitHubProvider{
+		oauthClient: oauthClient{
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			redirectURL:  redirectURL,
+			authURL:      "https://github.com/login/oauth/authorize",
+			tokenURL:     "https://github.com/login/oauth/access_token",
+			scopes:       []string{"read:user", "user:email"},
+		},
+		apiURL: "https://api.github.com",
+	}
+}
+
+func (p *GitHubProvider) AuthCodeURL(state, nonce, codeChallenge string) string {
+	return p.authCodeURL(state, codeChallenge, nil)
+}
+
+func (p *GitHubProvider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Identity, error) {
+	token, err := p.exchange(ctx, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err := p.getJSON(ctx, p.apiURL+"/user", token.AccessToken, &user); err != nil {
+		return nil, err
+	}
+	if user.ID == 0 {
+		return nil, fmt.Errorf("%w: no GitHub user ID", ErrOAuthFailed)
+	}
+
+	// The profile email may be unset or unverified, so use the primary one
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := p.getJSON(ctx, p.apiURL+"/user/emails", token.AccessToken, &emails); err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{Provider: "github", Subject: strconv.FormatInt(user.ID, 10)}
+	identity.Name, identity.Surname, _ = strings.Cut(user.Name, " ")
+	if identity.Name == "" {
+		identity.Name = user.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = strings.ToLower(email.Email)
+			identity.EmailVerified = email.Verified
+		}
+	}
+	return identity, nil
+}
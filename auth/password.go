@@ -1,7 +1,10 @@
 package auth
 
 import (
+	"crypto/rand"
 	"errors"
+	"math/big"
+	"strings"
 	"unicode"
 
 	"golang.org/x/crypto/bcrypt"
@@ -89,11 +92,43 @@ func ComparePassword(password, hash string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
-// GenerateTemporaryPassword generates a secure temporary password
+// temporaryPasswordAlphabet groups the character classes a temporary password must contain
+var temporaryPasswordAlphabet = []string{
+	"ABCDEFGHJKLMNPQRSTUVWXYZ",
+	"abcdefghijkmnopqrstuvwxyz",
+	"23456789",
+	"!@#$%^&*-_=+?",
+}
+
+// GenerateTemporaryPassword generates a secure temporary password that satisfies ValidatePassword
 func GenerateTemporaryPassword() (string, error) {
-	// This is a placeholder. In a real implementation, you would:
-	// 1. Generate a cryptographically secure random string
-	// 2. Ensure it meets password requirements
-	// 3. Return it along with its hash
-	return "", errors.New("not implemented")
+	const length = 16
+
+	password := make([]byte, 0, length)
+	all := strings.Join(temporaryPasswordAlphabet, "")
+
+	// One character from each class, the rest from the whole alphabet
+	for i := 0; i < length; i++ {
+		set := all
+		if i < len(temporaryPasswordAlphabet) {
+			set = temporaryPasswordAlphabet[i]
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(set))))
+		if err != nil {
+			return "", err
+		}
+		password = append(password, set[n.Int64()])
+	}
+
+	// Shuffle so the guaranteed classes aren't always at the front
+	for i := len(password) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		password[i], password[j] = password[j], password[i]
+	}
+
+	return string(password), nil
 }
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+const passwordResetExpiry = time.Hour
+
+// PasswordResetter issues the one-time tokens emailed for password resets
+type PasswordResetter struct {
+	tokens oneTimeTokens
+}
+
+func NewPasswordResetter(kv KV) *PasswordResetter {
+	return &PasswordResetter{
+		tokens: oneTimeTokens{kv: kv, prefix: "password_reset:", ttl: passwordResetExpiry},
+	}
+}
+
+// GenerateToken creates a new reset token for the given user
+func (pr *PasswordResetter) GenerateToken(ctx context.Context, userID string) (string, error) {
+	return pr.tokens.generate(ctx, userID)
+}
+
+// ConsumeToken validates the token and returns the associated user ID. The
+// token can't be used again afterwards.
+func (pr *PasswordResetter) ConsumeToken(ctx context.Context, token string) (string, error) {
+	return pr.tokens.consume(ctx, token)
+}
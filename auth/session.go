@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrTokenRevoked    = errors.New("refresh token has been revoked")
+	ErrTokenReused     = errors.New("refresh token has already been used")
+)
+
+const (
+	refreshTokenPrefix   = "refresh_token:"
+	refreshRotatedPrefix = "refresh_rotated:"
+	refreshFamilyPrefix  = "refresh_family:"
+	userSessionsPrefix   = "user_sessions:"
+	sessionInfoPrefix    = "session_info:"
+)
+
+// RefreshSession is the server-side record of one issued refresh token.
+// Every token rotated from the same login shares a SessionID (the token family).
+type RefreshSession struct {
+	ID        string    `json:"id"`
+	SessionID string    `json:"session_id"`
+	UserID    string    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Device identifies the client a session was started from
+type Device struct {
+	UserAgent string
+	IP        string
+}
+
+// SessionInfo describes one logged in device. It lives as long as the
+// session's latest refresh token.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// Current is set when listing sessions for the session making the request
+	Current bool `json:"current"`
+}
+
+// SessionStore keeps track of refresh tokens so they can be rotated on every
+// use and revoked before they expire
+type SessionStore struct {
+	kv   KV
+	keys *KeySet
+}
+
+func NewSessionStore(kv KV, keys *KeySet) *SessionStore {
+	return &SessionStore{kv: kv, keys: keys}
+}
+
+// Start records a new session for a token pair issued at login, along with
+// the device it was issued to
+func (s *SessionStore) Start(ctx context.Context, userID string, pair *TokenPair, device Device) error {
+	now := time.Now()
+	info := SessionInfo{
+		ID:         pair.SessionID,
+		UserAgent:  device.UserAgent,
+		IP:         device.IP,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+	if err := s.saveInfo(ctx, &info, time.Until(pair.RefreshExpiresAt)); err != nil {
+		return err
+	}
+	return s.Track(ctx, userID, pair)
+}
+
+// Touch marks a session as used from the given device, typically after its
+// refresh token was rotated
+func (s *SessionStore) Touch(ctx context.Context, pair *TokenPair, device Device) error {
+	info, err := s.info(ctx, pair.SessionID)
+	if err == ErrSessionNotFound {
+		// Sessions started before devices were recorded
+		info = &SessionInfo{ID: pair.SessionID}
+	} else if err != nil {
+		return err
+	}
+
+	info.UserAgent = device.UserAgent
+	info.IP = device.IP
+	info.LastUsedAt = time.Now()
+	return s.saveInfo(ctx, info, time.Until(pair.RefreshExpiresAt))
+}
+
+func (s *SessionStore) saveInfo(ctx context.Context, info *SessionInfo, ttl time.Duration) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return s.kv.Set(ctx, sessionInfoPrefix+info.ID, string(data), ttl)
+}
+
+func (s *SessionStore) info(ctx context.Context, sessionID string) (*SessionInfo, error) {
+	data, err := s.kv.Get(ctx, sessionInfoPrefix+sessionID)
+	if err == ErrKeyNotFound {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var info SessionInfo
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// List returns the user's active sessions, most recently used first
+func (s *SessionStore) List(ctx context.Context, userID string) ([]SessionInfo, error) {
+	sessionIDs, err := s.kv.SMembers(ctx, userSessionsPrefix+userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []SessionInfo{}
+	for _, sessionID := range sessionIDs {
+		info, err := s.info(ctx, sessionID)
+		if err == ErrSessionNotFound {
+			// Either the session expired, or it predates device tracking
+			// and is only known by its refresh tokens
+			tokenIDs, err := s.kv.SMembers(ctx, refreshFamilyPrefix+sessionID)
+			if err != nil {
+				return nil, err
+			}
+			if len(tokenIDs) == 0 {
+				if err := s.kv.SRem(ctx, userSessionsPrefix+userID, sessionID); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			info = &SessionInfo{ID: sessionID}
+		} else if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *info)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+// Track records a freshly issued token pair so its refresh token can later be rotated
+func (s *SessionStore) Track(ctx context.Context, userID string, pair *TokenPair) error {
+	session := RefreshSession{
+		ID:        pair.RefreshID,
+		SessionID: pair.SessionID,
+		UserID:    userID,
+		ExpiresAt: pair.RefreshExpiresAt,
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(session.ExpiresAt)
+	if err := s.kv.Set(ctx, refreshTokenPrefix+session.ID, string(data), ttl); err != nil {
+		return err
+	}
+	if err := s.kv.SAdd(ctx, refreshFamilyPrefix+session.SessionID, ttl, session.ID); err != nil {
+		return err
+	}
+	return s.kv.SAdd(ctx, userSessionsPrefix+userID, refreshTokenDuration, session.SessionID)
+}
+
+// get loads the refresh session for a token ID
+func (s *SessionStore) get(ctx context.Context, tokenID string) (*RefreshSession, error) {
+	data, err := s.kv.Get(ctx, refreshTokenPrefix+tokenID)
+	if err == ErrKeyNotFound {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var session RefreshSession
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Rotate exchanges a refresh token for a new token pair in the same session.
+// Presenting a token that was already rotated means it has leaked, so the
+// whole session is revoked and ErrTokenReused is returned.
+//
+// The new tokens are issued from the user as load currently finds them, so
+// profile and role changes are picked up. Sessions of deleted or suspended
+// users, or from before the user's tokens were revoked, are ended.
+func (s *SessionStore) Rotate(ctx context.Context, refreshToken string, load SubjectLoader) (*TokenPair, error) {
+	claims, err := ValidateToken(s.keys, refreshToken, TokenTypeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens issued before sessions were tracked carry no ID and can't be rotated
+	if claims.ID == "" || claims.SessionID == "" {
+		return nil, ErrTokenRevoked
+	}
+
+	session, err := s.get(ctx, claims.ID)
+	if err == ErrSessionNotFound {
+		return nil, ErrTokenRevoked
+	} else if err != nil {
+		return nil, err
+	}
+
+	if session.UserID != claims.UserID.Hex() || session.SessionID != claims.SessionID {
+		return nil, ErrInvalidClaims
+	}
+
+	subject, err := load(ctx, claims.UserID)
+	if err == ErrAccountDisabled {
+		if err := s.RevokeSession(ctx, session.UserID, session.SessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrAccountDisabled
+	} else if err != nil {
+		return nil, err
+	}
+	if claims.TokenVersion != subject.TokenVersion {
+		if err := s.RevokeSession(ctx, session.UserID, session.SessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrTokenRevoked
+	}
+
+	pair, err := generateTokenPair(s.keys, subject, claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the first caller may rotate a given token
+	rotated, err := s.kv.SetNX(ctx, refreshRotatedPrefix+session.ID, pair.RefreshID, time.Until(session.ExpiresAt))
+	if err != nil {
+		return nil, err
+	}
+	if !rotated {
+		if err := s.RevokeSession(ctx, session.UserID, session.SessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrTokenReused
+	}
+
+	if err := s.Track(ctx, session.UserID, pair); err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+// RevokeSession invalidates every refresh token issued to the given session
+func (s *SessionStore) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	tokenIDs, err := s.kv.SMembers(ctx, refreshFamilyPrefix+sessionID)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{refreshFamilyPrefix + sessionID, sessionInfoPrefix + sessionID}
+	for _, id := range tokenIDs {
+		keys = append(keys, refreshTokenPrefix+id, refreshRotatedPrefix+id)
+	}
+	if err := s.kv.Del(ctx, keys...); err != nil {
+		return err
+	}
+
+	return s.kv.SRem(ctx, userSessionsPrefix+userID, sessionID)
+}
+
+// RevokeAll invalidates every refresh token issued to the user
+func (s *SessionStore) RevokeAll(ctx context.Context, userID string) error {
+	sessionIDs, err := s.kv.SMembers(ctx, userSessionsPrefix+userID)
+	if err != nil {
+		return err
+	}
+
+	for _, sessionID := range sessionIDs {
+		if err := s.RevokeSession(ctx, userID, sessionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
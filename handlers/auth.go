@@ -1,11 +1,17 @@
 package handlers
 
 import (
+	"context"
+	"log"
+	"math"
 	"net/http"
-	"os"
+	"strconv"
+	"sync"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 
 	"backend-dragonhak/auth"
@@ -28,30 +34,157 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	// Find user by email
+	user, ok := checkCredentials(c, req)
+	if !ok {
+		return
+	}
+
+	if user.SuspendedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is suspended"})
+		return
+	}
+
+	if user.DeletedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is scheduled for deletion, restore it to log in again"})
+		return
+	}
+
+	// With two-factor enabled, failures are only cleared once the second
+	// factor is through too
+	if user.MFA == nil || !user.MFA.Enabled {
+		loginSucceeded(c, user.Email)
+	}
+	respondWithFirstFactor(c, user)
+}
+
+// respondWithFirstFactor completes a login that has proven the first factor,
+// a password or an external identity. With two-factor enabled that only
+// earns a challenge, which is exchanged for tokens at /login/mfa.
+func respondWithFirstFactor(c *gin.Context, user models.User) {
+	if user.MFA != nil && user.MFA.Enabled {
+		challenge, err := Stores.MFA.Issue(c, user.ID.Hex())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor login"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required": true,
+			"mfa_token":    challenge,
+		})
+		return
+	}
+
+	respondWithTokens(c, user)
+}
+
+// checkCredentials looks up the user and checks their password, subject to
+// login throttling. On failure it has already responded.
+func checkCredentials(c *gin.Context, req LoginRequest) (models.User, bool) {
 	var user models.User
+
+	// Refuse early while the account or IP is locked out, even if the
+	// password would be right
+	if loginLocked(c, req.Email) {
+		return user, false
+	}
+
+	// Find user by email
 	err := Collections.Users.FindOne(c, bson.M{"email": req.Email}).Decode(&user)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
-		return
+		// Spend the same time as a wrong password so unknown emails can't be
+		// told apart by response time
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(req.Password))
+		loginFailed(c, req.Email)
+		return user, false
 	}
 
 	// Compare password
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		loginFailed(c, req.Email)
+		return user, false
+	}
+
+	return user, true
+}
+
+// loginLocked responds with 429 if the account or the client IP is locked
+// out after too many failed logins
+func loginLocked(c *gin.Context, email string) bool {
+	wait, err := Stores.Logins.Check(c, email, c.ClientIP())
+	if err == auth.ErrLoginLocked {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts, try again later"})
+		return true
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+		return true
+	}
+	return false
+}
+
+// RestoreAccount lets users reopen their deleted account with their password
+// during the grace period. They log in as usual afterwards, so two-factor
+// authentication still applies.
+func RestoreAccount(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	user, ok := checkCredentials(c, req)
+	if !ok {
 		return
 	}
 
-	// Generate token pair
-	tokenPair, err := auth.GenerateTokenPair(
-		user.ID,
-		user.Name,
-		user.Surname,
-		string(user.Role),
-		os.Getenv("JWT_ACCESS_SECRET"),
-		os.Getenv("JWT_REFRESH_SECRET"),
-	)
+	if user.DeletedAt == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Account is not scheduled for deletion"})
+		return
+	}
+
+	if err := restoreUser(c, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore account"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account restored, you can log in again"})
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// dummyPasswordHash returns a bcrypt hash to compare against when there is no
+// user to check
+func dummyPasswordHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+// loginFailed records a failed attempt and sends the same response whether
+// the email or the password was wrong
+func loginFailed(c *gin.Context, email string) {
+	if err := Stores.Logins.RecordFailure(c, email, c.ClientIP()); err != nil {
+		log.Printf("Login: failed to record login failure: %v", err)
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+}
+
+// loginSucceeded clears the failed logins of email once every factor has
+// been proven
+func loginSucceeded(c *gin.Context, email string) {
+	if err := Stores.Logins.RecordSuccess(c, email); err != nil {
+		log.Printf("Login: failed to clear login failures: %v", err)
+	}
+}
+
+// respondWithTokens starts a session for user and returns its tokens
+func respondWithTokens(c *gin.Context, user models.User) {
+	tokenPair, err := issueTokenPair(c, user, clientDevice(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
 		return
@@ -60,14 +193,53 @@ func Login(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"access_token":  tokenPair.AccessToken,
 		"refresh_token": tokenPair.RefreshToken,
-		"user": gin.H{
-			"id":    user.ID.Hex(),
-			"email": user.Email,
-			"role":  user.Role,
-		},
+		"user":          models.NewProfileView(user),
 	})
 }
 
+// issueTokenPair generates a token pair for the user and starts a refresh
+// session for it on the given device
+func issueTokenPair(ctx context.Context, user models.User, device auth.Device) (*auth.TokenPair, error) {
+	tokenPair, err := auth.GenerateTokenPair(Stores.Keys, tokenSubject(user))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Stores.Sessions.Start(ctx, user.ID.Hex(), tokenPair, device); err != nil {
+		return nil, err
+	}
+
+	return tokenPair, nil
+}
+
+// tokenSubject returns the claims tokens are issued to the user with
+func tokenSubject(user models.User) *auth.TokenSubject {
+	return &auth.TokenSubject{
+		UserID:       user.ID,
+		Name:         user.Name,
+		Surname:      user.Surname,
+		Role:         string(user.Role),
+		TokenVersion: user.TokenVersion,
+	}
+}
+
+// loadTokenSubject reloads a user when their session is refreshed, so tokens
+// always carry the current profile and role
+func loadTokenSubject(ctx context.Context, userID primitive.ObjectID) (*auth.TokenSubject, error) {
+	var user models.User
+	err := Collections.Users.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, auth.ErrAccountDisabled
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user.SuspendedAt != nil || user.DeletedAt != nil {
+		return nil, auth.ErrAccountDisabled
+	}
+	return tokenSubject(user), nil
+}
+
 func RefreshToken(c *gin.Context) {
 	var req RefreshTokenRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -75,34 +247,63 @@ func RefreshToken(c *gin.Context) {
 		return
 	}
 
-	// Generate new access token using refresh token
-	accessToken, err := auth.RefreshAccessToken(
-		req.RefreshToken,
-		os.Getenv("JWT_ACCESS_SECRET"),
-		os.Getenv("JWT_REFRESH_SECRET"),
-	)
+	// Exchange the refresh token for a new pair; the old one stops working
+	tokenPair, err := Stores.Sessions.Rotate(c, req.RefreshToken, loadTokenSubject)
 	if err != nil {
 		switch err {
 		case auth.ErrExpiredToken:
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has expired"})
-		case auth.ErrInvalidToken:
+		case auth.ErrInvalidToken, auth.ErrInvalidClaims:
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		case auth.ErrTokenRevoked:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has been revoked"})
+		case auth.ErrAccountDisabled:
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account is suspended or deleted"})
+		case auth.ErrTokenReused:
+			log.Printf("RefreshToken: reused refresh token detected, session revoked")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has already been used"})
 		default:
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
 		}
 		return
 	}
 
+	if err := Stores.Sessions.Touch(c, tokenPair, clientDevice(c)); err != nil {
+		log.Printf("RefreshToken: failed to record session use: %v", err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"access_token": accessToken,
+		"access_token":  tokenPair.AccessToken,
+		"refresh_token": tokenPair.RefreshToken,
 	})
 }
 
 func Logout(c *gin.Context) {
-	// In a real implementation, you would:
-	// 1. Get the token from the request
-	// 2. Add it to a blacklist in Redis or similar
-	// 3. The token would be valid until it expires naturally
-	// For now, we'll just return success
+	userID := c.GetString("user_id")
+	sessionID := c.GetString("session_id")
+	if sessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is not bound to a session"})
+		return
+	}
+
+	if err := Stores.Sessions.RevokeSession(c, userID, sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	// Cut off the session's access tokens too, not just its refresh token
+	if err := Stores.Denylist.RevokeSession(c, sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
+
+// JWKS publishes the public keys tokens are signed with, so other services
+// can verify them without sharing a secret
+func JWKS(c *gin.Context) {
+	// Short enough that a newly rotated key is picked up before it signs much
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, Stores.Keys.JWKS())
+}
@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"backend-dragonhak/auth"
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testPassword = "StrongP@ss123"
+
+// setupAuthRouter creates a router with the auth endpoints and a registered user
+func setupAuthRouter(t *testing.T) (*gin.Engine, models.User) {
+	hash, err := auth.HashPassword(testPassword)
+	require.NoError(t, err)
+
+	user := models.User{
+		Name:      "John",
+		Surname:   "Doe",
+		Username:  "johndoe",
+		Email:     "john@example.com",
+		Password:  hash,
+		Role:      models.RoleCustomer,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	_, err = Collections.Users.InsertOne(context.Background(), &user)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.POST("/api/auth/login", Login)
+	router.POST("/api/auth/refresh", RefreshToken)
+	router.POST("/api/auth/logout", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), Logout)
+	router.GET("/api/protected", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": c.GetString("user_id")})
+	})
+
+	return router, user
+}
+
+func performJSON(router *gin.Engine, method, path string, body interface{}, token string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func login(t *testing.T, router *gin.Engine, email string) map[string]interface{} {
+	w := performJSON(router, "POST", "/api/auth/login", gin.H{"email": email, "password": testPassword}, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	tokens := login(t, router, user.Email)
+	firstRefresh := tokens["refresh_token"].(string)
+
+	// First use rotates the token
+	w := performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": firstRefresh}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var rotated map[string]string
+	json.Unmarshal(w.Body.Bytes(), &rotated)
+	assert.NotEmpty(t, rotated["access_token"])
+	assert.NotEmpty(t, rotated["refresh_token"])
+	assert.NotEqual(t, firstRefresh, rotated["refresh_token"])
+
+	// Replaying the rotated token is treated as theft
+	w = performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": firstRefresh}, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "already been used")
+
+	// ...which revokes the whole family, including the latest token
+	w = performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": rotated["refresh_token"]}, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "revoked")
+}
+
+func TestRefreshTokenRejectsInvalidTokens(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+
+	// A stateless token that was never recorded in the session store
+	untracked, err := auth.GenerateTokenPair(Stores.Keys, tokenSubject(user))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		refreshToken string
+	}{
+		{name: "Garbage token", refreshToken: "not-a-jwt"},
+		{name: "Access token used as refresh token", refreshToken: untracked.AccessToken},
+		{name: "Untracked refresh token", refreshToken: untracked.RefreshToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": tt.refreshToken}, "")
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+	}
+}
+
+func TestRefreshReloadsUser(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	ctx := context.Background()
+
+	refresh := func(refreshToken string) (*httptest.ResponseRecorder, map[string]string) {
+		w := performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": refreshToken}, "")
+		var tokens map[string]string
+		json.Unmarshal(w.Body.Bytes(), &tokens)
+		return w, tokens
+	}
+
+	t.Run("Claims survive a refresh and pick up changes", func(t *testing.T) {
+		tokens := login(t, router, user.Email)
+
+		_, err := Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"name": "Johnny", "role": models.RoleCraftsman}})
+		require.NoError(t, err)
+
+		w, rotated := refresh(tokens["refresh_token"].(string))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		claims, err := auth.ValidateToken(Stores.Keys, rotated["access_token"], auth.TokenTypeAccess)
+		require.NoError(t, err)
+		assert.Equal(t, "Johnny", claims.Name)
+		assert.Equal(t, "Doe", claims.Surname)
+		assert.Equal(t, string(models.RoleCraftsman), claims.Role)
+
+		// A second refresh still carries the full identity
+		w, rotated = refresh(rotated["refresh_token"])
+		require.Equal(t, http.StatusOK, w.Code)
+		claims, err = auth.ValidateToken(Stores.Keys, rotated["access_token"], auth.TokenTypeAccess)
+		require.NoError(t, err)
+		assert.Equal(t, "Johnny", claims.Name)
+		assert.Equal(t, "Doe", claims.Surname)
+	})
+
+	t.Run("Tokens from before a revocation are stale", func(t *testing.T) {
+		tokens := login(t, router, user.Email)
+
+		// Bump the version without touching the session store, as if the
+		// session had been missed by the revocation
+		_, err := Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$inc": bson.M{"token_version": 1}})
+		require.NoError(t, err)
+
+		w, _ := refresh(tokens["refresh_token"].(string))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "revoked")
+	})
+
+	t.Run("Suspended users can't refresh", func(t *testing.T) {
+		tokens := login(t, router, user.Email)
+
+		_, err := Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"suspended_at": time.Now()}})
+		require.NoError(t, err)
+		defer Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$unset": bson.M{"suspended_at": ""}})
+
+		w, _ := refresh(tokens["refresh_token"].(string))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Deleted users can't refresh", func(t *testing.T) {
+		tokens := login(t, router, user.Email)
+
+		_, err := Collections.Users.DeleteOne(ctx, bson.M{"_id": user.ID})
+		require.NoError(t, err)
+
+		w, _ := refresh(tokens["refresh_token"].(string))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		// The session is gone, not just refused
+		_, err = Collections.Users.InsertOne(ctx, &user)
+		require.NoError(t, err)
+		w, _ = refresh(tokens["refresh_token"].(string))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	current := login(t, router, user.Email)
+	other := login(t, router, user.Email)
+
+	w := performJSON(router, "POST", "/api/auth/logout", nil, current["access_token"].(string))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The logged out session can no longer be refreshed
+	w = performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": current["refresh_token"]}, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Other devices stay logged in
+	w = performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": other["refresh_token"]}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDenylistedAccessTokens(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+
+	t.Run("Logout revokes the access token", func(t *testing.T) {
+		tokens := login(t, router, user.Email)
+		accessToken := tokens["access_token"].(string)
+
+		w := performJSON(router, "GET", "/api/protected", nil, accessToken)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = performJSON(router, "POST", "/api/auth/logout", nil, accessToken)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = performJSON(router, "GET", "/api/protected", nil, accessToken)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "Token has been revoked")
+	})
+
+	t.Run("Revoking a user cuts off all of their tokens", func(t *testing.T) {
+		first := login(t, router, user.Email)
+		second := login(t, router, user.Email)
+
+		require.NoError(t, revokeUserTokens(context.Background(), user.ID))
+
+		for _, tokens := range []map[string]interface{}{first, second} {
+			w := performJSON(router, "GET", "/api/protected", nil, tokens["access_token"].(string))
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Contains(t, w.Body.String(), "Token has been revoked")
+		}
+
+		// Logging in again right away works, even within the same second
+		tokens := login(t, router, user.Email)
+		w := performJSON(router, "GET", "/api/protected", nil, tokens["access_token"].(string))
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	router.POST("/api/admin/users/:id/unlock", UnlockUser)
+
+	wrongPassword := gin.H{"email": user.Email, "password": "WrongP@ss123"}
+	unknownEmail := gin.H{"email": "nobody@example.com", "password": "WrongP@ss123"}
+
+	// Unknown emails and wrong passwords look the same
+	wrong := performJSON(router, "POST", "/api/auth/login", wrongPassword, "")
+	unknown := performJSON(router, "POST", "/api/auth/login", unknownEmail, "")
+	assert.Equal(t, http.StatusUnauthorized, wrong.Code)
+	assert.Equal(t, wrong.Code, unknown.Code)
+	assert.Equal(t, wrong.Body.String(), unknown.Body.String())
+
+	// Further failures start the back-off, which applies even to the right password
+	for i := 0; i < 2; i++ {
+		w := performJSON(router, "POST", "/api/auth/login", wrongPassword, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	w := performJSON(router, "POST", "/api/auth/login", gin.H{"email": user.Email, "password": testPassword}, "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// Other accounts are unaffected
+	w = performJSON(router, "POST", "/api/auth/login", unknownEmail, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// An admin can lift the lockout
+	w = performJSON(router, "POST", "/api/admin/users/"+user.ID.Hex()+"/unlock", nil, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	login(t, router, user.Email)
+}
+
+func TestLoginLockoutPerIP(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+
+	// Spreading guesses over many accounts still trips the per-IP limit
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 25 && (w == nil || w.Code != http.StatusTooManyRequests); i++ {
+		email := fmt.Sprintf("victim%d@example.com", i)
+		w = performJSON(router, "POST", "/api/auth/login", gin.H{"email": email, "password": "Guess@1234"}, "")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	w = performJSON(router, "POST", "/api/auth/login", gin.H{"email": user.Email, "password": testPassword}, "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	oldKey, err := auth.GenerateKey(auth.AlgRS256)
+	require.NoError(t, err)
+	newKey, err := auth.GenerateKey(auth.AlgEdDSA)
+	require.NoError(t, err)
+	strangerKey, err := auth.GenerateKey(auth.AlgEdDSA)
+	require.NoError(t, err)
+
+	oldKeys, err := auth.NewKeySet(oldKey)
+	require.NoError(t, err)
+	rotatedKeys, err := auth.NewKeySet(newKey, oldKey)
+	require.NoError(t, err)
+	strangerKeys, err := auth.NewKeySet(strangerKey)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.GET("/.well-known/jwks.json", JWKS)
+	router.GET("/api/protected", middleware.AuthMiddleware(rotatedKeys, Stores.Denylist), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	Stores.Keys = rotatedKeys
+
+	userID := primitive.NewObjectID()
+	issue := func(keys *auth.KeySet) *auth.TokenPair {
+		pair, err := auth.GenerateTokenPair(keys, &auth.TokenSubject{UserID: userID, Name: "John", Surname: "Doe", Role: "customer"})
+		require.NoError(t, err)
+		return pair
+	}
+
+	t.Run("Tokens from the retired key are still accepted", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/protected", nil, issue(oldKeys).AccessToken)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Tokens from the active key are accepted", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/protected", nil, issue(rotatedKeys).AccessToken)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Tokens from unknown keys are rejected", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/protected", nil, issue(strangerKeys).AccessToken)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Refresh tokens are not access tokens", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/protected", nil, issue(rotatedKeys).RefreshToken)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("The algorithm is fixed by the key", func(t *testing.T) {
+		// An HMAC token keyed with the public key must not pass as RS256
+		jwk := oldKey.JWK()
+		forged := jwt.NewWithClaims(jwt.SigningMethodHS256, auth.Claims{
+			UserID:    userID,
+			Role:      "admin",
+			TokenType: auth.TokenTypeAccess,
+		})
+		forged.Header["kid"] = jwk.Kid
+		signed, err := forged.SignedString([]byte(jwk.N))
+		require.NoError(t, err)
+
+		w := performJSON(router, "GET", "/api/protected", nil, signed)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("JWKS publishes every verification key", func(t *testing.T) {
+		w := performJSON(router, "GET", "/.well-known/jwks.json", nil, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var set auth.JWKS
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &set))
+		require.Len(t, set.Keys, 2)
+
+		assert.Equal(t, newKey.ID, set.Keys[0].Kid)
+		assert.Equal(t, "OKP", set.Keys[0].Kty)
+		assert.Equal(t, "EdDSA", set.Keys[0].Alg)
+		assert.NotEmpty(t, set.Keys[0].X)
+
+		assert.Equal(t, oldKey.ID, set.Keys[1].Kid)
+		assert.Equal(t, "RSA", set.Keys[1].Kty)
+		assert.Equal(t, "RS256", set.Keys[1].Alg)
+		assert.NotEmpty(t, set.Keys[1].N)
+		assert.Equal(t, "AQAB", set.Keys[1].E)
+		assert.NotContains(t, w.Body.String(), `"d"`)
+	})
+}
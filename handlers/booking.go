@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	errInvalidTransition = errors.New("status can't change that way")
+	errBookingChanged    = errors.New("booking was changed concurrently")
+)
+
+// transitionBooking moves a booking to next, setting any extra fields in set.
+// The update only applies if the booking still has the status it was loaded
+// with, so concurrent transitions can't both succeed.
+func transitionBooking(ctx context.Context, booking models.Booking, next models.BookingStatus, set bson.M) error {
+	if !booking.Status.CanTransitionTo(next) {
+		return errInvalidTransition
+	}
+
+	fields := bson.M{"status": next, "updated_at": time.Now()}
+	for key, value := range set {
+		fields[key] = value
+	}
+	result, err := Collections.Bookings.UpdateOne(ctx,
+		bson.M{"_id": booking.ID, "status": booking.Status},
+		bson.M{"$set": fields},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errBookingChanged
+	}
+	return nil
+}
+
+// releaseSeat cancels a booking and frees the seat it held, recording refund
+// if there is one, all in one transaction
+func releaseSeat(ctx context.Context, booking models.Booking, set bson.M, refund *models.Transaction) error {
+	return Transactions.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := transitionBooking(ctx, booking, models.BookingStatusCancelled, set); err != nil {
+			return err
+		}
+
+		_, err := Collections.Workshops.UpdateOne(ctx,
+			bson.M{"_id": booking.WorkshopID, "current_students": bson.M{"$gt": 0}},
+			bson.M{"$inc": bson.M{"current_students": -1}},
+		)
+		if err != nil {
+			return err
+		}
+
+		if refund != nil {
+			_, err = Collections.Transactions.InsertOne(ctx, refund)
+		}
+		return err
+	})
+}
+
+// cancellationRefund works out what a customer cancelling booking at now is
+// refunded under the workshop's cancellation policy. It returns the fields
+// to set on the cancelled booking and the refund, nil if there is none.
+func cancellationRefund(booking models.Booking, workshop models.Workshop, now time.Time) (bson.M, *models.Transaction) {
+	policy := models.DefaultCancellationPolicy
+	if workshop.CancellationPolicy != nil {
+		policy = *workshop.CancellationPolicy
+	}
+
+	set := bson.M{"cancelled_at": now}
+	amount := policy.Refund(workshop.Price, workshop.Date, now)
+	if booking.Status != models.BookingStatusConfirmed || amount <= 0 {
+		return set, nil
+	}
+
+	refund := &models.Transaction{
+		ID:          primitive.NewObjectID(),
+		UserID:      booking.CustomerID,
+		Amount:      amount,
+		Currency:    models.DefaultCurrency,
+		Status:      models.TransactionStatusRefunded,
+		Description: "Refund for cancelled booking of " + workshop.Title,
+		ReferenceID: booking.ID.Hex(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	set["payment_status"] = models.PaymentStatusRefunded
+	if amount < workshop.Price {
+		set["payment_status"] = models.PaymentStatusPartiallyRefunded
+	}
+	return set, refund
+}
+
+// CancelBooking cancels a booking, freeing its seat for the waitlist and
+// refunding it as the workshop's cancellation policy allows. Pending
+// bookings haven't been paid for, so they aren't refunded.
+func CancelBooking(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var booking models.Booking
+	if err := Collections.Bookings.FindOne(ctx, bson.M{"_id": objID}).Decode(&booking); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	}
+	if !booking.Status.CanTransitionTo(models.BookingStatusCancelled) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A %s booking can't be cancelled", booking.Status)})
+		return
+	}
+
+	var workshop models.Workshop
+	err = Collections.Workshops.FindOne(ctx, bson.M{"_id": booking.WorkshopID}).Decode(&workshop)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workshop not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load workshop"})
+		return
+	}
+
+	now := time.Now()
+	if !now.Before(workshop.Date) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The workshop has already started"})
+		return
+	}
+
+	set, refund := cancellationRefund(booking, workshop, now)
+	err = releaseSeat(ctx, booking, set, refund)
+	if err == errBookingChanged || err == errInvalidTransition {
+		c.JSON(http.StatusConflict, gin.H{"error": "The booking was changed by another request"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel booking"})
+		return
+	}
+
+	// The cancellation stands even if the seat can't be passed on yet; the
+	// waitlist worker retries when offers expire
+	if err := promoteFromWaitlist(ctx, workshop.ID); err != nil {
+		log.Printf("Waitlist: failed to promote for workshop %s: %v", workshop.ID.Hex(), err)
+	}
+
+	if err := Collections.Bookings.FindOne(ctx, bson.M{"_id": booking.ID}).Decode(&booking); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load booking"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"booking": booking,
+		"refund":  refund,
+	})
+}
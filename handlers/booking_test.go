@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCancelBooking(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	customers := router.Group("/api/customers", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), RoutePolicies.Enforce())
+	customers.POST("/workshops/:id/book", BookWorkshop)
+	customers.POST("/bookings/:id/cancel", CancelBooking)
+
+	ctx := context.Background()
+	token := login(t, router, user.Email)["access_token"].(string)
+
+	// book creates a workshop starting after the given time and books it
+	book := func(startsIn time.Duration, policy *models.CancellationPolicy) (workshopID, bookingID primitive.ObjectID) {
+		result, err := Collections.Workshops.InsertOne(ctx, models.Workshop{
+			Title:              "Pottery",
+			Status:             models.WorkshopStatusUpcoming,
+			Date:               time.Now().Add(startsIn),
+			MaxParticipants:    5,
+			Price:              80,
+			CancellationPolicy: policy,
+		})
+		require.NoError(t, err)
+		workshopID = result.InsertedID.(primitive.ObjectID)
+
+		w := performJSON(router, "POST", "/api/customers/workshops/"+workshopID.Hex()+"/book", nil, token)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var booking map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &booking))
+		bookingID, err = primitive.ObjectIDFromHex(booking["id"].(string))
+		require.NoError(t, err)
+		return workshopID, bookingID
+	}
+
+	cancelBooking := func(bookingID primitive.ObjectID) (int, *models.Transaction) {
+		w := performJSON(router, "POST", "/api/customers/bookings/"+bookingID.Hex()+"/cancel", nil, token)
+		var response struct {
+			Booking models.Booking      `json:"booking"`
+			Refund  *models.Transaction `json:"refund"`
+		}
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, models.BookingStatusCancelled, response.Booking.Status)
+			assert.NotNil(t, response.Booking.CancelledAt)
+		}
+		return w.Code, response.Refund
+	}
+
+	t.Run("Full refund well before the workshop", func(t *testing.T) {
+		workshopID, bookingID := book(72*time.Hour, nil)
+
+		status, refund := cancelBooking(bookingID)
+		require.Equal(t, http.StatusOK, status)
+		require.NotNil(t, refund)
+		assert.Equal(t, 80.0, refund.Amount)
+		assert.Equal(t, user.ID, refund.UserID)
+		assert.Equal(t, bookingID.Hex(), refund.ReferenceID)
+
+		// The seat is free again and the refund is on record
+		var workshop models.Workshop
+		require.NoError(t, Collections.Workshops.FindOne(ctx, bson.M{"_id": workshopID}).Decode(&workshop))
+		assert.Zero(t, workshop.CurrentStudents)
+		count, err := Collections.Transactions.CountDocuments(ctx, bson.M{"reference_id": bookingID.Hex()})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+
+		// Cancelled is final
+		status, _ = cancelBooking(bookingID)
+		assert.Equal(t, http.StatusConflict, status)
+	})
+
+	t.Run("No refund inside the default 48 hours", func(t *testing.T) {
+		_, bookingID := book(24*time.Hour, nil)
+
+		status, refund := cancelBooking(bookingID)
+		require.Equal(t, http.StatusOK, status)
+		assert.Nil(t, refund)
+	})
+
+	t.Run("Partial refund under the workshop's own policy", func(t *testing.T) {
+		_, bookingID := book(24*time.Hour, &models.CancellationPolicy{
+			FullRefundHours:      72,
+			PartialRefundHours:   12,
+			PartialRefundPercent: 50,
+		})
+
+		status, refund := cancelBooking(bookingID)
+		require.Equal(t, http.StatusOK, status)
+		require.NotNil(t, refund)
+		assert.Equal(t, 40.0, refund.Amount)
+
+		var booking models.Booking
+		require.NoError(t, Collections.Bookings.FindOne(ctx, bson.M{"_id": bookingID}).Decode(&booking))
+		assert.Equal(t, models.PaymentStatusPartiallyRefunded, booking.PaymentStatus)
+	})
+
+	t.Run("Completed bookings can't be cancelled", func(t *testing.T) {
+		_, bookingID := book(72*time.Hour, nil)
+		_, err := Collections.Bookings.UpdateOne(ctx, bson.M{"_id": bookingID}, bson.M{"$set": bson.M{"status": models.BookingStatusCompleted}})
+		require.NoError(t, err)
+
+		status, _ := cancelBooking(bookingID)
+		assert.Equal(t, http.StatusConflict, status)
+	})
+
+	t.Run("Workshops that started can't be cancelled", func(t *testing.T) {
+		workshopID, bookingID := book(time.Hour, nil)
+		_, err := Collections.Workshops.UpdateOne(ctx, bson.M{"_id": workshopID}, bson.M{"$set": bson.M{"date": time.Now().Add(-time.Minute)}})
+		require.NoError(t, err)
+
+		status, _ := cancelBooking(bookingID)
+		assert.Equal(t, http.StatusConflict, status)
+	})
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"backend-dragonhak/auth"
+	"backend-dragonhak/models"
+	"backend-dragonhak/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EnableCalendarFeeds issues the caller a new calendar token, replacing any
+// earlier one, and returns their subscribable feed URLs. Craftsmen get a
+// teaching feed as well as a bookings feed.
+func EnableCalendarFeeds(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	token, hash, err := auth.GenerateCalendarToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate calendar token"})
+		return
+	}
+	result, err := Collections.Users.UpdateOne(ctx,
+		bson.M{"_id": userID, "deleted_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"calendar_token_hash": hash, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save calendar token"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	feeds := gin.H{"bookings": calendarFeedURL(token, "bookings.ics")}
+	var craftsman models.Craftsman
+	if Collections.Craftsmen.FindOne(ctx, bson.M{"user_id": userID, "deleted_at": bson.M{"$exists": false}}).Decode(&craftsman) == nil {
+		feeds["teaching"] = calendarFeedURL(token, "teaching.ics")
+	}
+	c.JSON(http.StatusOK, gin.H{"feeds": feeds})
+}
+
+// DisableCalendarFeeds revokes the caller's calendar token, so their feed
+// URLs stop working
+func DisableCalendarFeeds(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	_, err = Collections.Users.UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{"$unset": bson.M{"calendar_token_hash": ""}, "$set": bson.M{"updated_at": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable calendar feeds"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Calendar feeds disabled"})
+}
+
+// GetBookingCalendar returns a booking as a single-event .ics file
+func GetBookingCalendar(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var booking models.Booking
+	if err := Collections.Bookings.FindOne(ctx, bson.M{"_id": objID}).Decode(&booking); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	}
+	var workshop models.Workshop
+	if err := Collections.Workshops.FindOne(ctx, bson.M{"_id": booking.WorkshopID}).Decode(&workshop); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workshop not found"})
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="booking-`+booking.ID.Hex()+`.ics"`)
+	respondCalendar(c, services.Calendar{Events: []services.CalendarEvent{bookingEvent(booking, workshop)}})
+}
+
+// GetBookingsFeed is the calendar feed of a customer's confirmed and
+// completed bookings, authenticated by the calendar token in the URL
+func GetBookingsFeed(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, ok := calendarUser(ctx, c)
+	if !ok {
+		return
+	}
+
+	var bookings []models.Booking
+	err := findAll(ctx, Collections.Bookings, bson.M{
+		"customer_id": user.ID,
+		"status":      bson.M{"$in": bson.A{models.BookingStatusConfirmed, models.BookingStatusCompleted}},
+	}, &bookings)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load bookings"})
+		return
+	}
+
+	workshopIDs := bson.A{}
+	for _, booking := range bookings {
+		workshopIDs = append(workshopIDs, booking.WorkshopID)
+	}
+	var workshops []models.Workshop
+	if err := findAll(ctx, Collections.Workshops, bson.M{"_id": bson.M{"$in": workshopIDs}}, &workshops); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load workshops"})
+		return
+	}
+	byID := map[primitive.ObjectID]models.Workshop{}
+	for _, workshop := range workshops {
+		byID[workshop.ID] = workshop
+	}
+
+	calendar := services.Calendar{Name: "My workshops"}
+	for _, booking := range bookings {
+		if workshop, ok := byID[booking.WorkshopID]; ok {
+			calendar.Events = append(calendar.Events, bookingEvent(booking, workshop))
+		}
+	}
+	respondCalendar(c, calendar)
+}
+
+// GetTeachingFeed is the calendar feed of the workshops a craftsman runs,
+// authenticated by the calendar token in the URL. Drafts are left out.
+func GetTeachingFeed(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, ok := calendarUser(ctx, c)
+	if !ok {
+		return
+	}
+
+	var craftsman models.Craftsman
+	if err := Collections.Craftsmen.FindOne(ctx, bson.M{"user_id": user.ID, "deleted_at": bson.M{"$exists": false}}).Decode(&craftsman); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+		return
+	}
+	workshops, err := craftsmanWorkshops(ctx, craftsman.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load workshops"})
+		return
+	}
+
+	calendar := services.Calendar{Name: "Teaching"}
+	for _, workshop := range workshops {
+		if workshop.Status == models.WorkshopStatusDraft {
+			continue
+		}
+		event := workshopEvent(workshop, "workshop-"+workshop.ID.Hex(), workshop.UpdatedAt)
+		seats := fmt.Sprintf("%d of %d seats booked", workshop.CurrentStudents, workshop.MaxParticipants)
+		if workshop.Description != "" {
+			seats = workshop.Description + "\n\n" + seats
+		}
+		event.Description = seats
+		event.URL = Mail.BaseURL + "/workshops/" + workshop.ID.Hex()
+		calendar.Events = append(calendar.Events, event)
+	}
+	respondCalendar(c, calendar)
+}
+
+// calendarUser finds the active user whose calendar token is in :token,
+// responding with 404 if there is none so feed URLs can't be probed
+func calendarUser(ctx context.Context, c *gin.Context) (models.User, bool) {
+	var user models.User
+	err := Collections.Users.FindOne(ctx, bson.M{
+		"calendar_token_hash": auth.HashCalendarToken(c.Param("token")),
+		"deleted_at":          bson.M{"$exists": false},
+		"suspended_at":        bson.M{"$exists": false},
+	}).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Calendar not found"})
+		return user, false
+	}
+	return user, true
+}
+
+// bookingEvent describes a booking's workshop from the customer's side
+func bookingEvent(booking models.Booking, workshop models.Workshop) services.CalendarEvent {
+	updated := booking.UpdatedAt
+	if workshop.UpdatedAt.After(updated) {
+		updated = workshop.UpdatedAt
+	}
+	event := workshopEvent(workshop, "booking-"+booking.ID.Hex(), updated)
+	event.URL = Mail.BaseURL + "/bookings/" + booking.ID.Hex()
+
+	switch {
+	case event.Status == services.EventCancelled:
+	case booking.Status == models.BookingStatusCancelled:
+		event.Status = services.EventCancelled
+	case booking.Status == models.BookingStatusPending:
+		event.Status = services.EventTentative
+	}
+	return event
+}
+
+// workshopEvent describes a workshop as a calendar event with the given UID
+// prefix, confirmed unless the workshop was cancelled
+func workshopEvent(workshop models.Workshop, uid string, updated time.Time) services.CalendarEvent {
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	event := services.CalendarEvent{
+		UID:         uid + "@" + calendarDomain(),
+		Summary:     workshop.Title,
+		Description: workshop.Description,
+		Location:    workshop.Location,
+		Start:       workshop.Date,
+		End:         workshop.EndsAt(),
+		Status:      services.EventConfirmed,
+		Updated:     updated,
+	}
+	if workshop.Status == models.WorkshopStatusCancelled {
+		event.Status = services.EventCancelled
+	}
+	return event
+}
+
+// calendarDomain is the domain event UIDs are scoped to
+func calendarDomain() string {
+	if u, err := url.Parse(Mail.BaseURL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "dragonhak"
+}
+
+// calendarFeedURL returns the URL of one of the feeds for a calendar token
+func calendarFeedURL(token, feed string) string {
+	return Mail.BaseURL + "/api/calendar/" + token + "/" + feed
+}
+
+// respondCalendar writes calendar as an iCalendar response. Calendars are
+// personal, so shared caches must not keep them.
+func respondCalendar(c *gin.Context, calendar services.Calendar) {
+	c.Header("Cache-Control", "private")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", calendar.Bytes())
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// unfoldCalendar checks that every content line of an iCalendar document
+// is CRLF terminated and at most 75 octets, and returns the unfolded lines
+func unfoldCalendar(t *testing.T, body string) []string {
+	require.True(t, strings.HasSuffix(body, "\r\n"))
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(line), 75, "line too long: %q", line)
+		assert.NotContains(t, line, "\n")
+		if strings.HasPrefix(line, " ") {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestCalendarFeeds(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, john := setupAuthRouter(t)
+	authorized := router.Group("/api", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), RoutePolicies.Enforce())
+	authorized.POST("/users/me/calendar", EnableCalendarFeeds)
+	authorized.DELETE("/users/me/calendar", DisableCalendarFeeds)
+	authorized.GET("/customers/bookings/:id/calendar.ics", GetBookingCalendar)
+	router.GET("/api/calendar/:token/bookings.ics", GetBookingsFeed)
+	router.GET("/api/calendar/:token/teaching.ics", GetTeachingFeed)
+
+	ctx := context.Background()
+	johnToken := tokenFor(t, john)
+	potter, craftsmanID := newCraftsman(t, "potter")
+	potterToken := tokenFor(t, potter)
+
+	start := time.Date(2030, time.May, 7, 16, 0, 0, 0, time.UTC)
+	workshop := func(title string, status models.WorkshopStatus) primitive.ObjectID {
+		result, err := Collections.Workshops.InsertOne(ctx, models.Workshop{
+			Title:           title,
+			Description:     "Clay, glaze; and\nfiring",
+			Location:        "Trubarjeva 5, Ljubljana",
+			Status:          status,
+			Date:            start,
+			Duration:        2,
+			MaxParticipants: 6,
+			CurrentStudents: 1,
+			CraftsmanID:     craftsmanID,
+			UpdatedAt:       start.AddDate(0, -1, 0),
+		})
+		require.NoError(t, err)
+		return result.InsertedID.(primitive.ObjectID)
+	}
+	book := func(workshopID primitive.ObjectID, status models.BookingStatus) primitive.ObjectID {
+		result, err := Collections.Bookings.InsertOne(ctx, models.Booking{WorkshopID: workshopID, CustomerID: john.ID, Status: status})
+		require.NoError(t, err)
+		return result.InsertedID.(primitive.ObjectID)
+	}
+
+	longTitle := "Wheel throwing for beginners: centring, opening, pulling walls and trimming – čaša"
+	confirmed := book(workshop(longTitle, models.WorkshopStatusUpcoming), models.BookingStatusConfirmed)
+	book(workshop("Raku", models.WorkshopStatusUpcoming), models.BookingStatusCancelled)
+	pending := book(workshop("Glazing", models.WorkshopStatusUpcoming), models.BookingStatusPending)
+	workshop("Kiln building", models.WorkshopStatusDraft)
+	workshop("Slip casting", models.WorkshopStatusCancelled)
+
+	enable := func(token string) map[string]string {
+		w := performJSON(router, "POST", "/api/users/me/calendar", nil, token)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response struct {
+			Feeds map[string]string `json:"feeds"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		for name, url := range response.Feeds {
+			require.True(t, strings.HasPrefix(url, Mail.BaseURL), "%s feed at %s", name, url)
+			response.Feeds[name] = strings.TrimPrefix(url, Mail.BaseURL)
+		}
+		return response.Feeds
+	}
+	fetch := func(path string) (int, []string) {
+		w := performJSON(router, "GET", path, nil, "")
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		assert.Equal(t, "text/calendar; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, "private", w.Header().Get("Cache-Control"))
+		return w.Code, unfoldCalendar(t, w.Body.String())
+	}
+	unescape := strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, "\n", `\\`, `\`)
+	events := func(lines []string) []string {
+		var summaries []string
+		for _, line := range lines {
+			if strings.HasPrefix(line, "SUMMARY:") {
+				summaries = append(summaries, unescape.Replace(strings.TrimPrefix(line, "SUMMARY:")))
+			}
+		}
+		return summaries
+	}
+
+	feeds := enable(johnToken)
+	assert.NotContains(t, feeds, "teaching", "John doesn't teach")
+
+	t.Run("Bookings feed lists confirmed bookings", func(t *testing.T) {
+		status, lines := fetch(feeds["bookings"])
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "BEGIN:VCALENDAR", lines[0])
+		assert.Equal(t, "END:VCALENDAR", lines[len(lines)-1])
+		assert.Equal(t, []string{longTitle}, events(lines))
+
+		assert.Contains(t, lines, "UID:booking-"+confirmed.Hex()+"@localhost")
+		assert.Contains(t, lines, "DTSTART:20300507T160000Z")
+		assert.Contains(t, lines, "DTEND:20300507T180000Z")
+		assert.Contains(t, lines, "DTSTAMP:20300407T160000Z")
+		assert.Contains(t, lines, `DESCRIPTION:Clay\, glaze\; and\nfiring`)
+		assert.Contains(t, lines, `LOCATION:Trubarjeva 5\, Ljubljana`)
+		assert.Contains(t, lines, "STATUS:CONFIRMED")
+	})
+
+	t.Run("Feed tokens can be rotated and revoked", func(t *testing.T) {
+		status, _ := fetch("/api/calendar/" + strings.Repeat("0", 64) + "/bookings.ics")
+		assert.Equal(t, http.StatusNotFound, status)
+
+		rotated := enable(johnToken)
+		status, _ = fetch(feeds["bookings"])
+		assert.Equal(t, http.StatusNotFound, status)
+		status, _ = fetch(rotated["bookings"])
+		assert.Equal(t, http.StatusOK, status)
+
+		w := performJSON(router, "DELETE", "/api/users/me/calendar", nil, johnToken)
+		require.Equal(t, http.StatusOK, w.Code)
+		status, _ = fetch(rotated["bookings"])
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("A single booking downloads as one event", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/customers/bookings/"+pending.Hex()+"/calendar.ics", nil, johnToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "booking-"+pending.Hex()+".ics")
+		lines := unfoldCalendar(t, w.Body.String())
+		assert.Equal(t, []string{"Glazing"}, events(lines))
+		assert.Contains(t, lines, "STATUS:TENTATIVE")
+
+		w = performJSON(router, "GET", "/api/customers/bookings/"+pending.Hex()+"/calendar.ics", nil, potterToken)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Teaching feed lists published workshops", func(t *testing.T) {
+		teaching := enable(potterToken)["teaching"]
+		require.NotEmpty(t, teaching)
+
+		status, lines := fetch(teaching)
+		require.Equal(t, http.StatusOK, status)
+		assert.ElementsMatch(t, []string{longTitle, "Raku", "Glazing", "Slip casting"}, events(lines))
+		assert.Contains(t, lines, "STATUS:CANCELLED")
+		assert.Contains(t, lines, `DESCRIPTION:Clay\, glaze\; and\nfiring\n\n1 of 6 seats booked`)
+
+		// Potter has no bookings, and an empty feed still has a component
+		status, lines = fetch(strings.Replace(teaching, "teaching.ics", "bookings.ics", 1))
+		require.Equal(t, http.StatusOK, status)
+		assert.Empty(t, events(lines))
+		assert.Contains(t, lines, "BEGIN:VTIMEZONE")
+		assert.NotContains(t, lines, "BEGIN:VEVENT")
+
+		// A customer's token doesn't open a teaching feed
+		status, _ = fetch(strings.Replace(enable(johnToken)["bookings"], "bookings.ics", "teaching.ics", 1))
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+}
@@ -12,20 +12,30 @@ type Collection interface {
 	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
 	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
 	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
 	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
 	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
 }
 
 // Collections holds all MongoDB collections
 var Collections struct {
-	Users     Collection
-	Craftsmen Collection
-	Crafts    Collection
-	Workshops Collection
-	Badges    Collection
-	Auctions  Collection
-	Bids      Collection
-	Bookings  Collection
+	Users          Collection
+	Craftsmen      Collection
+	Crafts         Collection
+	Workshops      Collection
+	Badges         Collection
+	Auctions       Collection
+	Bids           Collection
+	Bookings       Collection
+	Images         Collection
+	Erasures       Collection
+	Reviews        Collection
+	Exports        Collection
+	Transactions   Collection
+	Waitlist       Collection
+	WorkshopSeries Collection
 }
 
 // InitCollections initializes all collections
@@ -38,4 +48,12 @@ func InitCollections(db *mongo.Database) {
 	Collections.Auctions = db.Collection("auctions")
 	Collections.Bids = db.Collection("bids")
 	Collections.Bookings = db.Collection("bookings")
+	Collections.Images = db.Collection("images")
+	Collections.Erasures = db.Collection("erasures")
+	Collections.Reviews = db.Collection("reviews")
+	Collections.Exports = db.Collection("exports")
+	Collections.Transactions = db.Collection("transactions")
+	Collections.Waitlist = db.Collection("waitlist")
+	Collections.WorkshopSeries = db.Collection("workshop_series")
+	Transactions = NewMongoTransactor(db.Client())
 }
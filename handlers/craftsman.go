@@ -2,8 +2,8 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
-	"os"
 	"time"
 
 	"backend-dragonhak/auth"
@@ -12,10 +12,14 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/crypto/bcrypt"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// CreateCraftsmanProfile creates a new craftsman profile
+// errEmailTaken aborts a registration whose email is already in use
+var errEmailTaken = errors.New("email already exists")
+
+// CreateCraftsmanProfile registers a craftsman, creating the user account and
+// the craftsman profile together or not at all
 func CreateCraftsmanProfile(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -23,13 +27,11 @@ func CreateCraftsmanProfile(c *gin.Context) {
 	var request struct {
 		Username    string                    `json:"username" binding:"required"`
 		Email       string                    `json:"email" binding:"required,email"`
-		Password    string                    `json:"password" binding:"required,min=8"`
+		Password    string                    `json:"password" binding:"required"`
 		Bio         string                    `json:"bio"`
 		Experience  int                       `json:"experience"`
-		Rating      float64                   `json:"rating" binding:"required,min=0,max=5"`
 		Location    string                    `json:"location" binding:"required"`
 		ContactInfo models.ContactInformation `json:"contact_info"`
-		IsVerified  bool                      `json:"is_verified"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -37,68 +39,60 @@ func CreateCraftsmanProfile(c *gin.Context) {
 		return
 	}
 
-	// Check if email already exists
-	var existingUser models.User
-	err := Collections.Users.FindOne(ctx, bson.M{"email": request.Email}).Decode(&existingUser)
-	if err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Email already exists"})
-		return
-	}
-
-	// Create user
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	// Same password policy as CreateUser
+	hashedPassword, err := auth.HashPassword(request.Password)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		respondPasswordError(c, err)
 		return
 	}
 
+	// Rating and verification are earned, so new profiles start without them
+	now := time.Now()
 	user := models.User{
+		ID:        primitive.NewObjectID(),
 		Username:  request.Username,
 		Email:     request.Email,
-		Password:  string(hashedPassword),
-		Role:      "craftsman",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		Password:  hashedPassword,
+		Role:      models.RoleCraftsman,
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
-
-	userResult, err := Collections.Users.InsertOne(ctx, user)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
-		return
-	}
-
-	userID := userResult.InsertedID.(primitive.ObjectID)
-
-	// Create craftsman profile
 	craftsman := models.Craftsman{
-		UserID:      userID,
+		ID:          primitive.NewObjectID(),
+		UserID:      user.ID,
 		Bio:         request.Bio,
 		Experience:  request.Experience,
-		Rating:      request.Rating,
 		Location:    request.Location,
 		ContactInfo: request.ContactInfo,
-		IsVerified:  request.IsVerified,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
 
-	craftsmanResult, err := Collections.Craftsmen.InsertOne(ctx, craftsman)
+	err = Transactions.WithTransaction(ctx, func(ctx context.Context) error {
+		count, err := Collections.Users.CountDocuments(ctx, bson.M{"email": request.Email})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errEmailTaken
+		}
+		if _, err := Collections.Users.InsertOne(ctx, user); err != nil {
+			return err
+		}
+		_, err = Collections.Craftsmen.InsertOne(ctx, craftsman)
+		return err
+	})
+	if err == errEmailTaken || mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
+		return
+	}
 	if err != nil {
-		// If craftsman creation fails, delete the user
-		Collections.Users.DeleteOne(ctx, bson.M{"_id": userID})
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create craftsman profile"})
 		return
 	}
 
 	// Generate token pair
-	tokenPair, err := auth.GenerateTokenPair(
-		userID,
-		user.Name,
-		user.Surname,
-		string(user.Role),
-		os.Getenv("JWT_ACCESS_SECRET"),
-		os.Getenv("JWT_REFRESH_SECRET"),
-	)
+	tokenPair, err := issueTokenPair(ctx, user, clientDevice(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
 		return
@@ -107,13 +101,9 @@ func CreateCraftsmanProfile(c *gin.Context) {
 	c.JSON(http.StatusCreated, gin.H{
 		"access_token":  tokenPair.AccessToken,
 		"refresh_token": tokenPair.RefreshToken,
-		"user": gin.H{
-			"id":    userID.Hex(),
-			"email": user.Email,
-			"role":  user.Role,
-		},
+		"user":          models.NewProfileView(user),
 		"craftsman": gin.H{
-			"id":           craftsmanResult.InsertedID.(primitive.ObjectID).Hex(),
+			"id":           craftsman.ID.Hex(),
 			"bio":          craftsman.Bio,
 			"experience":   craftsman.Experience,
 			"rating":       craftsman.Rating,
@@ -182,52 +172,6 @@ func CreateCraft(c *gin.Context) {
 	c.JSON(http.StatusCreated, craft)
 }
 
-// CreateWorkshop creates a new workshop for a craft
-func CreateWorkshop(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	var workshop models.Workshop
-	if err := c.ShouldBindJSON(&workshop); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workshop data: " + err.Error()})
-		return
-	}
-
-	// Validate required fields
-	if workshop.Title == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Workshop title is required"})
-		return
-	}
-	if workshop.Description == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Workshop description is required"})
-		return
-	}
-	if workshop.MaxParticipants <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Maximum number of participants must be greater than 0"})
-		return
-	}
-	if workshop.Price < 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Price cannot be negative"})
-		return
-	}
-	if workshop.Duration <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Duration must be greater than 0"})
-		return
-	}
-
-	workshop.CreatedAt = time.Now()
-	workshop.UpdatedAt = time.Now()
-
-	result, err := Collections.Workshops.InsertOne(ctx, workshop)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workshop: " + err.Error()})
-		return
-	}
-
-	workshop.ID = result.InsertedID.(primitive.ObjectID)
-	c.JSON(http.StatusCreated, workshop)
-}
-
 // GetCraftsmanWorkshops retrieves all workshops for a craftsman
 func GetCraftsmanWorkshops(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -240,24 +184,32 @@ func GetCraftsmanWorkshops(c *gin.Context) {
 		return
 	}
 
-	var workshops []models.Workshop
-	cursor, err := Collections.Workshops.Find(ctx, bson.M{"craftsman_id": objID})
+	workshops, err := craftsmanWorkshops(ctx, objID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	c.JSON(http.StatusOK, workshops)
+}
+
+// craftsmanWorkshops loads every workshop a craftsman runs
+func craftsmanWorkshops(ctx context.Context, craftsmanID primitive.ObjectID) ([]models.Workshop, error) {
+	var workshops []models.Workshop
+	cursor, err := Collections.Workshops.Find(ctx, bson.M{"craftsman_id": craftsmanID})
+	if err != nil {
+		return nil, err
+	}
 	defer cursor.Close(ctx)
 
 	for cursor.Next(ctx) {
 		var workshop models.Workshop
 		if err := cursor.Decode(&workshop); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return nil, err
 		}
 		workshops = append(workshops, workshop)
 	}
-
-	c.JSON(http.StatusOK, workshops)
+	return workshops, nil
 }
 
 // UpdateCraftsmanProfile handles updating an existing craftsman profile
@@ -328,7 +280,7 @@ func GetCraftsmen(c *gin.Context) {
 	defer cancel()
 
 	var craftsmen []models.Craftsman
-	cursor, err := Collections.Craftsmen.Find(ctx, bson.M{})
+	cursor, err := Collections.Craftsmen.Find(ctx, bson.M{"deleted_at": bson.M{"$exists": false}})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -356,7 +308,7 @@ func GetCraftsman(c *gin.Context) {
 	}
 
 	var craftsman models.Craftsman
-	err = Collections.Craftsmen.FindOne(ctx, bson.M{"_id": objectID}).Decode(&craftsman)
+	err = Collections.Craftsmen.FindOne(ctx, bson.M{"_id": objectID, "deleted_at": bson.M{"$exists": false}}).Decode(&craftsman)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Craftsman not found"})
 		return
@@ -365,6 +317,15 @@ func GetCraftsman(c *gin.Context) {
 	c.JSON(http.StatusOK, craftsman)
 }
 
+// UpdateCraftsmanRequest represents the profile fields a craftsman may
+// change. Verification and rating are left to admins, see ModerateCraftsman.
+type UpdateCraftsmanRequest struct {
+	Bio         *string                    `json:"bio"`
+	Experience  *int                       `json:"experience" binding:"omitempty,min=0"`
+	Location    *string                    `json:"location"`
+	ContactInfo *models.ContactInformation `json:"contact_info"`
+}
+
 // UpdateCraftsman updates a craftsman's profile
 func UpdateCraftsman(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -377,25 +338,75 @@ func UpdateCraftsman(c *gin.Context) {
 		return
 	}
 
-	var craftsman models.Craftsman
-	if err := c.ShouldBindJSON(&craftsman); err != nil {
+	var req UpdateCraftsmanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	update := bson.M{
-		"$set": bson.M{
-			"bio":          craftsman.Bio,
-			"experience":   craftsman.Experience,
-			"rating":       craftsman.Rating,
-			"location":     craftsman.Location,
-			"contact_info": craftsman.ContactInfo,
-			"is_verified":  craftsman.IsVerified,
-			"updated_at":   time.Now(),
-		},
+	// Only the fields sent are changed
+	set := bson.M{"updated_at": time.Now()}
+	if req.Bio != nil {
+		set["bio"] = *req.Bio
+	}
+	if req.Experience != nil {
+		set["experience"] = *req.Experience
+	}
+	if req.Location != nil {
+		set["location"] = *req.Location
 	}
+	if req.ContactInfo != nil {
+		set["contact_info"] = *req.ContactInfo
+	}
+
+	result, err := Collections.Craftsmen.UpdateOne(ctx, bson.M{"_id": objectID}, bson.M{"$set": set})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Craftsman not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Craftsman updated successfully"})
+}
+
+// ModerateCraftsmanRequest represents the fields only an admin may change on
+// a craftsman profile
+type ModerateCraftsmanRequest struct {
+	IsVerified *bool    `json:"is_verified"`
+	Rating     *float64 `json:"rating" binding:"omitempty,min=0,max=5"`
+}
+
+// ModerateCraftsman lets an admin verify a craftsman or correct their rating
+func ModerateCraftsman(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	result, err := Collections.Craftsmen.UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	id := c.Param("id")
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+		return
+	}
+
+	var req ModerateCraftsmanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	set := bson.M{"updated_at": time.Now()}
+	if req.IsVerified != nil {
+		set["is_verified"] = *req.IsVerified
+	}
+	if req.Rating != nil {
+		set["rating"] = *req.Rating
+	}
+
+	result, err := Collections.Craftsmen.UpdateOne(ctx, bson.M{"_id": objectID}, bson.M{"$set": set})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -421,16 +432,83 @@ func DeleteCraftsman(c *gin.Context) {
 		return
 	}
 
-	result, err := Collections.Craftsmen.DeleteOne(ctx, bson.M{"_id": objectID})
+	// Deleted profiles are hidden straight away and purged, along with their
+	// workshops, once AccountDeletionGracePeriod is over
+	now := time.Now()
+	result, err := Collections.Craftsmen.UpdateOne(ctx,
+		bson.M{"_id": objectID, "deleted_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now}},
+	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if result.DeletedCount == 0 {
+	if result.MatchedCount == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Craftsman not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Craftsman deleted successfully"})
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Craftsman scheduled for deletion",
+		"purge_after": now.Add(AccountDeletionGracePeriod),
+	})
+}
+
+// craftsmanDeleted reports whether a craftsman profile is deleted and waiting
+// to be purged. Its workshops are hidden and can't be booked in the meantime.
+func craftsmanDeleted(ctx context.Context, craftsmanID primitive.ObjectID) (bool, error) {
+	count, err := Collections.Craftsmen.CountDocuments(ctx, bson.M{"_id": craftsmanID, "deleted_at": bson.M{"$exists": true}})
+	return count > 0, err
+}
+
+// deletedCraftsmanIDs lists the deleted craftsman profiles, whose workshops
+// are left out of listings
+func deletedCraftsmanIDs(ctx context.Context) (bson.A, error) {
+	var craftsmen []models.Craftsman
+	cursor, err := Collections.Craftsmen.Find(ctx, bson.M{"deleted_at": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &craftsmen); err != nil {
+		return nil, err
+	}
+	ids := bson.A{}
+	for _, craftsman := range craftsmen {
+		ids = append(ids, craftsman.ID)
+	}
+	return ids, nil
+}
+
+// RestoreCraftsman undoes the deletion of a craftsman profile still in its
+// grace period
+func RestoreCraftsman(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id := c.Param("id")
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+		return
+	}
+
+	result, err := Collections.Craftsmen.UpdateOne(ctx,
+		bson.M{"_id": objectID, "deleted_at": bson.M{"$exists": true}},
+		bson.M{
+			"$unset": bson.M{"deleted_at": "", "purge_started_at": ""},
+			"$set":   bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deleted craftsman not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Craftsman restored successfully"})
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -13,7 +14,10 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func TestCreateCraftsmanProfileHandler(t *testing.T) {
@@ -36,7 +40,7 @@ func TestCreateCraftsmanProfileHandler(t *testing.T) {
 			payload: map[string]interface{}{
 				"username":   "testcraftsman",
 				"email":      "test@example.com",
-				"password":   "password123",
+				"password":   testPassword,
 				"bio":        "Test bio",
 				"experience": 5,
 				"rating":     4.5,
@@ -57,7 +61,7 @@ func TestCreateCraftsmanProfileHandler(t *testing.T) {
 			payload: map[string]interface{}{
 				"username":   "testcraftsman2",
 				"email":      "test2@example.com",
-				"password":   "password123",
+				"password":   testPassword,
 				"experience": 3,
 				"rating":     4.0,
 				"location":   "Los Angeles",
@@ -68,6 +72,26 @@ func TestCreateCraftsmanProfileHandler(t *testing.T) {
 			},
 			expectedStatus: http.StatusCreated,
 		},
+		{
+			name: "Weak password",
+			payload: map[string]interface{}{
+				"username": "testcraftsman3",
+				"email":    "test3@example.com",
+				"password": "password123",
+				"location": "Chicago",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Email already in use",
+			payload: map[string]interface{}{
+				"username": "testcraftsman4",
+				"email":    "test@example.com",
+				"password": testPassword,
+				"location": "Boston",
+			},
+			expectedStatus: http.StatusConflict,
+		},
 	}
 
 	for _, tt := range tests {
@@ -117,16 +141,13 @@ func TestCreateCraftsmanProfileHandler(t *testing.T) {
 				if exp, ok := tt.payload["experience"]; ok {
 					assert.Equal(t, float64(exp.(int)), craftsman["experience"])
 				}
-				assert.Equal(t, tt.payload["rating"], craftsman["rating"])
+				// Trust fields sent by the client are ignored
+				assert.Equal(t, float64(0), craftsman["rating"])
 				assert.Equal(t, tt.payload["location"], craftsman["location"])
 				if tt.payload["contact_info"] != nil {
 					assert.NotNil(t, craftsman["contact_info"])
 				}
-				if isVerified, ok := tt.payload["is_verified"]; ok {
-					assert.Equal(t, isVerified, craftsman["is_verified"])
-				} else {
-					assert.Equal(t, false, craftsman["is_verified"])
-				}
+				assert.Equal(t, false, craftsman["is_verified"])
 
 				// Check contact info
 				contactInfo := craftsman["contact_info"].(map[string]interface{})
@@ -236,3 +257,82 @@ func TestCreateCraftHandler(t *testing.T) {
 		})
 	}
 }
+
+// failingInserts is a collection whose inserts always fail
+type failingInserts struct {
+	Collection
+}
+
+func (failingInserts) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	return nil, errors.New("insert failed")
+}
+
+func TestCreateCraftsmanProfileIsAtomic(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router := gin.New()
+	router.POST("/api/craftsmen", CreateCraftsmanProfile)
+	Collections.Craftsmen = failingInserts{Collections.Craftsmen}
+
+	w := performJSON(router, "POST", "/api/craftsmen", gin.H{
+		"username": "potter",
+		"email":    "potter@example.com",
+		"password": testPassword,
+		"location": "Ljubljana",
+	}, "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// The user account is rolled back along with the profile
+	count, err := Collections.Users.CountDocuments(context.Background(), bson.M{"email": "potter@example.com"})
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestUpdateCraftsmanKeepsOmittedFields(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router := gin.New()
+	router.PUT("/api/craftsmen/:id", UpdateCraftsman)
+	router.PATCH("/api/admin/craftsmen/:id", ModerateCraftsman)
+
+	result, err := Collections.Craftsmen.InsertOne(context.Background(), models.Craftsman{
+		UserID:   primitive.NewObjectID(),
+		Bio:      "Potter",
+		Location: "Ljubljana",
+		Rating:   3.5,
+	})
+	assert.NoError(t, err)
+	id := result.InsertedID.(primitive.ObjectID)
+
+	load := func() models.Craftsman {
+		var craftsman models.Craftsman
+		assert.NoError(t, Collections.Craftsmen.FindOne(context.Background(), bson.M{"_id": id}).Decode(&craftsman))
+		return craftsman
+	}
+
+	// The owner can't verify themselves or set their own rating
+	w := performJSON(router, "PUT", "/api/craftsmen/"+id.Hex(), gin.H{
+		"bio":         "Potter and glazer",
+		"rating":      5,
+		"is_verified": true,
+	}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	craftsman := load()
+	assert.Equal(t, "Potter and glazer", craftsman.Bio)
+	assert.Equal(t, "Ljubljana", craftsman.Location)
+	assert.Equal(t, 3.5, craftsman.Rating)
+	assert.False(t, craftsman.IsVerified)
+
+	w = performJSON(router, "PATCH", "/api/admin/craftsmen/"+id.Hex(), gin.H{"is_verified": true}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	craftsman = load()
+	assert.True(t, craftsman.IsVerified)
+	assert.Equal(t, 3.5, craftsman.Rating)
+
+	w = performJSON(router, "PATCH", "/api/admin/craftsmen/"+id.Hex(), gin.H{"rating": 6}, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
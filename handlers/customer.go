@@ -2,10 +2,13 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"backend-dragonhak/models"
+	"backend-dragonhak/services"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
@@ -13,13 +16,6 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-var bookingCollection *mongo.Collection
-
-// InitBookingCollection initializes the booking collection
-func InitBookingCollection(mongoClient *mongo.Client) {
-	bookingCollection = mongoClient.Database("dragonhak").Collection("bookings")
-}
-
 // SearchCraftsmen searches for craftsmen based on criteria
 func SearchCraftsmen(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -30,15 +26,20 @@ func SearchCraftsmen(c *gin.Context) {
 	location := c.Query("location")
 	minRating := c.Query("min_rating")
 
-	filter := bson.M{}
+	filter := bson.M{"deleted_at": bson.M{"$exists": false}}
 	if specialty != "" {
-		filter["specialties"] = specialty
+		filter["specialties.name"] = specialty
 	}
 	if location != "" {
 		filter["location"] = location
 	}
 	if minRating != "" {
-		filter["rating"] = bson.M{"$gte": minRating}
+		rating, err := strconv.ParseFloat(minRating, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid min_rating"})
+			return
+		}
+		filter["rating"] = bson.M{"$gte": rating}
 	}
 
 	var craftsmen []models.Craftsman
@@ -72,7 +73,7 @@ func SearchWorkshops(c *gin.Context) {
 	location := c.Query("location")
 	date := c.Query("date")
 
-	filter := bson.M{"status": "upcoming"}
+	filter := bson.M{"status": models.WorkshopStatusUpcoming}
 	if category != "" {
 		filter["category"] = category
 	}
@@ -93,6 +94,14 @@ func SearchWorkshops(c *gin.Context) {
 		}
 	}
 
+	// Workshops of deleted craftsmen are hidden
+	deleted, err := deletedCraftsmanIDs(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	filter["craftsman_id"] = bson.M{"$nin": deleted}
+
 	var workshops []models.Workshop
 	cursor, err := Collections.Workshops.Find(ctx, filter)
 	if err != nil {
@@ -113,7 +122,39 @@ func SearchWorkshops(c *gin.Context) {
 	c.JSON(http.StatusOK, workshops)
 }
 
-// BookWorkshop creates a booking for a workshop
+var (
+	errWorkshopFull  = errors.New("workshop is full")
+	errAlreadyBooked = errors.New("already booked")
+)
+
+// activeBookingStatuses are the statuses that hold a seat in a workshop
+var activeBookingStatuses = bson.A{models.BookingStatusPending, models.BookingStatusConfirmed}
+
+// takeSeat takes one seat in an upcoming workshop. The check and the
+// increment are a single conditional update, so concurrent callers can't
+// take more seats than the workshop has.
+func takeSeat(ctx context.Context, workshopID primitive.ObjectID) error {
+	result, err := Collections.Workshops.UpdateOne(ctx,
+		bson.M{
+			"_id":    workshopID,
+			"status": models.WorkshopStatusUpcoming,
+			"$expr":  bson.M{"$lt": bson.A{"$current_students", "$max_participants"}},
+		},
+		bson.M{"$inc": bson.M{"current_students": 1}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errWorkshopFull
+	}
+	return nil
+}
+
+// BookWorkshop books a workshop for the authenticated customer. The seat is
+// taken with a conditional increment in the same transaction as the booking,
+// so concurrent requests can't overbook a workshop, and a unique index on
+// active bookings keeps a customer from booking it twice.
 func BookWorkshop(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -133,23 +174,25 @@ func BookWorkshop(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Workshop not found"})
 		return
 	}
-
-	// Check if workshop is full
-	if workshop.CurrentStudents >= workshop.MaxParticipants {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Workshop is full"})
+	if workshop.Status != models.WorkshopStatusUpcoming {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workshop is not open for booking"})
 		return
 	}
-
-	// Get customer ID from the test context
-	customerID := c.GetHeader("X-Customer-ID")
-	if customerID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Customer ID is required"})
+	deleted, err := craftsmanDeleted(ctx, workshop.CraftsmanID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load workshop"})
+		return
+	}
+	if deleted {
+		// The craftsman deleted their profile
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workshop not found"})
 		return
 	}
 
-	customerObjID, err := primitive.ObjectIDFromHex(customerID)
+	// Bookings are always made in the caller's own name
+	customerObjID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid customer ID format"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
@@ -163,22 +206,57 @@ func BookWorkshop(c *gin.Context) {
 		UpdatedAt:  time.Now(),
 	}
 
-	// Insert booking
-	_, err = Collections.Bookings.InsertOne(ctx, booking)
-	if err != nil {
+	err = Transactions.WithTransaction(ctx, func(ctx context.Context) error {
+		booked, err := Collections.Bookings.CountDocuments(ctx, bson.M{
+			"workshop_id": objID,
+			"customer_id": customerObjID,
+			"status":      bson.M{"$in": activeBookingStatuses},
+		})
+		if err != nil {
+			return err
+		}
+		if booked > 0 {
+			return errAlreadyBooked
+		}
+
+		// Take a seat only if one is left and the workshop is still open
+		if err := takeSeat(ctx, objID); err != nil {
+			return err
+		}
+
+		// The count above can miss a booking made concurrently, the unique
+		// index on active bookings can't
+		_, err = Collections.Bookings.InsertOne(ctx, booking)
+		if mongo.IsDuplicateKeyError(err) {
+			return errAlreadyBooked
+		}
+		if err != nil {
+			return err
+		}
+
+		// A customer who got a seat no longer needs to wait for one
+		_, err = Collections.Waitlist.DeleteOne(ctx, bson.M{"workshop_id": objID, "customer_id": customerObjID})
+		return err
+	})
+	switch err {
+	case nil:
+	case errWorkshopFull:
+		c.JSON(http.StatusConflict, gin.H{"error": "Workshop is full"})
+		return
+	case errAlreadyBooked:
+		c.JSON(http.StatusConflict, gin.H{"error": "You have already booked this workshop"})
+		return
+	default:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create booking"})
 		return
 	}
 
-	// Update workshop's current students count
-	_, err = Collections.Workshops.UpdateOne(
-		ctx,
-		bson.M{"_id": objID},
-		bson.M{"$inc": bson.M{"current_students": 1}},
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workshop"})
-		return
+	// The booking stands even if the confirmation can't be delivered
+	var customer models.User
+	if err := Collections.Users.FindOne(ctx, bson.M{"_id": customerObjID}).Decode(&customer); err == nil {
+		sendMail(ctx, func() (services.Message, error) {
+			return services.BookingConfirmationEmail(customer.Email, customer.Name, workshop.Title, workshop.Location, workshop.Date)
+		})
 	}
 
 	// Return booking details
@@ -192,7 +270,8 @@ func BookWorkshop(c *gin.Context) {
 	})
 }
 
-// GetCustomerBookings retrieves all bookings for a customer
+// GetCustomerBookings retrieves all bookings for a customer. RoutePolicies
+// limits customers to their own bookings.
 func GetCustomerBookings(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -204,8 +283,8 @@ func GetCustomerBookings(c *gin.Context) {
 		return
 	}
 
-	var bookings []models.Booking
-	cursor, err := bookingCollection.Find(ctx, bson.M{"customer_id": objID})
+	bookings := []models.Booking{}
+	cursor, err := Collections.Bookings.Find(ctx, bson.M{"customer_id": objID})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -5,13 +5,18 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"backend-dragonhak/middleware"
 	"backend-dragonhak/models"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -110,13 +115,14 @@ func TestBookWorkshop(t *testing.T) {
 	SetupTestDB(t)
 	defer CleanupTestDB(t)
 
-	// Create test router
-	router := gin.Default()
-	router.POST("/api/customers/workshops/:id/book", BookWorkshop)
-
 	// Create test user (customer)
 	customerID := CreateTestUser(t)
 
+	// Create test router, authenticated as the customer
+	router := gin.Default()
+	asCustomer := func(c *gin.Context) { c.Set("user_id", customerID.Hex()) }
+	router.POST("/api/customers/workshops/:id/book", asCustomer, BookWorkshop)
+
 	// Create test craftsman user and profile
 	craftsmanID := CreateTestUser(t)
 
@@ -157,6 +163,7 @@ func TestBookWorkshop(t *testing.T) {
 		CraftsmanID:     craftsmanID,
 		Title:           "Woodworking Workshop",
 		Description:     "Learn woodworking basics",
+		Status:          models.WorkshopStatusUpcoming,
 		Date:            time.Now().Add(24 * time.Hour),
 		Duration:        4,
 		MaxParticipants: 10,
@@ -199,9 +206,6 @@ func TestBookWorkshop(t *testing.T) {
 			req, err := http.NewRequest("POST", "/api/customers/workshops/"+tt.workshopID+"/book", nil)
 			assert.NoError(t, err)
 
-			// Add customer ID to header
-			req.Header.Set("X-Customer-ID", customerID.Hex())
-
 			// Create response recorder
 			w := httptest.NewRecorder()
 
@@ -221,7 +225,173 @@ func TestBookWorkshop(t *testing.T) {
 				assert.NotEmpty(t, response["id"])
 				assert.Equal(t, tt.workshopID, response["workshop_id"])
 				assert.Equal(t, customerID.Hex(), response["customer_id"])
+
+				// The customer is emailed a confirmation
+				messages := sentMail(t)
+				if assert.Len(t, messages, 1) {
+					assert.Equal(t, "test@example.com", messages[0].Header.Get("To"))
+					assert.Contains(t, mailBody(t, messages[0]), "Woodworking Workshop")
+				}
 			}
 		})
 	}
 }
+
+// TestBookWorkshopConcurrently fires bookings at once through the handler.
+// MockTransactor runs units of work one at a time, so this covers the
+// handler's outcomes under load against the mock, not the database's
+// guarantees; those come from the conditional update in takeSeat, tested on
+// its own below, and the unique index on active bookings.
+func TestBookWorkshopConcurrently(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router := gin.New()
+	asCaller := func(c *gin.Context) { c.Set("user_id", c.GetHeader("X-Test-User")) }
+	router.POST("/api/customers/workshops/:id/book", asCaller, BookWorkshop)
+
+	newWorkshop := func(seats int) primitive.ObjectID {
+		result, err := Collections.Workshops.InsertOne(context.Background(), models.Workshop{
+			Title:           "Glassblowing",
+			Status:          models.WorkshopStatusUpcoming,
+			MaxParticipants: seats,
+		})
+		require.NoError(t, err)
+		return result.InsertedID.(primitive.ObjectID)
+	}
+
+	// book fires one request per customer at once and counts the outcomes
+	book := func(workshopID primitive.ObjectID, customers []primitive.ObjectID) map[int]int {
+		var (
+			mu       sync.Mutex
+			wg       sync.WaitGroup
+			statuses = map[int]int{}
+		)
+		start := make(chan struct{})
+		for _, customer := range customers {
+			wg.Add(1)
+			go func(customer primitive.ObjectID) {
+				defer wg.Done()
+				req, _ := http.NewRequest("POST", "/api/customers/workshops/"+workshopID.Hex()+"/book", nil)
+				req.Header.Set("X-Test-User", customer.Hex())
+				w := httptest.NewRecorder()
+				<-start
+				router.ServeHTTP(w, req)
+
+				mu.Lock()
+				statuses[w.Code]++
+				mu.Unlock()
+			}(customer)
+		}
+		close(start)
+		wg.Wait()
+		return statuses
+	}
+
+	countBookings := func(workshopID primitive.ObjectID) int64 {
+		count, err := Collections.Bookings.CountDocuments(context.Background(), bson.M{"workshop_id": workshopID})
+		require.NoError(t, err)
+		return count
+	}
+
+	t.Run("Never overbooks", func(t *testing.T) {
+		workshopID := newWorkshop(10)
+		customers := make([]primitive.ObjectID, 300)
+		for i := range customers {
+			customers[i] = primitive.NewObjectID()
+		}
+
+		statuses := book(workshopID, customers)
+		assert.Equal(t, 10, statuses[http.StatusCreated])
+		assert.Equal(t, 290, statuses[http.StatusConflict])
+
+		var workshop models.Workshop
+		require.NoError(t, Collections.Workshops.FindOne(context.Background(), bson.M{"_id": workshopID}).Decode(&workshop))
+		assert.Equal(t, 10, workshop.CurrentStudents)
+		assert.Equal(t, int64(10), countBookings(workshopID))
+	})
+
+	t.Run("Books each customer once", func(t *testing.T) {
+		workshopID := newWorkshop(100)
+		customer := primitive.NewObjectID()
+		customers := make([]primitive.ObjectID, 50)
+		for i := range customers {
+			customers[i] = customer
+		}
+
+		statuses := book(workshopID, customers)
+		assert.Equal(t, 1, statuses[http.StatusCreated])
+		assert.Equal(t, 49, statuses[http.StatusConflict])
+		assert.Equal(t, int64(1), countBookings(workshopID))
+	})
+
+	t.Run("The seat guard holds without a transaction", func(t *testing.T) {
+		workshopID := newWorkshop(10)
+
+		var (
+			wg    sync.WaitGroup
+			taken int32
+		)
+		start := make(chan struct{})
+		for i := 0; i < 300; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				err := takeSeat(context.Background(), workshopID)
+				if err == nil {
+					atomic.AddInt32(&taken, 1)
+				} else {
+					assert.Equal(t, errWorkshopFull, err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		assert.Equal(t, int32(10), taken)
+		var workshop models.Workshop
+		require.NoError(t, Collections.Workshops.FindOne(context.Background(), bson.M{"_id": workshopID}).Decode(&workshop))
+		assert.Equal(t, 10, workshop.CurrentStudents)
+	})
+}
+
+func TestCustomerBookingsAreBoundToTheCaller(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	customers := router.Group("/api/customers", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), RoutePolicies.Enforce())
+	customers.POST("/workshops/:id/book", BookWorkshop)
+	customers.GET("/:id/bookings", GetCustomerBookings)
+
+	result, err := Collections.Workshops.InsertOne(context.Background(), models.Workshop{Title: "Weaving", Status: models.WorkshopStatusUpcoming, MaxParticipants: 5})
+	require.NoError(t, err)
+	workshopID := result.InsertedID.(primitive.ObjectID)
+	token := login(t, router, user.Email)["access_token"].(string)
+
+	// A customer ID sent by the client is ignored
+	other := primitive.NewObjectID()
+	req, _ := http.NewRequest("POST", "/api/customers/workshops/"+workshopID.Hex()+"/book", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Customer-ID", other.Hex())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var booking map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &booking))
+	assert.Equal(t, user.ID.Hex(), booking["customer_id"])
+
+	w = performJSON(router, "POST", "/api/customers/workshops/"+workshopID.Hex()+"/book", nil, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = performJSON(router, "GET", "/api/customers/"+user.ID.Hex()+"/bookings", nil, token)
+	require.Equal(t, http.StatusOK, w.Code)
+	var bookings []models.Booking
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &bookings))
+	assert.Len(t, bookings, 1)
+
+	w = performJSON(router, "GET", "/api/customers/"+other.Hex()+"/bookings", nil, token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
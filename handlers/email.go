@@ -7,6 +7,7 @@ import (
 
 	"backend-dragonhak/auth"
 	"backend-dragonhak/models"
+	"backend-dragonhak/services"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
@@ -17,15 +18,9 @@ type EmailVerifier struct {
 	verifier *auth.EmailVerifier
 }
 
-func NewEmailVerifier(redisAddr string) *EmailVerifier {
+func NewEmailVerifier(kv auth.KV) *EmailVerifier {
 	return &EmailVerifier{
-		verifier: auth.NewEmailVerifier(redisAddr),
-	}
-}
-
-func NewDummyEmailVerifier() *EmailVerifier {
-	return &EmailVerifier{
-		verifier: &auth.EmailVerifier{},
+		verifier: auth.NewEmailVerifier(kv),
 	}
 }
 
@@ -58,17 +53,23 @@ func (ev *EmailVerifier) SendVerificationEmail(c *gin.Context) {
 		return
 	}
 
-	token, err := ev.verifier.GenerateToken(ctx, user.Email)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate verification token"})
+	if err := sendVerificationEmail(ctx, ev.verifier, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
 		return
 	}
 
-	// TODO: Send email with verification link
-	// For now, just return the token in the response
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Verification email sent",
-		"token":   token, // Remove this in production
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// sendVerificationEmail emails the user a link confirming their current address
+func sendVerificationEmail(ctx context.Context, verifier *auth.EmailVerifier, user models.User) error {
+	token, err := verifier.GenerateToken(ctx, user.Email)
+	if err != nil {
+		return err
+	}
+
+	return sendMail(ctx, func() (services.Message, error) {
+		return services.VerificationEmail(user.Email, user.Name, mailLink("/api/users/verify", token))
 	})
 }
 
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"backend-dragonhak/auth"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var tokenInLink = regexp.MustCompile(`token=([0-9a-f]+)`)
+
+func TestEmailVerification(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	user := models.User{
+		Name:      "John",
+		Email:     "john@example.com",
+		Role:      models.RoleCustomer,
+		CreatedAt: time.Now(),
+	}
+	_, err := Collections.Users.InsertOne(context.Background(), &user)
+	require.NoError(t, err)
+
+	ev := NewEmailVerifier(auth.NewMemoryKV())
+	router := gin.New()
+	router.POST("/api/users/verify/send", func(c *gin.Context) {
+		c.Set("user_id", user.ID.Hex())
+	}, ev.SendVerificationEmail)
+	router.GET("/api/users/verify", ev.VerifyEmail)
+
+	w := performJSON(router, "POST", "/api/users/verify/send", nil, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotContains(t, w.Body.String(), "token")
+
+	messages := sentMail(t)
+	require.Len(t, messages, 1)
+	assert.Equal(t, user.Email, messages[0].Header.Get("To"))
+	body := mailBody(t, messages[0])
+	assert.Contains(t, body, "http://localhost:8080/api/users/verify?token=")
+
+	match := tokenInLink.FindStringSubmatch(body)
+	require.NotNil(t, match)
+
+	w = performJSON(router, "GET", "/api/users/verify?token="+match[1], nil, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var updated models.User
+	require.NoError(t, Collections.Users.FindOne(context.Background(), bson.M{"_id": user.ID}).Decode(&updated))
+	assert.True(t, updated.EmailVerified)
+}
@@ -0,0 +1,430 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"backend-dragonhak/models"
+	"backend-dragonhak/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AccountDeletionGracePeriod is how long deleted accounts and craftsman
+// profiles can be restored before their data is purged
+var AccountDeletionGracePeriod = 30 * 24 * time.Hour
+
+// purgeClaimTimeout is how long a purge may run before another worker
+// assumes it crashed and takes over
+const purgeClaimTimeout = time.Hour
+
+// deleteImage removes an image from Cloudinary; tests replace it
+var deleteImage = services.DeleteImage
+
+// RunPurgeWorker purges deletions past their grace period and expired data
+// exports every interval until ctx is cancelled
+func RunPurgeWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		runCtx, cancel := context.WithTimeout(ctx, purgeClaimTimeout)
+		purged, err := PurgeDeletedAccounts(runCtx, time.Now())
+		cancel()
+		if err != nil {
+			log.Printf("PurgeWorker: %v", err)
+		} else if purged > 0 {
+			log.Printf("PurgeWorker: purged %d deleted accounts and profiles", purged)
+		}
+
+		// Personal data exports are only kept until their download expires
+		runCtx, cancel = context.WithTimeout(ctx, purgeClaimTimeout)
+		exports, err := PurgeExpiredExports(runCtx, time.Now())
+		cancel()
+		if err != nil {
+			log.Printf("PurgeWorker: %v", err)
+		} else if exports > 0 {
+			log.Printf("PurgeWorker: deleted %d expired data exports", exports)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeDeletedAccounts erases every user and craftsman profile deleted longer
+// than AccountDeletionGracePeriod before now, writing an erasure receipt for
+// each. It returns how many were purged.
+func PurgeDeletedAccounts(ctx context.Context, now time.Time) (int, error) {
+	expired := bson.M{"deleted_at": bson.M{"$lte": now.Add(-AccountDeletionGracePeriod)}}
+	purged := 0
+
+	var users []models.User
+	cursor, err := Collections.Users.Find(ctx, expired)
+	if err != nil {
+		return purged, err
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return purged, err
+	}
+
+	for _, user := range users {
+		claimed, err := claimPurge(ctx, Collections.Users, user.ID, now)
+		if err != nil {
+			return purged, err
+		}
+		if !claimed {
+			continue
+		}
+		if err := purgeUser(ctx, user, now); err != nil {
+			return purged, fmt.Errorf("purging user %s: %w", user.ID.Hex(), err)
+		}
+		purged++
+	}
+
+	// Profiles deleted on their own; those deleted with their account are
+	// gone by now
+	var craftsmen []models.Craftsman
+	cursor, err = Collections.Craftsmen.Find(ctx, expired)
+	if err != nil {
+		return purged, err
+	}
+	if err := cursor.All(ctx, &craftsmen); err != nil {
+		return purged, err
+	}
+
+	for _, craftsman := range craftsmen {
+		claimed, err := claimPurge(ctx, Collections.Craftsmen, craftsman.ID, now)
+		if err != nil {
+			return purged, err
+		}
+		if !claimed {
+			continue
+		}
+
+		receipt := newErasureReceipt(models.ErasureSubjectCraftsman, craftsman.ID, *craftsman.DeletedAt, now)
+		if err := purgeCraftsman(ctx, craftsman, receipt); err != nil {
+			return purged, fmt.Errorf("purging craftsman %s: %w", craftsman.ID.Hex(), err)
+		}
+		if _, err := Collections.Erasures.InsertOne(ctx, receipt); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// claimPurge marks a document as being purged so concurrent workers don't
+// purge it twice. Claims left behind by a crashed worker expire.
+func claimPurge(ctx context.Context, collection Collection, id primitive.ObjectID, now time.Time) (bool, error) {
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"_id": id,
+		"$or": bson.A{
+			bson.M{"purge_started_at": bson.M{"$exists": false}},
+			bson.M{"purge_started_at": bson.M{"$lt": now.Add(-purgeClaimTimeout)}},
+		},
+	}, bson.M{"$set": bson.M{"purge_started_at": now}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func newErasureReceipt(subject string, subjectID primitive.ObjectID, requestedAt, now time.Time) *models.ErasureReceipt {
+	return &models.ErasureReceipt{
+		Subject:     subject,
+		SubjectID:   subjectID,
+		RequestedAt: requestedAt,
+		PurgedAt:    now,
+		Actions:     map[string]int64{},
+	}
+}
+
+// purgeUser erases a deleted user. Their own content is deleted; records
+// other people depend on, like bookings of a workshop or bids in someone
+// else's auction, are kept without the link to the user.
+func purgeUser(ctx context.Context, user models.User, now time.Time) error {
+	receipt := newErasureReceipt(models.ErasureSubjectUser, user.ID, *user.DeletedAt, now)
+
+	var craftsmen []models.Craftsman
+	cursor, err := Collections.Craftsmen.Find(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &craftsmen); err != nil {
+		return err
+	}
+	for _, craftsman := range craftsmen {
+		if err := purgeCraftsman(ctx, craftsman, receipt); err != nil {
+			return err
+		}
+	}
+
+	// Off the waitlists first, so the seats freed below aren't offered back
+	// to the user
+	deleted, err := Collections.Waitlist.DeleteMany(ctx, bson.M{"customer_id": user.ID})
+	if err != nil {
+		return err
+	}
+	receipt.Actions["waitlist_entries_deleted"] = deleted.DeletedCount
+
+	cancelled, err := cancelCustomerBookings(ctx, user.ID, now)
+	if err != nil {
+		return err
+	}
+	receipt.Actions["bookings_cancelled"] += cancelled
+
+	updated, err := Collections.Bookings.UpdateMany(ctx,
+		bson.M{"customer_id": user.ID},
+		bson.M{"$set": bson.M{"customer_id": primitive.NilObjectID, "updated_at": now}},
+	)
+	if err != nil {
+		return err
+	}
+	receipt.Actions["bookings_anonymized"] = updated.ModifiedCount
+
+	// The user's auctions go, along with the bids placed on them
+	var auctions []models.Auction
+	cursor, err = Collections.Auctions.Find(ctx, bson.M{"seller_id": user.ID})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &auctions); err != nil {
+		return err
+	}
+	auctionIDs := bson.A{}
+	for _, auction := range auctions {
+		auctionIDs = append(auctionIDs, auction.ID)
+	}
+
+	deleted, err = Collections.Bids.DeleteMany(ctx, bson.M{"auction_id": bson.M{"$in": auctionIDs}})
+	if err != nil {
+		return err
+	}
+	receipt.Actions["bids_deleted"] = deleted.DeletedCount
+
+	deleted, err = Collections.Auctions.DeleteMany(ctx, bson.M{"seller_id": user.ID})
+	if err != nil {
+		return err
+	}
+	receipt.Actions["auctions_deleted"] = deleted.DeletedCount
+
+	updated, err = Collections.Bids.UpdateMany(ctx,
+		bson.M{"bidder_id": user.ID},
+		bson.M{"$set": bson.M{"bidder_id": primitive.NilObjectID}},
+	)
+	if err != nil {
+		return err
+	}
+	receipt.Actions["bids_anonymized"] = updated.ModifiedCount
+
+	_, err = Collections.Auctions.UpdateMany(ctx,
+		bson.M{"last_bid.bidder_id": user.ID},
+		bson.M{"$set": bson.M{"last_bid.bidder_id": primitive.NilObjectID}},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Payment records are kept for accounting, without the link to the user
+	updated, err = Collections.Transactions.UpdateMany(ctx,
+		bson.M{"user_id": user.ID},
+		bson.M{"$set": bson.M{"user_id": primitive.NilObjectID}},
+	)
+	if err != nil {
+		return err
+	}
+	receipt.Actions["transactions_anonymized"] = updated.ModifiedCount
+
+	deleted, err = Collections.Reviews.DeleteMany(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		return err
+	}
+	receipt.Actions["reviews_deleted"] = deleted.DeletedCount
+
+	if err := purgeImages(ctx, user.ID, receipt); err != nil {
+		return err
+	}
+
+	var exports []models.DataExport
+	if err := findAll(ctx, Collections.Exports, bson.M{"user_id": user.ID}, &exports); err != nil {
+		return err
+	}
+	for _, export := range exports {
+		if err := removeDataExport(ctx, export); err != nil {
+			return err
+		}
+		receipt.Actions["exports_deleted"]++
+	}
+
+	if err := Stores.Sessions.RevokeAll(ctx, user.ID.Hex()); err != nil {
+		return err
+	}
+
+	// Write the receipt before the user disappears, so a crash in between
+	// leaves the user to be purged again rather than an unrecorded erasure
+	if _, err := Collections.Erasures.InsertOne(ctx, receipt); err != nil {
+		return err
+	}
+
+	_, err = Collections.Users.DeleteOne(ctx, bson.M{"_id": user.ID})
+	return err
+}
+
+// cancelCustomerBookings cancels the bookings of a purged customer that still
+// hold a seat, refunding them as the workshop's cancellation policy allows
+// and passing the seats on to the waitlist
+func cancelCustomerBookings(ctx context.Context, customerID primitive.ObjectID, now time.Time) (int64, error) {
+	var bookings []models.Booking
+	err := findAll(ctx, Collections.Bookings, bson.M{
+		"customer_id": customerID,
+		"status":      bson.M{"$in": activeBookingStatuses},
+	}, &bookings)
+	if err != nil {
+		return 0, err
+	}
+
+	var cancelled int64
+	for _, booking := range bookings {
+		// A booking of a workshop that is gone is cancelled without a refund
+		var workshop models.Workshop
+		err := Collections.Workshops.FindOne(ctx, bson.M{"_id": booking.WorkshopID}).Decode(&workshop)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return cancelled, err
+		}
+
+		set, refund := cancellationRefund(booking, workshop, now)
+		err = releaseSeat(ctx, booking, set, refund)
+		if err == errBookingChanged {
+			continue
+		}
+		if err != nil {
+			return cancelled, err
+		}
+		cancelled++
+
+		if err := promoteFromWaitlist(ctx, booking.WorkshopID); err != nil {
+			log.Printf("PurgeWorker: failed to promote for workshop %s: %v", booking.WorkshopID.Hex(), err)
+		}
+	}
+	return cancelled, nil
+}
+
+// purgeCraftsman deletes a craftsman profile and its workshops. Workshops
+// that haven't run are cancelled first, refunding their bookings like any
+// cancelled workshop; bookings of workshops that took place are kept.
+func purgeCraftsman(ctx context.Context, craftsman models.Craftsman, receipt *models.ErasureReceipt) error {
+	var workshops []models.Workshop
+	cursor, err := Collections.Workshops.Find(ctx, bson.M{"craftsman_id": craftsman.ID})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &workshops); err != nil {
+		return err
+	}
+	workshopIDs := bson.A{}
+	for _, workshop := range workshops {
+		workshopIDs = append(workshopIDs, workshop.ID)
+	}
+
+	deleted, err := Collections.Waitlist.DeleteMany(ctx, bson.M{"workshop_id": bson.M{"$in": workshopIDs}})
+	if err != nil {
+		return err
+	}
+	receipt.Actions["waitlist_entries_deleted"] += deleted.DeletedCount
+
+	for _, workshop := range workshops {
+		if workshop.Status == models.WorkshopStatusDraft || workshop.Status == models.WorkshopStatusUpcoming {
+			// A workshop that changes in the meantime fails the purge, which
+			// is retried on the next run
+			if err := transitionWorkshop(ctx, workshop, models.WorkshopStatusCancelled, bson.M{"cancelled_at": receipt.PurgedAt}); err != nil {
+				return err
+			}
+			workshop.Status = models.WorkshopStatusCancelled
+		}
+		if workshop.Status != models.WorkshopStatusCancelled {
+			continue
+		}
+
+		cancelled, err := cancelWorkshopBookings(ctx, workshop, receipt.PurgedAt)
+		receipt.Actions["bookings_cancelled"] += int64(cancelled)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Series first, so the scheduler doesn't recreate their workshops
+	deleted, err = Collections.WorkshopSeries.DeleteMany(ctx, bson.M{"craftsman_id": craftsman.ID})
+	if err != nil {
+		return err
+	}
+	receipt.Actions["workshop_series_deleted"] += deleted.DeletedCount
+
+	deleted, err = Collections.Workshops.DeleteMany(ctx, bson.M{"craftsman_id": craftsman.ID})
+	if err != nil {
+		return err
+	}
+	receipt.Actions["workshops_deleted"] += deleted.DeletedCount
+
+	deleted, err = Collections.Craftsmen.DeleteMany(ctx, bson.M{"_id": craftsman.ID})
+	if err != nil {
+		return err
+	}
+	receipt.Actions["craftsmen_deleted"] += deleted.DeletedCount
+	return nil
+}
+
+// purgeImages deletes the user's uploaded images. Images Cloudinary fails to
+// delete are recorded on the receipt and kept on file so an admin can retry.
+func purgeImages(ctx context.Context, userID primitive.ObjectID, receipt *models.ErasureReceipt) error {
+	var images []models.Image
+	cursor, err := Collections.Images.Find(ctx, bson.M{"owner_id": userID})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &images); err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		if err := deleteImage(image.PublicID); err != nil {
+			log.Printf("PurgeWorker: failed to delete image %s: %v", image.PublicID, err)
+			receipt.Failures = append(receipt.Failures, "image "+image.PublicID+": "+err.Error())
+			continue
+		}
+		if _, err := Collections.Images.DeleteOne(ctx, bson.M{"_id": image.ID}); err != nil {
+			return err
+		}
+		receipt.Actions["images_deleted"]++
+	}
+	return nil
+}
+
+// GetErasureReceipts lists the receipts of purged accounts and profiles
+func GetErasureReceipts(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	receipts := []models.ErasureReceipt{}
+	cursor, err := Collections.Erasures.Find(ctx, bson.M{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := cursor.All(ctx, &receipts); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, receipts)
+}
@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// stubImageDeletion records deleted images instead of calling Cloudinary
+func stubImageDeletion(t *testing.T, failing ...string) *[]string {
+	deleted := []string{}
+	original := deleteImage
+	deleteImage = func(publicID string) error {
+		for _, id := range failing {
+			if id == publicID {
+				return errors.New("cloudinary unavailable")
+			}
+		}
+		deleted = append(deleted, publicID)
+		return nil
+	}
+	t.Cleanup(func() { deleteImage = original })
+	return &deleted
+}
+
+func TestAccountDeletion(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	deletedImages := stubImageDeletion(t, "john/broken.jpg")
+
+	router, user := setupAuthRouter(t)
+	router.GET("/api/users/:id", GetUser)
+	router.POST("/api/auth/restore", RestoreAccount)
+	me := router.Group("/api/users/me", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), RoutePolicies.Enforce())
+	me.DELETE("", AsCurrentUser, DeleteUser)
+
+	ctx := context.Background()
+	insert := func(collection Collection, doc interface{}) primitive.ObjectID {
+		result, err := collection.InsertOne(ctx, doc)
+		require.NoError(t, err)
+		return result.InsertedID.(primitive.ObjectID)
+	}
+	find := func(collection Collection, id primitive.ObjectID, into interface{}) error {
+		return collection.FindOne(ctx, bson.M{"_id": id}).Decode(into)
+	}
+
+	// John is a craftsman with a workshop, books and bids himself, and
+	// sells at auction
+	other := CreateTestUser(t)
+	upcoming := func(title string, craftsmanID primitive.ObjectID) models.Workshop {
+		return models.Workshop{
+			Title:           title,
+			CraftsmanID:     craftsmanID,
+			Status:          models.WorkshopStatusUpcoming,
+			Date:            time.Now().Add(90 * 24 * time.Hour),
+			Price:           40,
+			MaxParticipants: 5,
+			CurrentStudents: 1,
+		}
+	}
+	craftsmanID := insert(Collections.Craftsmen, models.Craftsman{UserID: user.ID, Bio: "Potter"})
+	workshopID := insert(Collections.Workshops, upcoming("Throwing pots", craftsmanID))
+	othersWorkshopID := insert(Collections.Workshops, upcoming("Weaving", primitive.NewObjectID()))
+	bookedByOther := insert(Collections.Bookings, models.Booking{WorkshopID: workshopID, CustomerID: other, Status: models.BookingStatusConfirmed})
+	bookedByJohn := insert(Collections.Bookings, models.Booking{WorkshopID: othersWorkshopID, CustomerID: user.ID, Status: models.BookingStatusConfirmed})
+	johnsAuction := insert(Collections.Auctions, models.Auction{SellerID: user.ID})
+	bidOnJohnsAuction := insert(Collections.Bids, models.Bid{AuctionID: johnsAuction, BidderID: other})
+	othersAuction := insert(Collections.Auctions, models.Auction{SellerID: other, LastBid: &models.Bid{BidderID: user.ID}})
+	johnsBid := insert(Collections.Bids, models.Bid{AuctionID: othersAuction, BidderID: user.ID})
+	insert(Collections.Images, models.Image{PublicID: "john/pot.jpg", OwnerID: user.ID})
+	insert(Collections.Images, models.Image{PublicID: "john/broken.jpg", OwnerID: user.ID})
+	insert(Collections.Images, models.Image{PublicID: "other/vase.jpg", OwnerID: other})
+	insert(Collections.Reviews, models.Review{UserID: user.ID, Rating: 4})
+
+	deleteAccount := func() {
+		tokens := login(t, router, user.Email)
+		w := performJSON(router, "DELETE", "/api/users/me", nil, tokens["access_token"].(string))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		// The account is closed straight away
+		w = performJSON(router, "POST", "/api/auth/login", gin.H{"email": user.Email, "password": testPassword}, "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": tokens["refresh_token"]}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w = performJSON(router, "GET", "/api/users/"+user.ID.Hex(), nil, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		var craftsman models.Craftsman
+		require.NoError(t, find(Collections.Craftsmen, craftsmanID, &craftsman))
+		assert.NotNil(t, craftsman.DeletedAt)
+	}
+
+	t.Run("Deleted accounts can be restored during the grace period", func(t *testing.T) {
+		deleteAccount()
+
+		w := performJSON(router, "POST", "/api/auth/restore", gin.H{"email": user.Email, "password": "WrongP@ss123"}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w = performJSON(router, "POST", "/api/auth/restore", gin.H{"email": user.Email, "password": testPassword}, "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		login(t, router, user.Email)
+		var craftsman models.Craftsman
+		require.NoError(t, find(Collections.Craftsmen, craftsmanID, &craftsman))
+		assert.Nil(t, craftsman.DeletedAt)
+
+		w = performJSON(router, "POST", "/api/auth/restore", gin.H{"email": user.Email, "password": testPassword}, "")
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Accounts are purged after the grace period", func(t *testing.T) {
+		deleteAccount()
+
+		purged, err := PurgeDeletedAccounts(ctx, time.Now())
+		require.NoError(t, err)
+		assert.Zero(t, purged)
+
+		purged, err = PurgeDeletedAccounts(ctx, time.Now().Add(AccountDeletionGracePeriod+time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, purged)
+
+		var gone bson.M
+		assert.Error(t, find(Collections.Users, user.ID, &gone))
+		assert.Error(t, find(Collections.Craftsmen, craftsmanID, &gone))
+		assert.Error(t, find(Collections.Workshops, workshopID, &gone))
+		assert.Error(t, find(Collections.Auctions, johnsAuction, &gone))
+		assert.Error(t, find(Collections.Bids, bidOnJohnsAuction, &gone))
+
+		// John's workshop is called off and its customers refunded
+		var booking models.Booking
+		require.NoError(t, find(Collections.Bookings, bookedByOther, &booking))
+		assert.Equal(t, models.BookingStatusCancelled, booking.Status)
+		assert.Equal(t, models.PaymentStatusRefunded, booking.PaymentStatus)
+		assert.NotNil(t, booking.CancelledAt)
+		count, err := Collections.Transactions.CountDocuments(ctx, bson.M{"user_id": other, "reference_id": bookedByOther.Hex(), "amount": 40.0})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+
+		// John's own booking gives up its seat, and other people's records
+		// stay without John in them
+		require.NoError(t, find(Collections.Bookings, bookedByJohn, &booking))
+		assert.True(t, booking.CustomerID.IsZero())
+		assert.Equal(t, models.BookingStatusCancelled, booking.Status)
+		var workshop models.Workshop
+		require.NoError(t, find(Collections.Workshops, othersWorkshopID, &workshop))
+		assert.Equal(t, 0, workshop.CurrentStudents)
+		count, err = Collections.Transactions.CountDocuments(ctx, bson.M{"user_id": primitive.NilObjectID, "reference_id": bookedByJohn.Hex()})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count, "John's refund is kept without the link to him")
+		var bid models.Bid
+		require.NoError(t, find(Collections.Bids, johnsBid, &bid))
+		assert.True(t, bid.BidderID.IsZero())
+		var auction models.Auction
+		require.NoError(t, find(Collections.Auctions, othersAuction, &auction))
+		assert.True(t, auction.LastBid.BidderID.IsZero())
+
+		assert.Equal(t, []string{"john/pot.jpg"}, *deletedImages)
+		count, err = Collections.Images.CountDocuments(ctx, bson.M{"owner_id": user.ID})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count, "images that failed to delete are kept for a retry")
+
+		var receipt models.ErasureReceipt
+		require.NoError(t, Collections.Erasures.FindOne(ctx, bson.M{"subject_id": user.ID}).Decode(&receipt))
+		assert.Equal(t, models.ErasureSubjectUser, receipt.Subject)
+		assert.Equal(t, int64(1), receipt.Actions["craftsmen_deleted"])
+		assert.Equal(t, int64(1), receipt.Actions["workshops_deleted"])
+		assert.Equal(t, int64(2), receipt.Actions["bookings_cancelled"])
+		assert.Equal(t, int64(1), receipt.Actions["bookings_anonymized"])
+		assert.Equal(t, int64(1), receipt.Actions["images_deleted"])
+		assert.Equal(t, int64(1), receipt.Actions["reviews_deleted"])
+		assert.Len(t, receipt.Failures, 1)
+
+		// Nothing is left to purge
+		purged, err = PurgeDeletedAccounts(ctx, time.Now().Add(AccountDeletionGracePeriod+time.Hour))
+		require.NoError(t, err)
+		assert.Zero(t, purged)
+	})
+}
+
+func TestCraftsmanProfileDeletion(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	customer := newUser(t, "ana", models.RoleCustomer)
+	router := gin.New()
+	router.GET("/api/craftsmen/:id", GetCraftsman)
+	router.DELETE("/api/craftsmen/:id", DeleteCraftsman)
+	router.POST("/api/craftsmen/:id/restore", RestoreCraftsman)
+	router.GET("/api/customers/search/workshops", SearchWorkshops)
+	router.POST("/api/customers/workshops/:id/book", func(c *gin.Context) {
+		c.Set("user_id", customer.ID.Hex())
+		BookWorkshop(c)
+	})
+
+	ctx := context.Background()
+	userID := CreateTestUser(t)
+	result, err := Collections.Craftsmen.InsertOne(ctx, models.Craftsman{UserID: userID, Bio: "Weaver"})
+	require.NoError(t, err)
+	craftsmanID := result.InsertedID.(primitive.ObjectID)
+	result, err = Collections.Workshops.InsertOne(ctx, models.Workshop{
+		Title:           "Looms",
+		CraftsmanID:     craftsmanID,
+		Status:          models.WorkshopStatusUpcoming,
+		Date:            time.Now().Add(90 * 24 * time.Hour),
+		MaxParticipants: 5,
+	})
+	require.NoError(t, err)
+	workshopID := result.InsertedID.(primitive.ObjectID)
+	result, err = Collections.Workshops.InsertOne(ctx, models.Workshop{
+		Title:       "Spinning",
+		CraftsmanID: craftsmanID,
+		Status:      models.WorkshopStatusCompleted,
+		Date:        time.Now().Add(-24 * time.Hour),
+	})
+	require.NoError(t, err)
+	attended, err := Collections.Bookings.InsertOne(ctx, models.Booking{
+		WorkshopID: result.InsertedID.(primitive.ObjectID),
+		CustomerID: customer.ID,
+		Status:     models.BookingStatusCompleted,
+	})
+	require.NoError(t, err)
+
+	path := "/api/craftsmen/" + craftsmanID.Hex()
+	bookPath := "/api/customers/workshops/" + workshopID.Hex() + "/book"
+	listed := func() int {
+		w := performJSON(router, "GET", "/api/customers/search/workshops", nil, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var workshops []models.Workshop
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &workshops))
+		return len(workshops)
+	}
+
+	// The profile and its workshops are hidden while the deletion is pending
+	w := performJSON(router, "DELETE", path, nil, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "GET", path, nil, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Zero(t, listed())
+	w = performJSON(router, "POST", bookPath, nil, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performJSON(router, "POST", path+"/restore", nil, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "GET", path, nil, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performJSON(router, "POST", path+"/restore", nil, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, 1, listed())
+	w = performJSON(router, "POST", bookPath, nil, "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var booked models.Booking
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &booked))
+
+	w = performJSON(router, "DELETE", path, nil, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	purged, err := PurgeDeletedAccounts(ctx, time.Now().Add(AccountDeletionGracePeriod+time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	// The booking of the workshop that didn't take place is cancelled; the
+	// one that did is kept as it was
+	var booking models.Booking
+	require.NoError(t, Collections.Bookings.FindOne(ctx, bson.M{"_id": booked.ID}).Decode(&booking))
+	assert.Equal(t, models.BookingStatusCancelled, booking.Status)
+	assert.NotNil(t, booking.CancelledAt)
+	require.NoError(t, Collections.Bookings.FindOne(ctx, bson.M{"_id": attended.InsertedID}).Decode(&booking))
+	assert.Equal(t, models.BookingStatusCompleted, booking.Status)
+
+	// The user keeps their account
+	var user models.User
+	require.NoError(t, Collections.Users.FindOne(ctx, bson.M{"_id": userID}).Decode(&user))
+	count, err := Collections.Workshops.CountDocuments(ctx, bson.M{"craftsman_id": craftsmanID})
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	var receipt models.ErasureReceipt
+	require.NoError(t, Collections.Erasures.FindOne(ctx, bson.M{"subject_id": craftsmanID}).Decode(&receipt))
+	assert.Equal(t, models.ErasureSubjectCraftsman, receipt.Subject)
+	assert.Equal(t, int64(2), receipt.Actions["workshops_deleted"])
+	assert.Equal(t, int64(1), receipt.Actions["bookings_cancelled"])
+}
+
+func TestPurgedCustomersGiveUpTheirSeats(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	ctx := context.Background()
+	result, err := Collections.Workshops.InsertOne(ctx, models.Workshop{
+		Title:           "Looms",
+		CraftsmanID:     primitive.NewObjectID(),
+		Status:          models.WorkshopStatusUpcoming,
+		Date:            time.Now().Add(90 * 24 * time.Hour),
+		MaxParticipants: 2,
+		CurrentStudents: 2,
+	})
+	require.NoError(t, err)
+	workshopID := result.InsertedID.(primitive.ObjectID)
+
+	// Two customers holding the workshop's seats delete their accounts,
+	// while a third waits for a seat
+	deletedAt := time.Now()
+	for _, name := range []string{"ana", "bor"} {
+		customer := newUser(t, name, models.RoleCustomer)
+		_, err := Collections.Bookings.InsertOne(ctx, models.Booking{WorkshopID: workshopID, CustomerID: customer.ID, Status: models.BookingStatusConfirmed})
+		require.NoError(t, err)
+		_, err = Collections.Users.UpdateOne(ctx, bson.M{"_id": customer.ID}, bson.M{"$set": bson.M{"deleted_at": deletedAt}})
+		require.NoError(t, err)
+	}
+	waiting := newUser(t, "cene", models.RoleCustomer)
+	_, err = Collections.Waitlist.InsertOne(ctx, models.WaitlistEntry{WorkshopID: workshopID, CustomerID: waiting.ID, JoinedAt: time.Now()})
+	require.NoError(t, err)
+
+	purged, err := PurgeDeletedAccounts(ctx, time.Now().Add(AccountDeletionGracePeriod+time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+
+	// Anonymized bookings no longer hold seats, so they can't collide on the
+	// unique index of active bookings
+	count, err := Collections.Bookings.CountDocuments(ctx, bson.M{
+		"customer_id": primitive.NilObjectID,
+		"status":      bson.M{"$in": activeBookingStatuses},
+	})
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	// One seat went to the waitlist, the other is free again
+	var offer models.Booking
+	require.NoError(t, Collections.Bookings.FindOne(ctx, bson.M{"customer_id": waiting.ID}).Decode(&offer))
+	assert.Equal(t, models.BookingStatusPending, offer.Status)
+	var workshop models.Workshop
+	require.NoError(t, Collections.Workshops.FindOne(ctx, bson.M{"_id": workshopID}).Decode(&workshop))
+	assert.Equal(t, 1, workshop.CurrentStudents)
+}
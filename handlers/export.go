@@ -0,0 +1,322 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"backend-dragonhak/models"
+	"backend-dragonhak/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ExportDir is where finished data exports are stored until downloaded
+var ExportDir = "exports"
+
+// ExportRetention is how long a finished export can be downloaded
+var ExportRetention = 7 * 24 * time.Hour
+
+// exportTimeout bounds a single export job; jobs older than this that never
+// finished are treated as failed and can be requested again
+const exportTimeout = 10 * time.Minute
+
+// RequestDataExport starts gathering a copy of the user's personal data. An
+// export that is still in progress is returned instead of starting another.
+func RequestDataExport(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := currentUser(ctx, c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	existing, err := findDataExport(ctx, user.ID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load data export"})
+		return
+	}
+	if err == nil {
+		inProgress := existing.Status == models.ExportStatusPending || existing.Status == models.ExportStatusRunning
+		if inProgress && time.Since(existing.RequestedAt) < exportTimeout {
+			c.JSON(http.StatusAccepted, existing)
+			return
+		}
+		if err := removeDataExport(ctx, existing); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replace data export"})
+			return
+		}
+	}
+
+	export := models.DataExport{
+		UserID:      user.ID,
+		Status:      models.ExportStatusPending,
+		RequestedAt: time.Now(),
+	}
+	result, err := Collections.Exports.InsertOne(ctx, export)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A data export is already being started"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start data export"})
+		return
+	}
+	export.ID = result.InsertedID.(primitive.ObjectID)
+
+	go func() {
+		jobCtx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		runDataExport(jobCtx, export.ID, user)
+	}()
+
+	c.JSON(http.StatusAccepted, export)
+}
+
+// GetDataExport reports the status of the user's latest data export
+func GetDataExport(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	export, err := findDataExport(ctx, userID)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No data export requested"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load data export"})
+		return
+	}
+
+	if exportDownloadable(export) {
+		export.DownloadURL = "/api/users/me/export/download"
+	}
+	c.JSON(http.StatusOK, export)
+}
+
+// DownloadDataExport sends the user's finished data export as a ZIP file
+func DownloadDataExport(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	export, err := findDataExport(ctx, userID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load data export"})
+		return
+	}
+	if err == mongo.ErrNoDocuments || !exportDownloadable(export) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No data export ready for download"})
+		return
+	}
+
+	name := fmt.Sprintf("dragonhak-export-%s.zip", export.RequestedAt.Format("2006-01-02"))
+	c.FileAttachment(export.File, name)
+}
+
+func findDataExport(ctx context.Context, userID primitive.ObjectID) (models.DataExport, error) {
+	var export models.DataExport
+	err := Collections.Exports.FindOne(ctx, bson.M{"user_id": userID}).Decode(&export)
+	return export, err
+}
+
+func exportDownloadable(export models.DataExport) bool {
+	return export.Status == models.ExportStatusReady &&
+		export.ExpiresAt != nil && time.Now().Before(*export.ExpiresAt)
+}
+
+// removeDataExport deletes an export along with its file
+func removeDataExport(ctx context.Context, export models.DataExport) error {
+	if export.File != "" {
+		if err := os.Remove(export.File); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	_, err := Collections.Exports.DeleteOne(ctx, bson.M{"_id": export.ID})
+	return err
+}
+
+// PurgeExpiredExports deletes every finished export whose download expired
+// before now, file included, and returns how many were deleted
+func PurgeExpiredExports(ctx context.Context, now time.Time) (int, error) {
+	var expired []models.DataExport
+	err := findAll(ctx, Collections.Exports, bson.M{
+		"status":     models.ExportStatusReady,
+		"expires_at": bson.M{"$lte": now},
+	}, &expired)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, export := range expired {
+		if err := removeDataExport(ctx, export); err != nil {
+			return i, fmt.Errorf("remove export %s: %w", export.ID.Hex(), err)
+		}
+	}
+	return len(expired), nil
+}
+
+// runDataExport builds the ZIP for an export and records the outcome
+func runDataExport(ctx context.Context, exportID primitive.ObjectID, user models.User) {
+	setStatus := func(set bson.M) {
+		if _, err := Collections.Exports.UpdateOne(ctx, bson.M{"_id": exportID}, bson.M{"$set": set}); err != nil {
+			log.Printf("DataExport: failed to update export %s: %v", exportID.Hex(), err)
+		}
+	}
+	setStatus(bson.M{"status": models.ExportStatusRunning})
+
+	file, err := writeDataExport(ctx, exportID, user)
+	if err != nil {
+		log.Printf("DataExport: export %s failed: %v", exportID.Hex(), err)
+		setStatus(bson.M{"status": models.ExportStatusFailed, "error": "The export could not be completed, please try again"})
+		return
+	}
+
+	now := time.Now()
+	setStatus(bson.M{
+		"status":       models.ExportStatusReady,
+		"file":         file,
+		"completed_at": now,
+		"expires_at":   now.Add(ExportRetention),
+	})
+
+	sendMail(ctx, func() (services.Message, error) {
+		return services.DataExportEmail(user.Email, user.Name, Mail.BaseURL+"/api/users/me/export/download")
+	})
+}
+
+// writeDataExport gathers everything keyed to the user into a ZIP of JSON
+// files and returns its path
+func writeDataExport(ctx context.Context, exportID primitive.ObjectID, user models.User) (string, error) {
+	files := map[string]interface{}{}
+
+	// The user's JSON tags already leave out credentials and secrets
+	files["profile.json"] = user
+	badges := user.Badges
+	if badges == nil {
+		badges = []models.Badge{}
+	}
+	files["badges.json"] = badges
+
+	craftsmen := []models.Craftsman{}
+	if err := findAll(ctx, Collections.Craftsmen, bson.M{"user_id": user.ID}, &craftsmen); err != nil {
+		return "", err
+	}
+	files["craftsman.json"] = craftsmen
+
+	bookings := []models.Booking{}
+	if err := findAll(ctx, Collections.Bookings, bson.M{"customer_id": user.ID}, &bookings); err != nil {
+		return "", err
+	}
+	files["bookings.json"] = bookings
+
+	bids := []models.Bid{}
+	if err := findAll(ctx, Collections.Bids, bson.M{"bidder_id": user.ID}, &bids); err != nil {
+		return "", err
+	}
+	files["bids.json"] = bids
+
+	auctions := []models.Auction{}
+	if err := findAll(ctx, Collections.Auctions, bson.M{"seller_id": user.ID}, &auctions); err != nil {
+		return "", err
+	}
+	files["auctions.json"] = auctions
+
+	reviews := []models.Review{}
+	if err := findAll(ctx, Collections.Reviews, bson.M{"user_id": user.ID}, &reviews); err != nil {
+		return "", err
+	}
+	files["reviews.json"] = reviews
+
+	waitlist := []models.WaitlistEntry{}
+	if err := findAll(ctx, Collections.Waitlist, bson.M{"customer_id": user.ID}, &waitlist); err != nil {
+		return "", err
+	}
+	files["waitlist.json"] = waitlist
+
+	transactions := []models.Transaction{}
+	if err := findAll(ctx, Collections.Transactions, bson.M{"user_id": user.ID}, &transactions); err != nil {
+		return "", err
+	}
+	files["transactions.json"] = transactions
+
+	images := []models.Image{}
+	if err := findAll(ctx, Collections.Images, bson.M{"owner_id": user.ID}, &images); err != nil {
+		return "", err
+	}
+	files["images.json"] = images
+
+	sessions, err := Stores.Sessions.List(ctx, user.ID.Hex())
+	if err != nil {
+		return "", err
+	}
+	files["sessions.json"] = sessions
+
+	if err := os.MkdirAll(ExportDir, 0o700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(ExportDir, "export-*.zip.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	archive := zip.NewWriter(tmp)
+	for name, data := range files {
+		w, err := archive.Create(name)
+		if err != nil {
+			tmp.Close()
+			return "", err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(data); err != nil {
+			tmp.Close()
+			return "", err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(ExportDir, exportID.Hex()+".zip")
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// findAll decodes every document matching filter into results
+func findAll(ctx context.Context, collection Collection, filter bson.M, results interface{}) error {
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
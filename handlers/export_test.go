@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestDataExport(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	me := router.Group("/api/users/me", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), RoutePolicies.Enforce())
+	me.POST("/export", RequestDataExport)
+	me.GET("/export", GetDataExport)
+	me.GET("/export/download", DownloadDataExport)
+
+	ctx := context.Background()
+	other := CreateTestUser(t)
+	insert := func(collection Collection, doc interface{}) {
+		_, err := collection.InsertOne(ctx, doc)
+		require.NoError(t, err)
+	}
+	insert(Collections.Craftsmen, models.Craftsman{UserID: user.ID, Bio: "Potter"})
+	insert(Collections.Bookings, models.Booking{WorkshopID: primitive.NewObjectID(), CustomerID: user.ID, Status: models.BookingStatusConfirmed})
+	insert(Collections.Bookings, models.Booking{WorkshopID: primitive.NewObjectID(), CustomerID: other, Status: models.BookingStatusConfirmed})
+	insert(Collections.Reviews, models.Review{UserID: user.ID, Rating: 5, Comment: "Lovely class"})
+	insert(Collections.Reviews, models.Review{UserID: other, Rating: 1, Comment: "Not for me"})
+
+	token := login(t, router, user.Email)["access_token"].(string)
+
+	w := performJSON(router, "GET", "/api/users/me/export", nil, token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performJSON(router, "POST", "/api/users/me/export", nil, token)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	var export models.DataExport
+	require.Eventually(t, func() bool {
+		w := performJSON(router, "GET", "/api/users/me/export", nil, token)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &export))
+		return export.Status == models.ExportStatusReady
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "/api/users/me/export/download", export.DownloadURL)
+	assert.NotNil(t, export.ExpiresAt)
+
+	// The user is told by email once the export is ready
+	require.Eventually(t, func() bool { return len(sentMail(t)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "Your data export is ready", sentMail(t)[0].Header.Get("Subject"))
+
+	w = performJSON(router, "GET", "/api/users/me/export/download", nil, token)
+	require.Equal(t, http.StatusOK, w.Code)
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+
+	files := map[string]string{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		r.Close()
+		files[f.Name] = string(data)
+	}
+
+	for _, name := range []string{"profile.json", "craftsman.json", "bookings.json", "bids.json", "auctions.json", "reviews.json", "badges.json", "sessions.json", "images.json"} {
+		assert.Contains(t, files, name)
+	}
+	assert.Contains(t, files["profile.json"], user.Email)
+	assert.Contains(t, files["craftsman.json"], "Potter")
+	assert.Contains(t, files["reviews.json"], "Lovely class")
+	assert.NotContains(t, files["reviews.json"], "Not for me")
+	assert.NotContains(t, files["bookings.json"], other.Hex())
+	assert.Equal(t, 1, strings.Count(files["bookings.json"], user.ID.Hex()))
+	for name, data := range files {
+		assert.NotContains(t, data, user.Password, "password hash leaked in %s", name)
+	}
+
+	// Once the download expires the file and its record are deleted
+	stored, err := findDataExport(ctx, user.ID)
+	require.NoError(t, err)
+	purged, err := PurgeExpiredExports(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	purged, err = PurgeExpiredExports(ctx, stored.ExpiresAt.Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.NoFileExists(t, stored.File)
+	_, err = findDataExport(ctx, user.ID)
+	assert.Equal(t, mongo.ErrNoDocuments, err)
+}
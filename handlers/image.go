@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"backend-dragonhak/models"
 	"backend-dragonhak/services"
+	"context"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type UploadImageRequest struct {
@@ -12,8 +18,18 @@ type UploadImageRequest struct {
 	Folder      string `json:"folder" binding:"required"`
 }
 
-// UploadImage handles image upload requests
+// UploadImage handles image upload requests. Images are recorded against the
+// uploader so they can delete them and so they are erased with the account.
 func UploadImage(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ownerID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
 	var req UploadImageRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -27,6 +43,21 @@ func UploadImage(c *gin.Context) {
 		return
 	}
 
+	image := models.Image{
+		PublicID:  publicID,
+		URL:       imageURL,
+		OwnerID:   ownerID,
+		CreatedAt: time.Now(),
+	}
+	if _, err := Collections.Images.InsertOne(ctx, image); err != nil {
+		// An untracked image could never be erased, so don't keep it
+		if err := deleteImage(publicID); err != nil {
+			log.Printf("UploadImage: failed to remove untracked image %s: %v", publicID, err)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"url":       imageURL,
 		"public_id": publicID,
@@ -54,18 +85,26 @@ func GetImage(c *gin.Context) {
 
 // DeleteImage deletes an image by its public ID
 func DeleteImage(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
 	publicID := c.Param("public_id")
 	if publicID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Public ID is required"})
 		return
 	}
 
-	err := services.DeleteImage(publicID)
+	err := deleteImage(publicID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image: " + err.Error()})
 		return
 	}
 
+	if _, err := Collections.Images.DeleteOne(ctx, bson.M{"public_id": publicID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image record"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Image deleted successfully",
 	})
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+
+	"backend-dragonhak/services"
+)
+
+// Mail holds the outbound mailer and the base URL used to build links in emails
+var Mail struct {
+	Sender  services.Mailer
+	BaseURL string
+}
+
+// InitMail sets the mailer used by the handlers
+func InitMail(sender services.Mailer, baseURL string) {
+	Mail.Sender = sender
+	Mail.BaseURL = strings.TrimRight(baseURL, "/")
+}
+
+// mailLink builds an absolute link to path carrying a one-time token
+func mailLink(path, token string) string {
+	return Mail.BaseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendMail renders and sends a message, logging failures for callers that
+// shouldn't fail the request over an undelivered email
+func sendMail(ctx context.Context, build func() (services.Message, error)) error {
+	msg, err := build()
+	if err == nil {
+		err = Mail.Sender.Send(ctx, msg)
+	}
+	if err != nil {
+		log.Printf("Failed to send email: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// currentUser loads the authenticated user
+func currentUser(ctx context.Context, c *gin.Context) (models.User, error) {
+	var user models.User
+	objID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		return user, err
+	}
+	err = Collections.Users.FindOne(ctx, bson.M{"_id": objID}).Decode(&user)
+	return user, err
+}
+
+// AsCurrentUser points the id route parameter at the authenticated user, so
+// the handlers for /api/users/:id also serve /api/users/me
+func AsCurrentUser(c *gin.Context) {
+	c.Params = append(c.Params, gin.Param{Key: "id", Value: c.GetString("user_id")})
+	c.Next()
+}
+
+// GetMe returns the authenticated user's account along with their craftsman
+// profile, badges and bookings
+func GetMe(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := currentUser(ctx, c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	profile := models.NewProfileView(user)
+	account := models.AccountView{
+		User:   profile,
+		Badges: user.Badges,
+		Verification: models.VerificationView{
+			EmailVerified: profile.EmailVerified,
+			VerifiedAt:    profile.VerifiedAt,
+		},
+	}
+	if account.Badges == nil {
+		account.Badges = []models.Badge{}
+	}
+
+	var craftsman models.Craftsman
+	err = Collections.Craftsmen.FindOne(ctx, bson.M{"user_id": user.ID}).Decode(&craftsman)
+	if err == nil {
+		account.Craftsman = &craftsman
+	} else if err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load craftsman profile"})
+		return
+	}
+
+	account.BookingsCount, err = Collections.Bookings.CountDocuments(ctx, bson.M{"customer_id": user.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count bookings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
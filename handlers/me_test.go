@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMeEndpoints(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	me := router.Group("/api/users/me", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), RoutePolicies.Enforce())
+	me.GET("", GetMe)
+	me.PATCH("", AsCurrentUser, UpdateUser)
+	me.GET("/badges", AsCurrentUser, GetUserBadges)
+
+	ctx := context.Background()
+	badge := models.Badge{ID: primitive.NewObjectID(), Name: "First workshop"}
+	_, err := Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"badges": []models.Badge{badge}}})
+	require.NoError(t, err)
+	_, err = Collections.Craftsmen.InsertOne(ctx, models.Craftsman{UserID: user.ID, Bio: "Potter", CreatedAt: time.Now()})
+	require.NoError(t, err)
+	for _, customerID := range []primitive.ObjectID{user.ID, user.ID, primitive.NewObjectID()} {
+		_, err = Collections.Bookings.InsertOne(ctx, models.Booking{CustomerID: customerID, WorkshopID: primitive.NewObjectID()})
+		require.NoError(t, err)
+	}
+
+	token := login(t, router, user.Email)["access_token"].(string)
+
+	t.Run("Returns the whole account", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/users/me", nil, token)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var account models.AccountView
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &account))
+		assert.Equal(t, user.ID, account.User.ID)
+		assert.Equal(t, user.Email, account.User.Email)
+		require.NotNil(t, account.Craftsman)
+		assert.Equal(t, "Potter", account.Craftsman.Bio)
+		require.Len(t, account.Badges, 1)
+		assert.Equal(t, badge.Name, account.Badges[0].Name)
+		assert.Equal(t, int64(2), account.BookingsCount)
+		assert.False(t, account.Verification.EmailVerified)
+	})
+
+	t.Run("Updates apply to the caller", func(t *testing.T) {
+		w := performJSON(router, "PATCH", "/api/users/me", gin.H{"name": "Johnny"}, token)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var updated models.User
+		require.NoError(t, Collections.Users.FindOne(ctx, bson.M{"_id": user.ID}).Decode(&updated))
+		assert.Equal(t, "Johnny", updated.Name)
+	})
+
+	t.Run("Badges", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/users/me/badges", nil, token)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), badge.Name)
+	})
+
+	t.Run("Requires a token", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/users/me", nil, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
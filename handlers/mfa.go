@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"backend-dragonhak/auth"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// mfaIssuer is the account issuer shown in authenticator apps
+const mfaIssuer = "DragonHak"
+
+type ConfirmMFARequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfa_token" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// useTOTPCode checks a TOTP code and makes sure it can't be replayed
+func useTOTPCode(ctx context.Context, userID primitive.ObjectID, secret, code string) (bool, error) {
+	counter, ok := auth.ValidateTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return Stores.MFA.MarkCodeUsed(ctx, userID.Hex(), counter)
+}
+
+// EnrollMFA starts two-factor enrollment by generating a TOTP secret. The
+// secret only takes effect once a code from it is confirmed.
+func EnrollMFA(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := currentUser(ctx, c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.MFA != nil && user.MFA.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	_, err = Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+		"$set": bson.M{"mfa.pending_secret": secret, "updated_at": time.Now()},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enrollment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": auth.TOTPURI(mfaIssuer, user.Email, secret),
+	})
+}
+
+// ConfirmMFA enables two-factor authentication once the user proves their
+// authenticator works, and returns recovery codes. The codes are only shown
+// this once.
+func ConfirmMFA(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req ConfirmMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	user, err := currentUser(ctx, c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.MFA == nil || user.MFA.PendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor enrollment has not been started"})
+		return
+	}
+
+	ok, err := useTOTPCode(ctx, user.ID, user.MFA.PendingSecret, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, hashes, err := auth.GenerateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	now := time.Now()
+	_, err = Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+		"$set": bson.M{
+			"mfa.enabled":        true,
+			"mfa.secret":         user.MFA.PendingSecret,
+			"mfa.recovery_codes": hashes,
+			"mfa.enabled_at":     now,
+			"updated_at":         now,
+		},
+		"$unset": bson.M{"mfa.pending_secret": ""},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// VerifyMFALogin completes a two-step login with a TOTP or recovery code
+func VerifyMFALogin(c *gin.Context) {
+	var req MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Code == "") == (req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide the MFA token and either a code or a recovery code"})
+		return
+	}
+
+	userID, err := Stores.MFA.Consume(c, req.MFAToken)
+	if err != nil {
+		if err == auth.ErrTokenInvalid {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify MFA token"})
+		}
+		return
+	}
+
+	objID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	var user models.User
+	if err := Collections.Users.FindOne(c, bson.M{"_id": objID}).Decode(&user); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	// The account may have been closed since the password was checked
+	if user.SuspendedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is suspended"})
+		return
+	}
+
+	if user.DeletedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is scheduled for deletion, restore it to log in again"})
+		return
+	}
+
+	if user.MFA == nil || !user.MFA.Enabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	// Wrong codes count as failed logins, so codes can't be guessed by
+	// logging in again for a new challenge
+	if loginLocked(c, user.Email) {
+		return
+	}
+
+	if req.Code != "" {
+		ok, err := useTOTPCode(c, user.ID, user.MFA.Secret, req.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+			return
+		}
+		if !ok {
+			mfaFailed(c, user.Email)
+			return
+		}
+	} else {
+		i := auth.MatchRecoveryCode(req.RecoveryCode, user.MFA.RecoveryCodes)
+		if i < 0 {
+			mfaFailed(c, user.Email)
+			return
+		}
+
+		// Recovery codes are single use; only the login that removes the
+		// code gets through when two use it at once
+		hash := user.MFA.RecoveryCodes[i]
+		result, err := Collections.Users.UpdateOne(c, bson.M{"_id": user.ID, "mfa.recovery_codes": hash}, bson.M{
+			"$pull": bson.M{"mfa.recovery_codes": hash},
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to use recovery code"})
+			return
+		}
+		if result.ModifiedCount == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+	}
+
+	loginSucceeded(c, user.Email)
+	respondWithTokens(c, user)
+}
+
+// mfaFailed records a wrong second factor against the account and client IP
+func mfaFailed(c *gin.Context, email string) {
+	if err := Stores.Logins.RecordFailure(c, email, c.ClientIP()); err != nil {
+		log.Printf("Login: failed to record login failure: %v", err)
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+}
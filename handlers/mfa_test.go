@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"backend-dragonhak/auth"
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B test vectors, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		code, err := auth.TOTPCode(secret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		assert.Equal(t, want, code, "time %d", unix)
+	}
+}
+
+func TestMFALogin(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	authRequired := middleware.AuthMiddleware(Stores.Keys, Stores.Denylist)
+	router.POST("/api/users/me/mfa/enroll", authRequired, EnrollMFA)
+	router.POST("/api/users/me/mfa/confirm", authRequired, ConfirmMFA)
+	router.POST("/api/auth/login/mfa", VerifyMFALogin)
+
+	accessToken := login(t, router, user.Email)["access_token"].(string)
+
+	// Enroll and confirm
+	w := performJSON(router, "POST", "/api/users/me/mfa/enroll", nil, accessToken)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var enrollment map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enrollment))
+	secret := enrollment["secret"]
+	assert.Contains(t, enrollment["otpauth_uri"], "otpauth://totp/")
+	assert.Contains(t, enrollment["otpauth_uri"], "secret="+secret)
+
+	// Password login still works until the enrollment is confirmed
+	login(t, router, user.Email)
+
+	w = performJSON(router, "POST", "/api/users/me/mfa/confirm", gin.H{"code": "abcdef"}, accessToken)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	code, err := auth.TOTPCode(secret, time.Now())
+	require.NoError(t, err)
+	w = performJSON(router, "POST", "/api/users/me/mfa/confirm", gin.H{"code": code}, accessToken)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &confirmation))
+	assert.Len(t, confirmation.RecoveryCodes, 10)
+
+	w = performJSON(router, "POST", "/api/users/me/mfa/enroll", nil, accessToken)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// challenge logs in with the password and returns the MFA token
+	challenge := func() string {
+		response := login(t, router, user.Email)
+		assert.Equal(t, true, response["mfa_required"])
+		assert.Nil(t, response["access_token"])
+		return response["mfa_token"].(string)
+	}
+
+	t.Run("A code can't be replayed", func(t *testing.T) {
+		w := performJSON(router, "POST", "/api/auth/login/mfa", gin.H{"mfa_token": challenge(), "code": code}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Valid code completes the login", func(t *testing.T) {
+		next, err := auth.TOTPCode(secret, time.Now().Add(30*time.Second))
+		require.NoError(t, err)
+
+		w := performJSON(router, "POST", "/api/auth/login/mfa", gin.H{"mfa_token": challenge(), "code": next}, "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "access_token")
+		assert.Contains(t, w.Body.String(), `"mfa_enabled":true`)
+	})
+
+	t.Run("A challenge can only be answered once", func(t *testing.T) {
+		token := challenge()
+		w := performJSON(router, "POST", "/api/auth/login/mfa", gin.H{"mfa_token": token, "code": "abcdef"}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		previous, err := auth.TOTPCode(secret, time.Now().Add(-30*time.Second))
+		require.NoError(t, err)
+		w = performJSON(router, "POST", "/api/auth/login/mfa", gin.H{"mfa_token": token, "code": previous}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "Invalid or expired MFA token")
+	})
+
+	t.Run("Recovery codes work once", func(t *testing.T) {
+		recovery := confirmation.RecoveryCodes[0]
+		w := performJSON(router, "POST", "/api/auth/login/mfa", gin.H{"mfa_token": challenge(), "recovery_code": recovery}, "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = performJSON(router, "POST", "/api/auth/login/mfa", gin.H{"mfa_token": challenge(), "recovery_code": recovery}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("A recovery code used by two logins at once works once", func(t *testing.T) {
+		recovery := confirmation.RecoveryCodes[1]
+		token := challenge()
+
+		// The second login read the user before the first removed the code
+		var stale models.User
+		require.NoError(t, Collections.Users.FindOne(context.Background(), bson.M{"_id": user.ID}).Decode(&stale))
+
+		w := performJSON(router, "POST", "/api/auth/login/mfa", gin.H{"mfa_token": challenge(), "recovery_code": recovery}, "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		users := Collections.Users
+		Collections.Users = fixedLookup{users, stale}
+		defer func() { Collections.Users = users }()
+
+		w = performJSON(router, "POST", "/api/auth/login/mfa", gin.H{"mfa_token": token, "recovery_code": recovery}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("An account deleted during the challenge can't log in", func(t *testing.T) {
+		token := challenge()
+		_, err := Collections.Users.UpdateOne(context.Background(), bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"deleted_at": time.Now()}})
+		require.NoError(t, err)
+		defer Collections.Users.UpdateOne(context.Background(), bson.M{"_id": user.ID}, bson.M{"$unset": bson.M{"deleted_at": ""}})
+
+		w := performJSON(router, "POST", "/api/auth/login/mfa", gin.H{"mfa_token": token, "code": "000000"}, "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Wrong codes count as failed logins", func(t *testing.T) {
+		w := performJSON(router, "POST", "/api/auth/login", gin.H{"email": user.Email, "password": "WrongP@ss123"}, "")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+
+		// The right password alone doesn't clear the failure, and each wrong
+		// code adds one until the back-off starts
+		for i := 0; i < 2; i++ {
+			w := performJSON(router, "POST", "/api/auth/login/mfa", gin.H{"mfa_token": challenge(), "code": "000000"}, "")
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		}
+		w = performJSON(router, "POST", "/api/auth/login", gin.H{"email": user.Email, "password": testPassword}, "")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	})
+}
+
+// fixedLookup is a collection whose lookups always return the same document,
+// as if it was read before a concurrent request changed it
+type fixedLookup struct {
+	Collection
+	doc interface{}
+}
+
+func (f fixedLookup) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	return mongo.NewSingleResultFromDocument(f.doc, nil, nil)
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend-dragonhak/auth"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// OAuthProviders holds the configured social login providers by name
+var OAuthProviders = map[string]auth.OAuthProvider{}
+
+// StartOAuthLogin sends the user to the provider's login page
+func StartOAuthLogin(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := c.Param("provider")
+	provider, ok := OAuthProviders[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown login provider"})
+		return
+	}
+
+	state, login, err := Stores.OAuthStates.Start(ctx, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	c.Redirect(http.StatusFound, provider.AuthCodeURL(state, login.Nonce, login.CodeChallenge()))
+}
+
+// OAuthCallback completes a social login and returns the usual token pair.
+// The external identity is matched to a user by a previous link, then by
+// verified email; otherwise a new account is created.
+func OAuthCallback(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	name := c.Param("provider")
+	provider, ok := OAuthProviders[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown login provider"})
+		return
+	}
+
+	if c.Query("error") != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login was cancelled or denied"})
+		return
+	}
+
+	login, err := Stores.OAuthStates.Consume(ctx, c.Query("state"))
+	if err != nil || login.Provider != name {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state"})
+		return
+	}
+
+	identity, err := provider.Exchange(ctx, c.Query("code"), login.CodeVerifier, login.Nonce)
+	if err != nil {
+		log.Printf("OAuthCallback: %s login failed: %v", name, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to log in with " + name})
+		return
+	}
+
+	user, status, message := userForIdentity(ctx, identity)
+	if status != http.StatusOK {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+
+	if user.SuspendedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is suspended"})
+		return
+	}
+
+	if user.DeletedAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is scheduled for deletion, restore it to log in again"})
+		return
+	}
+
+	respondWithFirstFactor(c, user)
+}
+
+// userForIdentity finds, links or creates the user for an external identity.
+// On failure it returns the status and message to respond with.
+func userForIdentity(ctx context.Context, identity *auth.Identity) (models.User, int, string) {
+	var user models.User
+
+	// Already linked
+	err := Collections.Users.FindOne(ctx, bson.M{
+		"identities": bson.M{"$elemMatch": bson.M{"provider": identity.Provider, "subject": identity.Subject}},
+	}).Decode(&user)
+	if err == nil {
+		return user, http.StatusOK, ""
+	} else if err != mongo.ErrNoDocuments {
+		return user, http.StatusInternalServerError, "Failed to look up user"
+	}
+
+	// Anyone can claim any address at some providers, so only a verified
+	// email proves the identity belongs to the account's owner
+	if identity.Email == "" || !identity.EmailVerified {
+		return user, http.StatusBadRequest, "Your " + identity.Provider + " account has no verified email address"
+	}
+
+	linked := models.ExternalIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+		LinkedAt: time.Now(),
+	}
+
+	err = Collections.Users.FindOne(ctx, bson.M{"email": identity.Email}).Decode(&user)
+	if err == nil {
+		// Someone could have registered the address without owning it, and
+		// linking would let them keep their password on the victim's account
+		if !user.EmailVerified {
+			return user, http.StatusConflict, "An account with this email exists but its email is not verified. Log in with your password and verify it first."
+		}
+
+		_, err = Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+			"$push": bson.M{"identities": linked},
+			"$set":  bson.M{"updated_at": time.Now()},
+		})
+		if err != nil {
+			return user, http.StatusInternalServerError, "Failed to link account"
+		}
+		user.Identities = append(user.Identities, linked)
+		return user, http.StatusOK, ""
+	} else if err != mongo.ErrNoDocuments {
+		return user, http.StatusInternalServerError, "Failed to look up user"
+	}
+
+	// New users sign up as customers without a password
+	now := time.Now()
+	username, _, _ := strings.Cut(identity.Email, "@")
+	user = models.User{
+		Name:          identity.Name,
+		Surname:       identity.Surname,
+		Username:      username,
+		Email:         identity.Email,
+		Role:          models.RoleCustomer,
+		EmailVerified: true,
+		VerifiedAt:    now,
+		Identities:    []models.ExternalIdentity{linked},
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	result, err := Collections.Users.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return user, http.StatusConflict, "An account with this email was created at the same time, please try again"
+	}
+	if err != nil {
+		return user, http.StatusInternalServerError, "Failed to create user"
+	}
+	user.ID = result.InsertedID.(primitive.ObjectID)
+	return user, http.StatusOK, ""
+}
+
+// UnlinkIdentity removes a provider from the current user's account
+func UnlinkIdentity(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, err := currentUser(ctx, c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	name := c.Param("provider")
+	linked := false
+	for _, identity := range user.Identities {
+		if identity.Provider == name {
+			linked = true
+		}
+	}
+	if !linked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Provider is not linked to this account"})
+		return
+	}
+
+	// Don't lock the user out of their account
+	if user.Password == "" && len(user.Identities) == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Set a password through a password reset before unlinking your only way to log in"})
+		return
+	}
+
+	_, err = Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+		"$pull": bson.M{"identities": bson.M{"provider": name}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink provider"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Provider unlinked successfully"})
+}
@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"backend-dragonhak/auth"
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mockOIDC is a minimal OpenID Connect provider that approves every
+// authorization request for the configured account
+type mockOIDC struct {
+	server *httptest.Server
+	key    *auth.Key
+	signer *rsa.PrivateKey
+
+	mu            sync.Mutex
+	grants        map[string]url.Values
+	subject       string
+	email         string
+	emailVerified bool
+	nonceOverride string
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	signer, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := auth.NewKey(signer)
+	require.NoError(t, err)
+
+	m := &mockOIDC{key: key, signer: signer, grants: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(auth.JWKS{Keys: []auth.JWK{m.key.JWK()}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		code := fmt.Sprintf("code-%d", len(m.grants)+1)
+		m.grants[code] = r.URL.Query()
+		redirect := r.URL.Query().Get("redirect_uri") + "?code=" + code + "&state=" + url.QueryEscape(r.URL.Query().Get("state"))
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockOIDC) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r.ParseForm()
+	grant, ok := m.grants[r.PostForm.Get("code")]
+	delete(m.grants, r.PostForm.Get("code"))
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if !ok || r.PostForm.Get("client_secret") != "client-secret" ||
+		r.PostForm.Get("redirect_uri") != grant.Get("redirect_uri") ||
+		challenge != grant.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	nonce := grant.Get("nonce")
+	if m.nonceOverride != "" {
+		nonce = m.nonceOverride
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            m.server.URL,
+		"aud":            grant.Get("client_id"),
+		"sub":            m.subject,
+		"email":          m.email,
+		"email_verified": m.emailVerified,
+		"given_name":     "Jane",
+		"family_name":    "Roe",
+		"nonce":          nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = m.key.ID
+	signed, _ := idToken.SignedString(m.signer)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "provider-access-token",
+		"token_type":   "Bearer",
+		"id_token":     signed,
+	})
+}
+
+// login runs the browser side of the flow: our start endpoint, the
+// provider's authorize endpoint, then back to our callback
+func (m *mockOIDC) login(t *testing.T, router *gin.Engine) *httptest.ResponseRecorder {
+	w := performJSON(router, "GET", "/api/auth/oauth/mock/start", nil, "")
+	require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(w.Header().Get("Location"))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	return performJSON(router, "GET", callback.RequestURI(), nil, "")
+}
+
+func TestOAuthLogin(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	provider := newMockOIDC(t)
+	oidc, err := auth.NewOIDCProvider(context.Background(), "mock", provider.server.URL, "client-id", "client-secret", "http://localhost:8080/api/auth/oauth/mock/callback")
+	require.NoError(t, err)
+	OAuthProviders["mock"] = oidc
+	defer delete(OAuthProviders, "mock")
+
+	router, user := setupAuthRouter(t)
+	router.GET("/api/auth/oauth/:provider/start", StartOAuthLogin)
+	router.GET("/api/auth/oauth/:provider/callback", OAuthCallback)
+	router.DELETE("/api/users/me/identities/:provider", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), UnlinkIdentity)
+
+	find := func(email string) models.User {
+		var found models.User
+		require.NoError(t, Collections.Users.FindOne(context.Background(), bson.M{"email": email}).Decode(&found))
+		return found
+	}
+
+	t.Run("Start redirects with PKCE and a nonce", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/auth/oauth/mock/start", nil, "")
+		require.Equal(t, http.StatusFound, w.Code)
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+		assert.NotEmpty(t, location.Query().Get("code_challenge"))
+		assert.NotEmpty(t, location.Query().Get("nonce"))
+		assert.NotEmpty(t, location.Query().Get("state"))
+	})
+
+	t.Run("Unknown provider", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/auth/oauth/nope/start", nil, "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("New users are signed up", func(t *testing.T) {
+		provider.subject, provider.email, provider.emailVerified = "new-subject", "jane@example.com", true
+
+		w := provider.login(t, router)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "access_token")
+
+		created := find("jane@example.com")
+		assert.True(t, created.EmailVerified)
+		assert.Equal(t, "Jane", created.Name)
+		require.Len(t, created.Identities, 1)
+		assert.Equal(t, "new-subject", created.Identities[0].Subject)
+
+		// Logging in again finds the same account
+		w = provider.login(t, router)
+		require.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			User models.ProfileView `json:"user"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, created.ID, response.User.ID)
+		assert.Equal(t, []string{"mock"}, response.User.LinkedProviders)
+	})
+
+	t.Run("Only verified emails link to existing accounts", func(t *testing.T) {
+		provider.subject, provider.email, provider.emailVerified = "john-subject", user.Email, true
+
+		w := provider.login(t, router)
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		_, err := Collections.Users.UpdateOne(context.Background(), bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"email_verified": true}})
+		require.NoError(t, err)
+
+		provider.emailVerified = false
+		w = provider.login(t, router)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Empty(t, find(user.Email).Identities)
+
+		provider.emailVerified = true
+		w = provider.login(t, router)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		linked := find(user.Email)
+		require.Len(t, linked.Identities, 1)
+		assert.Equal(t, "john-subject", linked.Identities[0].Subject)
+	})
+
+	t.Run("The ID token must answer our nonce", func(t *testing.T) {
+		provider.nonceOverride = "replayed"
+		defer func() { provider.nonceOverride = "" }()
+
+		w := provider.login(t, router)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("State is single use", func(t *testing.T) {
+		w := performJSON(router, "GET", "/api/auth/oauth/mock/callback?code=abc&state=unknown", nil, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Unlinking keeps a way to log in", func(t *testing.T) {
+		provider.subject, provider.email = "new-subject", "jane@example.com"
+		w := provider.login(t, router)
+		require.Equal(t, http.StatusOK, w.Code)
+		var tokens map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+
+		// Jane signed up through the provider and has no password
+		w = performJSON(router, "DELETE", "/api/users/me/identities/mock", nil, tokens["access_token"].(string))
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		// John still has his password
+		johnTokens := login(t, router, user.Email)
+		w = performJSON(router, "DELETE", "/api/users/me/identities/mock", nil, johnTokens["access_token"].(string))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, find(user.Email).Identities)
+
+		w = performJSON(router, "DELETE", "/api/users/me/identities/mock", nil, johnTokens["access_token"].(string))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("The provider doesn't replace the second factor", func(t *testing.T) {
+		jane := find("jane@example.com")
+		_, err := Collections.Users.UpdateOne(context.Background(), bson.M{"_id": jane.ID}, bson.M{
+			"$set": bson.M{"mfa": models.MFASettings{Enabled: true, Secret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"}},
+		})
+		require.NoError(t, err)
+
+		provider.subject, provider.email = "new-subject", "jane@example.com"
+		w := provider.login(t, router)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, true, response["mfa_required"])
+		assert.NotEmpty(t, response["mfa_token"])
+		assert.Nil(t, response["access_token"])
+		assert.Nil(t, response["refresh_token"])
+	})
+}
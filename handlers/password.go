@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"backend-dragonhak/auth"
+	"backend-dragonhak/models"
+	"backend-dragonhak/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// respondPasswordError writes the response for an error from auth.HashPassword
+func respondPasswordError(c *gin.Context, err error) {
+	switch err {
+	case auth.ErrPasswordTooShort:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must be at least 8 characters long"})
+	case auth.ErrPasswordNoUpper:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must contain at least one uppercase letter"})
+	case auth.ErrPasswordNoLower:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must contain at least one lowercase letter"})
+	case auth.ErrPasswordNoNumber:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must contain at least one number"})
+	case auth.ErrPasswordNoSpecial:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must contain at least one special character"})
+	case auth.ErrPasswordCommon:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is too common or easily guessable"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+	}
+}
+
+// revokeUserTokens logs the user out everywhere, e.g. after a credential
+// change. Bumping the token version invalidates every token issued so far,
+// while tokens from later logins carry the new version and stay valid.
+func revokeUserTokens(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := Collections.Users.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$inc": bson.M{"token_version": 1}})
+	if err != nil {
+		return err
+	}
+
+	var user models.User
+	if err := Collections.Users.FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		return err
+	}
+
+	if err := Stores.Sessions.RevokeAll(ctx, userID.Hex()); err != nil {
+		return err
+	}
+	return Stores.Denylist.RevokeUser(ctx, userID.Hex(), user.TokenVersion)
+}
+
+// ForgotPassword emails a one-time password reset token to the user
+func ForgotPassword(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Respond the same way whether or not the email exists, so the endpoint
+	// can't be used to find registered accounts
+	response := gin.H{"message": "If the email is registered, a password reset link has been sent"}
+
+	var user models.User
+	err := Collections.Users.FindOne(ctx, bson.M{"email": req.Email}).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	token, err := Stores.Resets.GenerateToken(ctx, user.ID.Hex())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate reset token"})
+		return
+	}
+
+	// A delivery failure is logged but not reported, for the same reason
+	sendMail(ctx, func() (services.Message, error) {
+		return services.PasswordResetEmail(user.Email, user.Name, mailLink("/reset-password", token))
+	})
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword
+func ResetPassword(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Check the password policy before spending the token
+	hashedPassword, err := auth.HashPassword(req.Password)
+	if err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+
+	userID, err := Stores.Resets.ConsumeToken(ctx, req.Token)
+	if err != nil {
+		if err == auth.ErrTokenInvalid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify reset token"})
+		}
+		return
+	}
+
+	objID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"password":   hashedPassword,
+			"updated_at": time.Now(),
+		},
+	}
+
+	result, err := Collections.Users.UpdateOne(ctx, bson.M{"_id": objID}, update)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Whoever knew the old password must not stay logged in
+	if err := revokeUserTokens(ctx, objID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke existing sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
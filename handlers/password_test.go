@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordReset(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	router.POST("/api/auth/password/forgot", ForgotPassword)
+	router.POST("/api/auth/password/reset", ResetPassword)
+
+	tokens := login(t, router, user.Email)
+
+	token, err := Stores.Resets.GenerateToken(context.Background(), user.ID.Hex())
+	require.NoError(t, err)
+
+	// A weak password is rejected without spending the token
+	w := performJSON(router, "POST", "/api/auth/password/reset", gin.H{"token": token, "password": "weak"}, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "at least 8 characters")
+
+	const newPassword = "N3wStr0ng!Pass"
+	w = performJSON(router, "POST", "/api/auth/password/reset", gin.H{"token": token, "password": newPassword}, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Only the new password works from now on
+	w = performJSON(router, "POST", "/api/auth/login", gin.H{"email": user.Email, "password": testPassword}, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performJSON(router, "POST", "/api/auth/login", gin.H{"email": user.Email, "password": newPassword}, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Sessions from before the reset are revoked
+	w = performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": tokens["refresh_token"]}, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performJSON(router, "GET", "/api/protected", nil, tokens["access_token"].(string))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// The token is single use
+	w = performJSON(router, "POST", "/api/auth/password/reset", gin.H{"token": token, "password": "An0ther!Pass"}, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid or expired reset token")
+}
+
+func TestForgotPasswordDoesNotRevealAccounts(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	router.POST("/api/auth/password/forgot", ForgotPassword)
+
+	known := performJSON(router, "POST", "/api/auth/password/forgot", gin.H{"email": user.Email}, "")
+	unknown := performJSON(router, "POST", "/api/auth/password/forgot", gin.H{"email": "nobody@example.com"}, "")
+
+	assert.Equal(t, http.StatusOK, known.Code)
+	assert.Equal(t, http.StatusOK, unknown.Code)
+	assert.Equal(t, known.Body.String(), unknown.Body.String())
+
+	// Only the registered address is emailed, and the link carries a working token
+	messages := sentMail(t)
+	require.Len(t, messages, 1)
+	assert.Equal(t, user.Email, messages[0].Header.Get("To"))
+
+	match := tokenInLink.FindStringSubmatch(mailBody(t, messages[0]))
+	require.NotNil(t, match)
+	userID, err := Stores.Resets.ConsumeToken(context.Background(), match[1])
+	require.NoError(t, err)
+	assert.Equal(t, user.ID.Hex(), userID)
+}
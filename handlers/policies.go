@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	anyRole          = []models.UserRole{models.RoleAdmin, models.RoleCraftsman, models.RoleCustomer}
+	adminOnly        = []models.UserRole{models.RoleAdmin}
+	craftsmanOrAdmin = []models.UserRole{models.RoleAdmin, models.RoleCraftsman}
+)
+
+// RoutePolicies declares who may call each authenticated route, keyed by
+// method and full route path as registered in main.go. Mutating routes that
+// are missing from this table are refused by middleware.Policies.Enforce.
+var RoutePolicies = middleware.Policies{
+	// Users may only change their own account
+	"PUT /api/users/:id":                        {Roles: anyRole, Owner: userFromParam("id")},
+	"PATCH /api/users/:id":                      {Roles: anyRole, Owner: userFromParam("id")},
+	"DELETE /api/users/:id":                     {Roles: anyRole, Owner: userFromParam("id")},
+	"PUT /api/users/me":                         {Roles: anyRole},
+	"PATCH /api/users/me":                       {Roles: anyRole},
+	"DELETE /api/users/me":                      {Roles: anyRole},
+	"POST /api/users/verify/send":               {Roles: anyRole},
+	"POST /api/users/me/mfa/enroll":             {Roles: anyRole},
+	"POST /api/users/me/mfa/confirm":            {Roles: anyRole},
+	"DELETE /api/users/me/identities/:provider": {Roles: anyRole},
+	"DELETE /api/users/me/sessions/:id":         {Roles: anyRole},
+	"POST /api/users/me/export":                 {Roles: anyRole},
+	"POST /api/users/me/calendar":               {Roles: anyRole},
+	"DELETE /api/users/me/calendar":             {Roles: anyRole},
+
+	// Only the owning craftsman may edit a craftsman profile
+	"PUT /api/craftsmen/:id":          {Roles: craftsmanOrAdmin, Owner: craftsmanOwner},
+	"DELETE /api/craftsmen/:id":       {Roles: craftsmanOrAdmin, Owner: craftsmanOwner},
+	"POST /api/craftsmen/:id/restore": {Roles: craftsmanOrAdmin, Owner: craftsmanOwner},
+
+	// Customers book in their own name and list only their own bookings
+	"POST /api/customers/workshops/:id/book":       {Roles: []models.UserRole{models.RoleCustomer}},
+	"GET /api/customers/:id/bookings":              {Roles: anyRole, Owner: userFromParam("id")},
+	"POST /api/customers/bookings/:id/cancel":      {Roles: anyRole, Owner: bookingCustomer},
+	"POST /api/customers/bookings/:id/accept":      {Roles: anyRole, Owner: bookingCustomer},
+	"GET /api/customers/bookings/:id/calendar.ics": {Roles: anyRole, Owner: bookingCustomer},
+	"POST /api/customers/workshops/:id/waitlist":   {Roles: []models.UserRole{models.RoleCustomer}},
+	"DELETE /api/customers/workshops/:id/waitlist": {Roles: []models.UserRole{models.RoleCustomer}},
+
+	// Craftsmen create workshops for their own profile, and only the
+	// craftsman running a workshop may change it
+	"POST /api/workshops":                    {Roles: []models.UserRole{models.RoleCraftsman}},
+	"PUT /api/workshops/:id":                 {Roles: craftsmanOrAdmin, Owner: workshopOwner},
+	"POST /api/workshops/:id/publish":        {Roles: craftsmanOrAdmin, Owner: workshopOwner},
+	"POST /api/workshops/:id/cancel":         {Roles: craftsmanOrAdmin, Owner: workshopOwner},
+	"PATCH /api/workshops/:id/capacity":      {Roles: craftsmanOrAdmin, Owner: workshopOwner},
+	"POST /api/workshops/series":             {Roles: []models.UserRole{models.RoleCraftsman}},
+	"POST /api/workshops/series/:id/publish": {Roles: craftsmanOrAdmin, Owner: seriesOwner},
+
+	"POST /api/badges/":                       {Roles: adminOnly},
+	"POST /api/badges/:badgeId/award/:userId": {Roles: adminOnly},
+
+	// Images may be deleted by whoever uploaded them
+	"POST /api/images/upload":       {Roles: anyRole},
+	"DELETE /api/images/:public_id": {Roles: anyRole, Owner: imageOwner},
+
+	"POST /api/auctions/":         {Roles: craftsmanOrAdmin},
+	"POST /api/auctions/:id/bids": {Roles: []models.UserRole{models.RoleCustomer, models.RoleCraftsman}},
+
+	"POST /api/admin/users/:id/suspend":   {Roles: adminOnly},
+	"POST /api/admin/users/:id/unsuspend": {Roles: adminOnly},
+	"POST /api/admin/users/:id/unlock":    {Roles: adminOnly},
+	"POST /api/admin/users/:id/restore":   {Roles: adminOnly},
+	"GET /api/admin/erasures":             {Roles: adminOnly},
+	"PATCH /api/admin/craftsmen/:id":      {Roles: adminOnly},
+}
+
+// userFromParam treats the user ID in the named route parameter as the owner
+func userFromParam(name string) middleware.OwnerResolver {
+	return func(c *gin.Context) (primitive.ObjectID, error) {
+		objID, err := primitive.ObjectIDFromHex(c.Param(name))
+		if err != nil {
+			return primitive.NilObjectID, primitive.ErrInvalidHex
+		}
+		return objID, nil
+	}
+}
+
+// imageOwner resolves the user who uploaded the image in :public_id
+func imageOwner(c *gin.Context) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var image models.Image
+	if err := Collections.Images.FindOne(ctx, bson.M{"public_id": c.Param("public_id")}).Decode(&image); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return image.OwnerID, nil
+}
+
+// bookingCustomer resolves the customer who made the booking in :id
+func bookingCustomer(c *gin.Context) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return primitive.NilObjectID, primitive.ErrInvalidHex
+	}
+
+	var booking models.Booking
+	if err := Collections.Bookings.FindOne(ctx, bson.M{"_id": objID}).Decode(&booking); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return booking.CustomerID, nil
+}
+
+// workshopOwner resolves the user whose craftsman profile runs the workshop
+// in :id
+func workshopOwner(c *gin.Context) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return primitive.NilObjectID, primitive.ErrInvalidHex
+	}
+
+	var workshop models.Workshop
+	if err := Collections.Workshops.FindOne(ctx, bson.M{"_id": objID}).Decode(&workshop); err != nil {
+		return primitive.NilObjectID, err
+	}
+	var craftsman models.Craftsman
+	if err := Collections.Craftsmen.FindOne(ctx, bson.M{"_id": workshop.CraftsmanID}).Decode(&craftsman); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return craftsman.UserID, nil
+}
+
+// seriesOwner resolves the user whose craftsman profile runs the workshop
+// series in :id
+func seriesOwner(c *gin.Context) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return primitive.NilObjectID, primitive.ErrInvalidHex
+	}
+
+	var series models.WorkshopSeries
+	if err := Collections.WorkshopSeries.FindOne(ctx, bson.M{"_id": objID}).Decode(&series); err != nil {
+		return primitive.NilObjectID, err
+	}
+	var craftsman models.Craftsman
+	if err := Collections.Craftsmen.FindOne(ctx, bson.M{"_id": series.CraftsmanID}).Decode(&craftsman); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return craftsman.UserID, nil
+}
+
+// craftsmanOwner resolves the user owning the craftsman profile in :id
+func craftsmanOwner(c *gin.Context) (primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return primitive.NilObjectID, primitive.ErrInvalidHex
+	}
+
+	var craftsman models.Craftsman
+	if err := Collections.Craftsmen.FindOne(ctx, bson.M{"_id": objID}).Decode(&craftsman); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return craftsman.UserID, nil
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// policyRouter mounts every route in RoutePolicies behind Enforce, with a
+// stand-in for AuthMiddleware that takes the caller from request headers
+func policyRouter() *gin.Engine {
+	router := gin.New()
+	fakeAuth := func(c *gin.Context) {
+		c.Set("user_id", c.GetHeader("X-Test-User"))
+		c.Set("role", c.GetHeader("X-Test-Role"))
+	}
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+
+	for route := range RoutePolicies {
+		parts := strings.SplitN(route, " ", 2)
+		router.Handle(parts[0], parts[1], fakeAuth, RoutePolicies.Enforce(), ok)
+	}
+	router.POST("/api/unlisted", fakeAuth, RoutePolicies.Enforce(), ok)
+	router.GET("/api/unlisted", fakeAuth, RoutePolicies.Enforce(), ok)
+	return router
+}
+
+func TestRoutePolicies(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router := policyRouter()
+
+	owner := primitive.NewObjectID()
+	stranger := primitive.NewObjectID()
+
+	profile := models.Craftsman{UserID: owner, CreatedAt: time.Now()}
+	result, err := Collections.Craftsmen.InsertOne(context.Background(), profile)
+	require.NoError(t, err)
+	profileID := result.InsertedID.(primitive.ObjectID)
+	craftsmanID := profileID.Hex()
+
+	_, err = Collections.Images.InsertOne(context.Background(), models.Image{PublicID: "img1", OwnerID: owner})
+	require.NoError(t, err)
+
+	result, err = Collections.Bookings.InsertOne(context.Background(), models.Booking{CustomerID: owner})
+	require.NoError(t, err)
+	bookingID := result.InsertedID.(primitive.ObjectID).Hex()
+
+	result, err = Collections.Workshops.InsertOne(context.Background(), models.Workshop{CraftsmanID: profileID})
+	require.NoError(t, err)
+	workshopID := result.InsertedID.(primitive.ObjectID).Hex()
+
+	result, err = Collections.WorkshopSeries.InsertOne(context.Background(), models.WorkshopSeries{CraftsmanID: profileID})
+	require.NoError(t, err)
+	seriesID := result.InsertedID.(primitive.ObjectID).Hex()
+
+	const (
+		admin     = models.RoleAdmin
+		craftsman = models.RoleCraftsman
+		customer  = models.RoleCustomer
+	)
+
+	// Expected status per role; "owner" acts on its own resource, "other" on someone else's
+	type expectation struct {
+		role   models.UserRole
+		asUser primitive.ObjectID
+		want   int
+	}
+	allowAll := []expectation{
+		{admin, stranger, http.StatusOK},
+		{craftsman, stranger, http.StatusOK},
+		{customer, stranger, http.StatusOK},
+	}
+	adminOnlyMatrix := []expectation{
+		{admin, stranger, http.StatusOK},
+		{craftsman, owner, http.StatusForbidden},
+		{customer, owner, http.StatusForbidden},
+	}
+	selfOrAdmin := []expectation{
+		{admin, stranger, http.StatusOK},
+		{customer, owner, http.StatusOK},
+		{craftsman, owner, http.StatusOK},
+		{customer, stranger, http.StatusForbidden},
+		{craftsman, stranger, http.StatusForbidden},
+	}
+	customerOnly := []expectation{
+		{customer, stranger, http.StatusOK},
+		{craftsman, stranger, http.StatusForbidden},
+		{admin, stranger, http.StatusForbidden},
+	}
+	craftsmanOwnerMatrix := []expectation{
+		{admin, stranger, http.StatusOK},
+		{craftsman, owner, http.StatusOK},
+		{craftsman, stranger, http.StatusForbidden},
+		{customer, owner, http.StatusForbidden},
+	}
+
+	matrix := []struct {
+		method string
+		path   string
+		route  string
+		expect []expectation
+	}{
+		{"PUT", "/api/users/" + owner.Hex(), "/api/users/:id", selfOrAdmin},
+		{"PATCH", "/api/users/" + owner.Hex(), "/api/users/:id", selfOrAdmin},
+		{"DELETE", "/api/users/" + owner.Hex(), "/api/users/:id", selfOrAdmin},
+		{"POST", "/api/users/verify/send", "/api/users/verify/send", allowAll},
+		{"PUT", "/api/users/me", "/api/users/me", allowAll},
+		{"PATCH", "/api/users/me", "/api/users/me", allowAll},
+		{"DELETE", "/api/users/me", "/api/users/me", allowAll},
+		{"POST", "/api/users/me/mfa/enroll", "/api/users/me/mfa/enroll", allowAll},
+		{"POST", "/api/users/me/mfa/confirm", "/api/users/me/mfa/confirm", allowAll},
+		{"DELETE", "/api/users/me/identities/google", "/api/users/me/identities/:provider", allowAll},
+		{"DELETE", "/api/users/me/sessions/abc", "/api/users/me/sessions/:id", allowAll},
+		{"POST", "/api/users/me/export", "/api/users/me/export", allowAll},
+		{"POST", "/api/users/me/calendar", "/api/users/me/calendar", allowAll},
+		{"DELETE", "/api/users/me/calendar", "/api/users/me/calendar", allowAll},
+		{"PUT", "/api/craftsmen/" + craftsmanID, "/api/craftsmen/:id", craftsmanOwnerMatrix},
+		{"DELETE", "/api/craftsmen/" + craftsmanID, "/api/craftsmen/:id", craftsmanOwnerMatrix},
+		{"POST", "/api/craftsmen/" + craftsmanID + "/restore", "/api/craftsmen/:id/restore", craftsmanOwnerMatrix},
+		{"GET", "/api/customers/" + owner.Hex() + "/bookings", "/api/customers/:id/bookings", selfOrAdmin},
+		{"POST", "/api/customers/bookings/" + bookingID + "/cancel", "/api/customers/bookings/:id/cancel", selfOrAdmin},
+		{"POST", "/api/customers/bookings/" + bookingID + "/accept", "/api/customers/bookings/:id/accept", selfOrAdmin},
+		{"GET", "/api/customers/bookings/" + bookingID + "/calendar.ics", "/api/customers/bookings/:id/calendar.ics", selfOrAdmin},
+		{"POST", "/api/customers/workshops/w1/waitlist", "/api/customers/workshops/:id/waitlist", customerOnly},
+		{"DELETE", "/api/customers/workshops/w1/waitlist", "/api/customers/workshops/:id/waitlist", customerOnly},
+		{"POST", "/api/workshops", "/api/workshops", []expectation{
+			{craftsman, stranger, http.StatusOK},
+			{customer, stranger, http.StatusForbidden},
+			{admin, stranger, http.StatusForbidden},
+		}},
+		{"PUT", "/api/workshops/" + workshopID, "/api/workshops/:id", craftsmanOwnerMatrix},
+		{"POST", "/api/workshops/" + workshopID + "/publish", "/api/workshops/:id/publish", craftsmanOwnerMatrix},
+		{"POST", "/api/workshops/" + workshopID + "/cancel", "/api/workshops/:id/cancel", craftsmanOwnerMatrix},
+		{"PATCH", "/api/workshops/" + workshopID + "/capacity", "/api/workshops/:id/capacity", craftsmanOwnerMatrix},
+		{"POST", "/api/workshops/series", "/api/workshops/series", []expectation{
+			{craftsman, stranger, http.StatusOK},
+			{customer, stranger, http.StatusForbidden},
+			{admin, stranger, http.StatusForbidden},
+		}},
+		{"POST", "/api/workshops/series/" + seriesID + "/publish", "/api/workshops/series/:id/publish", craftsmanOwnerMatrix},
+		{"POST", "/api/customers/workshops/w1/book", "/api/customers/workshops/:id/book", customerOnly},
+		{"POST", "/api/badges/", "/api/badges/", adminOnlyMatrix},
+		{"POST", "/api/badges/b1/award/" + owner.Hex(), "/api/badges/:badgeId/award/:userId", adminOnlyMatrix},
+		{"POST", "/api/images/upload", "/api/images/upload", allowAll},
+		{"DELETE", "/api/images/img1", "/api/images/:public_id", selfOrAdmin},
+		{"POST", "/api/auctions/", "/api/auctions/", []expectation{
+			{admin, stranger, http.StatusOK},
+			{craftsman, stranger, http.StatusOK},
+			{customer, stranger, http.StatusForbidden},
+		}},
+		{"POST", "/api/auctions/a1/bids", "/api/auctions/:id/bids", []expectation{
+			{customer, stranger, http.StatusOK},
+			{craftsman, stranger, http.StatusOK},
+			{admin, stranger, http.StatusForbidden},
+		}},
+		{"POST", "/api/admin/users/" + owner.Hex() + "/suspend", "/api/admin/users/:id/suspend", adminOnlyMatrix},
+		{"POST", "/api/admin/users/" + owner.Hex() + "/unsuspend", "/api/admin/users/:id/unsuspend", adminOnlyMatrix},
+		{"POST", "/api/admin/users/" + owner.Hex() + "/unlock", "/api/admin/users/:id/unlock", adminOnlyMatrix},
+		{"POST", "/api/admin/users/" + owner.Hex() + "/restore", "/api/admin/users/:id/restore", adminOnlyMatrix},
+		{"GET", "/api/admin/erasures", "/api/admin/erasures", adminOnlyMatrix},
+		{"PATCH", "/api/admin/craftsmen/" + craftsmanID, "/api/admin/craftsmen/:id", adminOnlyMatrix},
+	}
+
+	covered := map[string]bool{}
+	for _, route := range matrix {
+		covered[route.method+" "+route.route] = true
+		for _, e := range route.expect {
+			name := route.method + " " + route.route + " as " + string(e.role)
+			if e.asUser == owner {
+				name += " (owner)"
+			}
+			t.Run(name, func(t *testing.T) {
+				req, _ := http.NewRequest(route.method, route.path, nil)
+				req.Header.Set("X-Test-User", e.asUser.Hex())
+				req.Header.Set("X-Test-Role", string(e.role))
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				assert.Equal(t, e.want, w.Code)
+			})
+		}
+	}
+
+	// Every declared policy must be covered by the matrix above
+	for route := range RoutePolicies {
+		assert.True(t, covered[route], "no allow/deny matrix for %s", route)
+	}
+}
+
+func TestRoutePoliciesFailClosed(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router := policyRouter()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{name: "Mutating route without a policy", method: "POST", path: "/api/unlisted", wantStatus: http.StatusForbidden},
+		{name: "Read-only route without a policy", method: "GET", path: "/api/unlisted", wantStatus: http.StatusOK},
+		{name: "Unknown craftsman profile", method: "PUT", path: "/api/craftsmen/" + primitive.NewObjectID().Hex(), wantStatus: http.StatusNotFound},
+		{name: "Malformed user ID", method: "PUT", path: "/api/users/not-an-id", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("X-Test-User", primitive.NewObjectID().Hex())
+			req.Header.Set("X-Test-Role", string(models.RoleCraftsman))
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
@@ -0,0 +1,457 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SeriesHorizon is how far ahead the occurrences of a workshop series are
+// created. The workshop scheduler extends it as time passes.
+var SeriesHorizon = 90 * 24 * time.Hour
+
+// Scopes for changing a workshop that belongs to a series
+const (
+	scopeOccurrence = "occurrence"
+	scopeFollowing  = "following"
+)
+
+var (
+	errSeatsTaken     = errors.New("capacity is below the seats taken")
+	errSeriesNotOwned = errors.New("series belongs to another craftsman")
+)
+
+// CreateWorkshopSeries creates a draft workshop series for the caller's
+// craftsman profile, along with its occurrences within SeriesHorizon
+func CreateWorkshopSeries(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var series models.WorkshopSeries
+	if err := c.ShouldBindJSON(&series); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid series data: " + err.Error()})
+		return
+	}
+
+	craftsman, err := callerCraftsman(ctx, c)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only craftsmen with a profile can create workshops"})
+		return
+	}
+
+	now := time.Now()
+	series.ID = primitive.NewObjectID()
+	series.CraftsmanID = craftsman.ID
+	series.Status = models.WorkshopStatusDraft
+	series.CreatedAt = now
+	series.UpdatedAt = now
+
+	// The series is validated as its first occurrence would be
+	first := series.Occurrence(series.Start)
+	if err := applyCraft(ctx, &first); err != nil {
+		respondWorkshopError(c, err)
+		return
+	}
+	series.Category, series.Difficulty = first.Category, first.Difficulty
+	if problem := validateWorkshop(first, now); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+	if problem := validateRecurrence(series); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	if _, err := Collections.WorkshopSeries.InsertOne(ctx, series); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create series"})
+		return
+	}
+	if _, err := materializeSeries(ctx, series, now); err != nil {
+		log.Printf("Series: failed to create occurrences of series %s: %v", series.ID.Hex(), err)
+	}
+
+	respondSeries(ctx, c, http.StatusCreated, series)
+}
+
+// GetWorkshopSeries returns a workshop series and its occurrences
+func GetWorkshopSeries(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	series, ok := loadSeries(ctx, c)
+	if !ok {
+		return
+	}
+	respondSeries(ctx, c, http.StatusOK, series)
+}
+
+// PublishWorkshopSeries opens a draft series for booking: its future draft
+// occurrences are published, and later ones are created published
+func PublishWorkshopSeries(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	series, ok := loadSeries(ctx, c)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	result, err := Collections.WorkshopSeries.UpdateOne(ctx,
+		bson.M{"_id": series.ID, "status": models.WorkshopStatusDraft},
+		bson.M{"$set": bson.M{"status": models.WorkshopStatusUpcoming, "updated_at": now}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish series"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "The series is already published"})
+		return
+	}
+	series.Status = models.WorkshopStatusUpcoming
+
+	var drafts []models.Workshop
+	err = findAll(ctx, Collections.Workshops, bson.M{
+		"series_id": series.ID,
+		"status":    models.WorkshopStatusDraft,
+		"date":      bson.M{"$gt": now},
+	}, &drafts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load occurrences"})
+		return
+	}
+	for _, workshop := range drafts {
+		err := transitionWorkshop(ctx, workshop, models.WorkshopStatusUpcoming, nil)
+		if err != nil && err != errWorkshopChanged {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish occurrences"})
+			return
+		}
+	}
+
+	respondSeries(ctx, c, http.StatusOK, series)
+}
+
+// updateFollowing applies changes made to an occurrence to it and every
+// later occurrence of its series. The series is split there: the old one
+// ends before the occurrence and a new one with the changed details takes
+// over, moved by as much as the occurrence's date was. Occurrences that
+// can no longer be edited only move to the new series.
+func updateFollowing(ctx context.Context, occurrence, changes models.Workshop, now time.Time) (models.WorkshopSeries, error) {
+	series, err := occurrenceSeries(ctx, occurrence)
+	if err != nil {
+		return series, err
+	}
+	loc, err := series.Zone()
+	if err != nil {
+		loc = time.UTC
+	}
+
+	at := occurrence.OccurrenceDate.In(loc)
+	offset := changes.Date.Sub(occurrence.Date)
+	before, after := series.Recurrence.Split(series.Start.In(loc), at)
+	shifted := make([]time.Time, len(after.Exceptions))
+	for i, exception := range after.Exceptions {
+		shifted[i] = exception.Add(offset)
+	}
+	after.Exceptions = shifted
+
+	next := series
+	next.ID = primitive.NewObjectID()
+	next.Title = changes.Title
+	next.Description = changes.Description
+	next.Category = changes.Category
+	next.Difficulty = changes.Difficulty
+	next.CraftID = changes.CraftID
+	next.Duration = changes.Duration
+	next.MaxParticipants = changes.MaxParticipants
+	next.Price = changes.Price
+	next.Location = changes.Location
+	next.CancellationPolicy = changes.CancellationPolicy
+	next.Start = at.Add(offset)
+	next.Recurrence = after
+	next.EndedAt = nil
+	next.CreatedAt = now
+	next.UpdatedAt = now
+
+	var following []models.Workshop
+	err = findAll(ctx, Collections.Workshops, bson.M{
+		"series_id":       series.ID,
+		"occurrence_date": bson.M{"$gte": at},
+	}, &following)
+	if err != nil {
+		return series, err
+	}
+	for _, workshop := range following {
+		if workshop.Status.Editable() && workshop.CurrentStudents > changes.MaxParticipants {
+			return series, errSeatsTaken
+		}
+	}
+
+	err = Transactions.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		if at.After(series.Start) {
+			_, err = Collections.WorkshopSeries.UpdateOne(ctx,
+				bson.M{"_id": series.ID},
+				bson.M{"$set": bson.M{"recurrence": before, "updated_at": now}},
+			)
+		} else {
+			// Nothing is left before the split
+			_, err = Collections.WorkshopSeries.DeleteOne(ctx, bson.M{"_id": series.ID})
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := Collections.WorkshopSeries.InsertOne(ctx, next); err != nil {
+			return err
+		}
+
+		for _, workshop := range following {
+			set := bson.M{
+				"series_id":       next.ID,
+				"occurrence_date": workshop.OccurrenceDate.Add(offset),
+				"updated_at":      now,
+			}
+			filter := bson.M{"_id": workshop.ID, "status": workshop.Status}
+			update := bson.M{"$set": set}
+			if workshop.Status.Editable() {
+				update = workshopUpdate(changes, set)
+				update["$set"].(bson.M)["date"] = workshop.Date.Add(offset)
+				filter["current_students"] = bson.M{"$lte": changes.MaxParticipants}
+			}
+
+			result, err := Collections.Workshops.UpdateOne(ctx, filter, update)
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errWorkshopChanged
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return series, err
+	}
+
+	if _, err := materializeSeries(ctx, next, now); err != nil {
+		log.Printf("Series: failed to create occurrences of series %s: %v", next.ID.Hex(), err)
+	}
+	for _, workshop := range following {
+		if workshop.Status == models.WorkshopStatusUpcoming && changes.MaxParticipants > workshop.MaxParticipants {
+			if err := promoteFromWaitlist(ctx, workshop.ID); err != nil {
+				log.Printf("Waitlist: failed to promote for workshop %s: %v", workshop.ID.Hex(), err)
+			}
+		}
+	}
+	return next, nil
+}
+
+// cancelFollowing ends a series before occurrence and cancels it and the
+// later occurrences, returning how many workshops and bookings it cancelled
+func cancelFollowing(ctx context.Context, occurrence models.Workshop, now time.Time) (workshops, bookings int, err error) {
+	series, err := occurrenceSeries(ctx, occurrence)
+	if err != nil {
+		return 0, 0, err
+	}
+	loc, err := series.Zone()
+	if err != nil {
+		loc = time.UTC
+	}
+
+	before, _ := series.Recurrence.Split(series.Start.In(loc), occurrence.OccurrenceDate.In(loc))
+	_, err = Collections.WorkshopSeries.UpdateOne(ctx,
+		bson.M{"_id": series.ID},
+		bson.M{"$set": bson.M{"recurrence": before, "updated_at": now}},
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var following []models.Workshop
+	err = findAll(ctx, Collections.Workshops, bson.M{
+		"series_id":       series.ID,
+		"occurrence_date": bson.M{"$gte": *occurrence.OccurrenceDate},
+		"status":          bson.M{"$in": bson.A{models.WorkshopStatusDraft, models.WorkshopStatusUpcoming}},
+	}, &following)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, workshop := range following {
+		err := transitionWorkshop(ctx, workshop, models.WorkshopStatusCancelled, bson.M{"cancelled_at": now})
+		if err == errWorkshopChanged {
+			continue
+		}
+		if err != nil {
+			return workshops, bookings, err
+		}
+		workshops++
+
+		workshop.Status = models.WorkshopStatusCancelled
+		cancelled, err := cancelWorkshopBookings(ctx, workshop, now)
+		bookings += cancelled
+		if err != nil {
+			return workshops, bookings, err
+		}
+	}
+	return workshops, bookings, nil
+}
+
+// occurrenceSeries loads the series an occurrence belongs to. Route policies
+// only check who owns the occurrence, so the series must be theirs too.
+func occurrenceSeries(ctx context.Context, occurrence models.Workshop) (models.WorkshopSeries, error) {
+	var series models.WorkshopSeries
+	if err := Collections.WorkshopSeries.FindOne(ctx, bson.M{"_id": occurrence.SeriesID}).Decode(&series); err != nil {
+		return series, err
+	}
+	if series.CraftsmanID != occurrence.CraftsmanID {
+		return series, errSeriesNotOwned
+	}
+	return series, nil
+}
+
+// MaterializeSeries creates the occurrences of every series that fall
+// within SeriesHorizon of now, returning how many it created
+func MaterializeSeries(ctx context.Context, now time.Time) (int, error) {
+	var series []models.WorkshopSeries
+	err := findAll(ctx, Collections.WorkshopSeries, bson.M{
+		"ended_at": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"recurrence.until": bson.M{"$exists": false}},
+			bson.M{"recurrence.until": bson.M{"$gte": now}},
+		},
+	}, &series)
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, s := range series {
+		workshops, err := materializeSeries(ctx, s, now)
+		created += len(workshops)
+		if err != nil {
+			return created, err
+		}
+
+		// Once its last occurrence exists the series is done. A series split
+		// in the meantime has a new rule, so it is left for the next run.
+		if s.EndsBy(now.Add(SeriesHorizon)) {
+			_, err := Collections.WorkshopSeries.UpdateOne(ctx,
+				bson.M{"_id": s.ID, "updated_at": s.UpdatedAt},
+				bson.M{"$set": bson.M{"ended_at": now}},
+			)
+			if err != nil {
+				return created, err
+			}
+		}
+	}
+	return created, nil
+}
+
+// materializeSeries creates the future occurrences of a series within
+// SeriesHorizon that don't exist yet. Occurrences that were cancelled or
+// moved still exist, so they aren't created again.
+func materializeSeries(ctx context.Context, series models.WorkshopSeries, now time.Time) ([]models.Workshop, error) {
+	var existing []models.Workshop
+	if err := findAll(ctx, Collections.Workshops, bson.M{"series_id": series.ID}, &existing); err != nil {
+		return nil, err
+	}
+	scheduled := map[int64]bool{}
+	for _, workshop := range existing {
+		if workshop.OccurrenceDate != nil {
+			scheduled[workshop.OccurrenceDate.UnixMilli()] = true
+		}
+	}
+
+	created := []models.Workshop{}
+	for _, start := range series.Occurrences(now.Add(SeriesHorizon)) {
+		if !start.After(now) || scheduled[start.UnixMilli()] {
+			continue
+		}
+
+		workshop := series.Occurrence(start)
+		workshop.ID = primitive.NewObjectID()
+		workshop.CreatedAt = now
+		workshop.UpdatedAt = now
+		_, err := Collections.Workshops.InsertOne(ctx, workshop)
+		if mongo.IsDuplicateKeyError(err) {
+			// Created concurrently by another run
+			continue
+		}
+		if err != nil {
+			return created, err
+		}
+		created = append(created, workshop)
+	}
+	return created, nil
+}
+
+// validateRecurrence checks a series' time zone and recurrence rule,
+// returning what is wrong with them or "" if nothing is
+func validateRecurrence(series models.WorkshopSeries) string {
+	rule := series.Recurrence
+	if _, err := series.Zone(); err != nil {
+		return "Unknown time zone " + series.Timezone
+	}
+	if rule.Count > 0 && rule.Until != nil {
+		return "A recurrence can end after a count or on a date, not both"
+	}
+	if rule.Until != nil && rule.Until.Before(series.Start) {
+		return "A recurrence can't end before it starts"
+	}
+	// A year per counted interval is more than enough to find an
+	// occurrence, and the walk stops at the first one
+	loc, _ := series.Zone()
+	through := series.Start.AddDate(max(rule.Count, 1)*max(rule.Interval, 1), 0, 0)
+	if _, ok := rule.First(series.Start.In(loc), through); !ok {
+		return "The recurrence has no occurrences"
+	}
+	return ""
+}
+
+// loadSeries loads the workshop series in :id, responding with an error if
+// it can't
+func loadSeries(ctx context.Context, c *gin.Context) (models.WorkshopSeries, bool) {
+	var series models.WorkshopSeries
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid series ID format"})
+		return series, false
+	}
+
+	err = Collections.WorkshopSeries.FindOne(ctx, bson.M{"_id": objID}).Decode(&series)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Series not found"})
+		return series, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load series"})
+		return series, false
+	}
+	return series, true
+}
+
+// respondSeries responds with a series and its occurrences in date order
+func respondSeries(ctx context.Context, c *gin.Context, status int, series models.WorkshopSeries) {
+	occurrences := []models.Workshop{}
+	if err := findAll(ctx, Collections.Workshops, bson.M{"series_id": series.ID}, &occurrences); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load occurrences"})
+		return
+	}
+	sort.Slice(occurrences, func(i, j int) bool { return occurrences[i].Date.Before(occurrences[j].Date) })
+
+	c.JSON(status, gin.H{
+		"series":      series,
+		"occurrences": occurrences,
+	})
+}
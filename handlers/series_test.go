@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRecurrenceOccurrences(t *testing.T) {
+	ljubljana, err := time.LoadLocation("Europe/Ljubljana")
+	require.NoError(t, err)
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 18, 0, 0, 0, ljubljana)
+	}
+	until := date(2025, time.April, 1)
+
+	tests := []struct {
+		name  string
+		rule  models.Recurrence
+		start time.Time
+		want  []time.Time
+	}{
+		{
+			name:  "Weekly count includes exceptions",
+			rule:  models.Recurrence{Frequency: models.FrequencyWeekly, Count: 4, Exceptions: []time.Time{date(2025, time.March, 11).UTC()}},
+			start: date(2025, time.March, 4),
+			want:  []time.Time{date(2025, time.March, 4), date(2025, time.March, 18), date(2025, time.March, 25)},
+		},
+		{
+			name:  "Every other week until a date, across a clock change",
+			rule:  models.Recurrence{Frequency: models.FrequencyWeekly, Interval: 2, Until: &until},
+			start: date(2025, time.March, 4),
+			want:  []time.Time{date(2025, time.March, 4), date(2025, time.March, 18), date(2025, time.April, 1)},
+		},
+		{
+			name:  "Monthly skips months without the day",
+			rule:  models.Recurrence{Frequency: models.FrequencyMonthly, Count: 3},
+			start: date(2025, time.January, 31),
+			want:  []time.Time{date(2025, time.January, 31), date(2025, time.March, 31), date(2025, time.May, 31)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rule.Occurrences(tt.start, tt.start.AddDate(1, 0, 0))
+			require.Len(t, got, len(tt.want))
+			for i := range got {
+				assert.True(t, tt.want[i].Equal(got[i]), "occurrence %d: want %s, got %s", i, tt.want[i], got[i])
+				assert.Equal(t, 18, got[i].Hour(), "keeps the wall clock time")
+			}
+		})
+	}
+
+	t.Run("First skips exceptions", func(t *testing.T) {
+		start := date(2025, time.March, 4)
+		rule := models.Recurrence{Frequency: models.FrequencyWeekly, Count: 520, Exceptions: []time.Time{start, date(2025, time.March, 11)}}
+		first, ok := rule.First(start, start.AddDate(520, 0, 0))
+		require.True(t, ok)
+		assert.True(t, date(2025, time.March, 18).Equal(first), "first is %s", first)
+
+		rule.Count = 2
+		_, ok = rule.First(start, start.AddDate(2, 0, 0))
+		assert.False(t, ok)
+	})
+
+	t.Run("Split", func(t *testing.T) {
+		rule := models.Recurrence{Frequency: models.FrequencyWeekly, Count: 5}
+		start := date(2025, time.March, 4)
+		before, after := rule.Split(start, date(2025, time.March, 18))
+
+		assert.Len(t, before.Occurrences(start, start.AddDate(1, 0, 0)), 2)
+		assert.Zero(t, before.Count)
+		assert.Equal(t, 3, after.Count)
+		assert.Len(t, after.Occurrences(date(2025, time.March, 18), start.AddDate(1, 0, 0)), 3)
+	})
+}
+
+func TestWorkshopSeries(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, john := setupAuthRouter(t)
+	authorized := router.Group("/api", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), RoutePolicies.Enforce())
+	authorized.POST("/customers/workshops/:id/book", BookWorkshop)
+	authorized.POST("/workshops", CreateWorkshop)
+	authorized.PUT("/workshops/:id", UpdateWorkshop)
+	authorized.POST("/workshops/:id/cancel", CancelWorkshop)
+	authorized.POST("/workshops/series", CreateWorkshopSeries)
+	authorized.GET("/workshops/series/:id", GetWorkshopSeries)
+	authorized.POST("/workshops/series/:id/publish", PublishWorkshopSeries)
+
+	ctx := context.Background()
+	johnToken := tokenFor(t, john)
+	potter, _ := newCraftsman(t, "potter")
+	potterToken := tokenFor(t, potter)
+
+	// Tuesdays at 18:00, starting at least a week from now
+	ljubljana, err := time.LoadLocation("Europe/Ljubljana")
+	require.NoError(t, err)
+	start := time.Now().In(ljubljana).AddDate(0, 0, 7)
+	start = time.Date(start.Year(), start.Month(), start.Day(), 18, 0, 0, 0, ljubljana)
+	for start.Weekday() != time.Tuesday {
+		start = start.AddDate(0, 0, 1)
+	}
+	week := func(n int) time.Time { return start.AddDate(0, 0, 7*n) }
+
+	details := func(changes gin.H) gin.H {
+		body := gin.H{
+			"title":            "Pottery night",
+			"description":      "Weekly wheel throwing",
+			"category":         "ceramics",
+			"difficulty":       models.DifficultyBeginner,
+			"duration":         2,
+			"max_participants": 2,
+			"price":            30,
+			"location":         "Ljubljana",
+			"start":            start,
+			"timezone":         "Europe/Ljubljana",
+			"recurrence": gin.H{
+				"frequency":  models.FrequencyWeekly,
+				"count":      6,
+				"exceptions": []time.Time{week(1)},
+			},
+		}
+		for key, value := range changes {
+			body[key] = value
+		}
+		return body
+	}
+
+	type seriesResponse struct {
+		Series      models.WorkshopSeries `json:"series"`
+		Occurrences []models.Workshop     `json:"occurrences"`
+	}
+	decode := func(body []byte) seriesResponse {
+		var response seriesResponse
+		require.NoError(t, json.Unmarshal(body, &response))
+		return response
+	}
+	getSeries := func(id primitive.ObjectID) seriesResponse {
+		w := performJSON(router, "GET", "/api/workshops/series/"+id.Hex(), nil, potterToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return decode(w.Body.Bytes())
+	}
+	occurrencePath := func(w models.Workshop) string { return "/api/workshops/" + w.ID.Hex() }
+
+	t.Run("Invalid series are rejected", func(t *testing.T) {
+		tests := []struct {
+			name string
+			body gin.H
+		}{
+			{"Unknown time zone", details(gin.H{"timezone": "Europe/Atlantis"})},
+			{"Count and until", details(gin.H{"recurrence": gin.H{"frequency": "weekly", "count": 2, "until": week(3)}})},
+			{"Unknown frequency", details(gin.H{"recurrence": gin.H{"frequency": "daily"}})},
+			{"Every occurrence excepted", details(gin.H{"recurrence": gin.H{"frequency": "weekly", "count": 1, "exceptions": []time.Time{start}}})},
+			{"Count too high", details(gin.H{"recurrence": gin.H{"frequency": "weekly", "count": 20000000}})},
+			{"Interval too long", details(gin.H{"recurrence": gin.H{"frequency": "monthly", "interval": 13}})},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				w := performJSON(router, "POST", "/api/workshops/series", tt.body, potterToken)
+				assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+			})
+		}
+	})
+
+	w := performJSON(router, "POST", "/api/workshops/series", details(nil), potterToken)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	created := decode(w.Body.Bytes())
+	series, occurrences := created.Series, created.Occurrences
+	assert.Equal(t, models.WorkshopStatusDraft, series.Status)
+
+	// Six weeks less the excepted second one
+	require.Len(t, occurrences, 5)
+	for i, n := range []int{0, 2, 3, 4, 5} {
+		assert.True(t, week(n).Equal(occurrences[i].Date), "occurrence %d is on %s, not %s", i, occurrences[i].Date, week(n))
+		assert.Equal(t, series.ID, occurrences[i].SeriesID)
+		assert.Equal(t, models.WorkshopStatusDraft, occurrences[i].Status)
+	}
+
+	t.Run("Publishing opens every occurrence", func(t *testing.T) {
+		w := performJSON(router, "POST", "/api/customers/workshops/"+occurrences[0].ID.Hex()+"/book", nil, johnToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = performJSON(router, "POST", "/api/workshops/series/"+series.ID.Hex()+"/publish", nil, potterToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		for _, occurrence := range decode(w.Body.Bytes()).Occurrences {
+			assert.Equal(t, models.WorkshopStatusUpcoming, occurrence.Status)
+		}
+		w = performJSON(router, "POST", "/api/workshops/series/"+series.ID.Hex()+"/publish", nil, potterToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Each occurrence has its own seats", func(t *testing.T) {
+		w := performJSON(router, "POST", "/api/customers/workshops/"+occurrences[2].ID.Hex()+"/book", nil, johnToken)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		after := getSeries(series.ID).Occurrences
+		assert.Equal(t, 0, after[1].CurrentStudents)
+		assert.Equal(t, 1, after[2].CurrentStudents)
+	})
+
+	t.Run("Scope is checked", func(t *testing.T) {
+		w := performJSON(router, "PUT", occurrencePath(occurrences[1])+"?scope=all", details(gin.H{"date": week(2)}), potterToken)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		result, err := Collections.Workshops.InsertOne(ctx, models.Workshop{Status: models.WorkshopStatusUpcoming, CraftsmanID: occurrences[0].CraftsmanID})
+		require.NoError(t, err)
+		w = performJSON(router, "PUT", "/api/workshops/"+result.InsertedID.(primitive.ObjectID).Hex()+"?scope=following", details(gin.H{"date": week(2)}), potterToken)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Another craftsman can't reach the series", func(t *testing.T) {
+		weaver, weaverID := newCraftsman(t, "weaver")
+		weaverToken := tokenFor(t, weaver)
+
+		// The series fields are ignored on creation
+		body := details(gin.H{"date": week(3), "series_id": series.ID, "occurrence_date": occurrences[2].OccurrenceDate})
+		w := performJSON(router, "POST", "/api/workshops", body, weaverToken)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var forged models.Workshop
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &forged))
+		require.NoError(t, Collections.Workshops.FindOne(ctx, bson.M{"_id": forged.ID}).Decode(&forged))
+		assert.True(t, forged.SeriesID.IsZero())
+		assert.Nil(t, forged.OccurrenceDate)
+
+		// An occurrence pointing at someone else's series is refused
+		result, err := Collections.Workshops.InsertOne(ctx, models.Workshop{
+			Status:         models.WorkshopStatusUpcoming,
+			CraftsmanID:    weaverID,
+			SeriesID:       series.ID,
+			OccurrenceDate: occurrences[2].OccurrenceDate,
+			Date:           week(3),
+		})
+		require.NoError(t, err)
+		path := "/api/workshops/" + result.InsertedID.(primitive.ObjectID).Hex()
+
+		w = performJSON(router, "PUT", path+"?scope=following", details(gin.H{"title": "Hijacked", "date": week(3)}), weaverToken)
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+		w = performJSON(router, "POST", path+"/cancel?scope=following", nil, weaverToken)
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+		_, err = Collections.Workshops.DeleteOne(ctx, bson.M{"_id": result.InsertedID})
+		require.NoError(t, err)
+
+		after := getSeries(series.ID)
+		assert.Equal(t, series.Recurrence.Count, after.Series.Recurrence.Count)
+		for _, occurrence := range after.Occurrences {
+			assert.Equal(t, "Pottery night", occurrence.Title)
+			assert.Equal(t, models.WorkshopStatusUpcoming, occurrence.Status)
+		}
+	})
+
+	t.Run("Editing one occurrence leaves the rest", func(t *testing.T) {
+		w := performJSON(router, "PUT", occurrencePath(occurrences[1]), details(gin.H{"title": "Glazing night", "date": week(2)}), potterToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		after := getSeries(series.ID).Occurrences
+		assert.Equal(t, "Glazing night", after[1].Title)
+		for _, i := range []int{0, 2, 3, 4} {
+			assert.Equal(t, "Pottery night", after[i].Title)
+		}
+	})
+
+	var following models.WorkshopSeries
+	t.Run("Editing all following occurrences splits the series", func(t *testing.T) {
+		// An hour later and with more seats from the third occurrence on
+		w := performJSON(router, "PUT", occurrencePath(occurrences[2])+"?scope=following", details(gin.H{
+			"title":            "Evening throwing",
+			"max_participants": 4,
+			"date":             week(3).Add(time.Hour),
+		}), potterToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		response := decode(w.Body.Bytes())
+		following = response.Series
+		assert.NotEqual(t, series.ID, following.ID)
+		assert.Equal(t, models.WorkshopStatusUpcoming, following.Status)
+
+		require.Len(t, response.Occurrences, 3)
+		for i, occurrence := range response.Occurrences {
+			assert.Equal(t, occurrences[i+2].ID, occurrence.ID)
+			assert.Equal(t, "Evening throwing", occurrence.Title)
+			assert.Equal(t, 4, occurrence.MaxParticipants)
+			assert.True(t, week(i+3).Add(time.Hour).Equal(occurrence.Date), "occurrence moved to %s", occurrence.Date)
+		}
+		assert.Equal(t, 1, response.Occurrences[0].CurrentStudents, "John keeps his seat")
+
+		earlier := getSeries(series.ID)
+		require.Len(t, earlier.Occurrences, 2)
+		assert.Equal(t, "Pottery night", earlier.Occurrences[0].Title)
+		assert.Equal(t, "Glazing night", earlier.Occurrences[1].Title)
+
+		// Nothing is recreated in the gaps the split left
+		created, err := MaterializeSeries(ctx, time.Now())
+		require.NoError(t, err)
+		assert.Zero(t, created)
+	})
+
+	t.Run("Cancelling all following occurrences ends the series", func(t *testing.T) {
+		later := getSeries(following.ID).Occurrences
+		w := performJSON(router, "POST", occurrencePath(later[1])+"/cancel?scope=following", nil, potterToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response map[string]int
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, 2, response["cancelled_workshops"])
+
+		after := getSeries(following.ID).Occurrences
+		assert.Equal(t, models.WorkshopStatusUpcoming, after[0].Status)
+		assert.Equal(t, models.WorkshopStatusCancelled, after[1].Status)
+		assert.Equal(t, models.WorkshopStatusCancelled, after[2].Status)
+
+		created, err := MaterializeSeries(ctx, time.Now())
+		require.NoError(t, err)
+		assert.Zero(t, created)
+	})
+}
+
+func TestMaterializeSeries(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	horizon := SeriesHorizon
+	SeriesHorizon = 30 * 24 * time.Hour
+	defer func() { SeriesHorizon = horizon }()
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	series := models.WorkshopSeries{
+		ID:              primitive.NewObjectID(),
+		Title:           "Open studio",
+		MaxParticipants: 8,
+		Start:           now.Add(time.Hour),
+		Recurrence:      models.Recurrence{Frequency: models.FrequencyWeekly},
+		Status:          models.WorkshopStatusUpcoming,
+	}
+	_, err := Collections.WorkshopSeries.InsertOne(ctx, series)
+	require.NoError(t, err)
+
+	// Weeks 0 to 4 fall within the 30 day horizon
+	created, err := MaterializeSeries(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 5, created)
+
+	created, err = MaterializeSeries(ctx, now)
+	require.NoError(t, err)
+	assert.Zero(t, created)
+
+	// Two weeks on, two more weeks come within reach
+	created, err = MaterializeSeries(ctx, now.AddDate(0, 0, 14))
+	require.NoError(t, err)
+	assert.Equal(t, 2, created)
+
+	count, err := Collections.Workshops.CountDocuments(ctx, bson.M{"series_id": series.ID, "status": models.WorkshopStatusUpcoming})
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), count)
+}
+
+func TestMaterializeSeriesSkipsEndedSeries(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	horizon := SeriesHorizon
+	SeriesHorizon = 30 * 24 * time.Hour
+	defer func() { SeriesHorizon = horizon }()
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	insert := func(count int) primitive.ObjectID {
+		series := models.WorkshopSeries{
+			ID:         primitive.NewObjectID(),
+			Title:      "Open studio",
+			Start:      now.Add(time.Hour),
+			Recurrence: models.Recurrence{Frequency: models.FrequencyWeekly, Count: count},
+			Status:     models.WorkshopStatusUpcoming,
+			UpdatedAt:  now,
+		}
+		_, err := Collections.WorkshopSeries.InsertOne(ctx, series)
+		require.NoError(t, err)
+		return series.ID
+	}
+	endedAt := func(id primitive.ObjectID) *time.Time {
+		var series models.WorkshopSeries
+		require.NoError(t, Collections.WorkshopSeries.FindOne(ctx, bson.M{"_id": id}).Decode(&series))
+		return series.EndedAt
+	}
+
+	// Three weeks fit in the horizon, ten don't
+	short := insert(3)
+	long := insert(10)
+
+	created, err := MaterializeSeries(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 3+5, created)
+	assert.NotNil(t, endedAt(short))
+	assert.Nil(t, endedAt(long))
+
+	// The ended series isn't looked at again, even if an occurrence went
+	// missing
+	_, err = Collections.Workshops.DeleteOne(ctx, bson.M{"series_id": short})
+	require.NoError(t, err)
+	created, err = MaterializeSeries(ctx, now)
+	require.NoError(t, err)
+	assert.Zero(t, created)
+
+	created, err = MaterializeSeries(ctx, now.AddDate(0, 0, 35))
+	require.NoError(t, err)
+	assert.Equal(t, 5, created)
+	assert.NotNil(t, endedAt(long))
+}
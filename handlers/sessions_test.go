@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"backend-dragonhak/auth"
+	"backend-dragonhak/middleware"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionManagement(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	authRequired := middleware.AuthMiddleware(Stores.Keys, Stores.Denylist)
+	router.GET("/api/users/me/sessions", authRequired, GetSessions)
+	router.DELETE("/api/users/me/sessions/:id", authRequired, DeleteSession)
+
+	loginFrom := func(userAgent string) map[string]interface{} {
+		req, _ := http.NewRequest("POST", "/api/auth/login", strings.NewReader(`{"email":"`+user.Email+`","password":"`+testPassword+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = "203.0.113.7:41000"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var tokens map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+		return tokens
+	}
+	list := func(accessToken string) []auth.SessionInfo {
+		w := performJSON(router, "GET", "/api/users/me/sessions", nil, accessToken)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var sessions []auth.SessionInfo
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+		return sessions
+	}
+
+	laptop := loginFrom("Firefox on Linux")
+	phone := loginFrom("Safari on iPhone")
+	laptopToken := laptop["access_token"].(string)
+
+	t.Run("Sessions list their device", func(t *testing.T) {
+		sessions := list(laptopToken)
+		require.Len(t, sessions, 2)
+
+		byAgent := map[string]auth.SessionInfo{}
+		for _, session := range sessions {
+			byAgent[session.UserAgent] = session
+		}
+		assert.True(t, byAgent["Firefox on Linux"].Current)
+		assert.False(t, byAgent["Safari on iPhone"].Current)
+		assert.Equal(t, "203.0.113.7", byAgent["Safari on iPhone"].IP)
+		assert.WithinDuration(t, time.Now(), byAgent["Safari on iPhone"].CreatedAt, time.Minute)
+	})
+
+	t.Run("Refreshing marks the session as used", func(t *testing.T) {
+		before := list(laptopToken)[0]
+
+		w := performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": phone["refresh_token"]}, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		json.Unmarshal(w.Body.Bytes(), &phone)
+
+		after := list(laptopToken)
+		require.Len(t, after, 2)
+		assert.False(t, after[0].LastUsedAt.Before(before.LastUsedAt))
+	})
+
+	t.Run("Revoking a device logs it out", func(t *testing.T) {
+		var phoneSession string
+		for _, session := range list(laptopToken) {
+			if !session.Current {
+				phoneSession = session.ID
+			}
+		}
+
+		w := performJSON(router, "DELETE", "/api/users/me/sessions/"+phoneSession, nil, laptopToken)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": phone["refresh_token"]}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		w = performJSON(router, "GET", "/api/protected", nil, phone["access_token"].(string))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		// The laptop stays logged in
+		sessions := list(laptopToken)
+		require.Len(t, sessions, 1)
+		assert.True(t, sessions[0].Current)
+	})
+
+	t.Run("Only your own sessions can be revoked", func(t *testing.T) {
+		other, err := auth.GenerateTokenPair(Stores.Keys, &auth.TokenSubject{UserID: CreateTestUser(t), Role: "customer"})
+		require.NoError(t, err)
+
+		session := list(laptopToken)[0]
+		w := performJSON(router, "DELETE", "/api/users/me/sessions/"+session.ID, nil, other.AccessToken)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Len(t, list(laptopToken), 1)
+	})
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"backend-dragonhak/auth"
+)
+
+// Stores holds the signing keys and key-value backed state used by the auth handlers
+var Stores struct {
+	Keys     *auth.KeySet
+	Sessions *auth.SessionStore
+	Denylist *auth.Denylist
+	Resets   *auth.PasswordResetter
+	// Verifications issues the tokens sent when a user changes their email
+	Verifications *auth.EmailVerifier
+	MFA           *auth.MFAChallenges
+	Logins        *auth.LoginGuard
+	OAuthStates   *auth.OAuthStates
+}
+
+// InitStores initializes all stores on top of the given key-value backend
+func InitStores(kv auth.KV, keys *auth.KeySet) {
+	Stores.Keys = keys
+	Stores.Sessions = auth.NewSessionStore(kv, keys)
+	Stores.Denylist = auth.NewDenylist(kv)
+	Stores.Resets = auth.NewPasswordResetter(kv)
+	Stores.Verifications = auth.NewEmailVerifier(kv)
+	Stores.MFA = auth.NewMFAChallenges(kv)
+	Stores.Logins = auth.NewLoginGuard(kv)
+	Stores.OAuthStates = auth.NewOAuthStates(kv)
+}
@@ -1,285 +1,906 @@
 package handlers
 
 import (
+	"backend-dragonhak/auth"
 	"backend-dragonhak/models"
+	"backend-dragonhak/services"
+	"bytes"
 	"context"
+	"io"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// MockCollection implements a mock MongoDB collection
+// MockCollection implements an in-memory MongoDB collection. Documents are
+// kept in their BSON form so filters and update operators work for every
+// model; only the parts of the query language the handlers use are supported.
 type MockCollection struct {
+	mu   sync.Mutex
 	Data []interface{}
+	// Unique lists fields InsertOne enforces a unique index on
+	Unique []string
 }
 
+// InsertOne mocks the InsertOne operation
 func (mc *MockCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
-	// Generate a new ObjectID for the document
-	id := primitive.NewObjectID()
-
-	// If the document is a struct with an ID field, set it
-	switch v := document.(type) {
-	case *models.User:
-		v.ID = id
-		document = v
-	case *models.Workshop:
-		v.ID = id
-		document = v
-	case *models.Craft:
-		v.ID = id
-		document = v
-	case *models.Craftsman:
-		v.ID = id
-		document = v
-	case *models.Booking:
-		v.ID = id
-		document = v
-	case models.User:
-		v.ID = id
-		document = v
-	case models.Workshop:
-		v.ID = id
-		document = v
-	case models.Craft:
-		v.ID = id
-		document = v
-	case models.Craftsman:
-		v.ID = id
-		document = v
-	case models.Booking:
-		v.ID = id
-		document = v
-	}
-
-	mc.Data = append(mc.Data, document)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	doc, err := toDocument(document)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate a new ObjectID unless the document already has one
+	id, hasID := doc["_id"]
+	if oid, ok := id.(primitive.ObjectID); !hasID || (ok && oid.IsZero()) {
+		newID := primitive.NewObjectID()
+		doc["_id"] = newID
+		setDocumentID(document, newID)
+		id = newID
+	}
+
+	for _, field := range mc.Unique {
+		value, ok := doc[field]
+		if !ok {
+			continue
+		}
+		for _, existing := range mc.Data {
+			if matchDocument(existing.(bson.M), bson.M{field: value}) {
+				return nil, mongo.WriteException{WriteErrors: []mongo.WriteError{{
+					Code:    11000,
+					Message: "E11000 duplicate key error: " + field,
+				}}}
+			}
+		}
+	}
+
+	mc.Data = append(mc.Data, doc)
 	return &mongo.InsertOneResult{InsertedID: id}, nil
 }
 
 // FindOne mocks the FindOne operation
 func (mc *MockCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
-	// Convert filter to bson.M
-	filterMap, ok := filter.(bson.M)
-	if !ok {
-		return mongo.NewSingleResultFromDocument(nil, mongo.ErrNoDocuments, nil)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	o := options.MergeFindOneOptions(opts...)
+	if o.Projection != nil || o.Collation != nil || o.Hint != nil || o.Max != nil || o.Min != nil {
+		panic("MockCollection: FindOne supports only the sort and skip options")
+	}
+	var skip int64
+	if o.Skip != nil {
+		skip = *o.Skip
 	}
+	matched := mc.query(filter, o.Sort, skip, 1)
+	if len(matched) == 0 {
+		return mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+	}
+	return mongo.NewSingleResultFromDocument(matched[0], nil, nil)
+}
+
+// UpdateOne mocks the UpdateOne operation
+func (mc *MockCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 
-	// Find matching document
 	for _, doc := range mc.Data {
-		// Handle different document types
-		switch v := doc.(type) {
-		case *models.Workshop:
-			if v.ID == filterMap["_id"] {
-				return mongo.NewSingleResultFromDocument(v, nil, nil)
+		if matchDocument(doc.(bson.M), filter) {
+			modified, err := applyUpdate(doc.(bson.M), update, false)
+			if err != nil {
+				return nil, err
 			}
-		case *models.User:
-			if v.ID == filterMap["_id"] || v.Email == filterMap["email"] {
-				return mongo.NewSingleResultFromDocument(v, nil, nil)
+			result := &mongo.UpdateResult{MatchedCount: 1}
+			if modified {
+				result.ModifiedCount = 1
 			}
-		case *models.Craft:
-			if v.ID == filterMap["_id"] {
-				return mongo.NewSingleResultFromDocument(v, nil, nil)
-			}
-		case *models.Craftsman:
-			if v.ID == filterMap["_id"] {
-				return mongo.NewSingleResultFromDocument(v, nil, nil)
+			return result, nil
+		}
+	}
+
+	upsert := options.MergeUpdateOptions(opts...).Upsert
+	if upsert == nil || !*upsert {
+		return &mongo.UpdateResult{MatchedCount: 0, ModifiedCount: 0}, nil
+	}
+
+	// Seed the new document with the equality conditions of the filter
+	doc := bson.M{}
+	for key, value := range toMap(filter) {
+		if !strings.HasPrefix(key, "$") && !isOperatorDocument(value) {
+			setPath(doc, key, normalizeValue(value))
+		}
+	}
+	if _, err := applyUpdate(doc, update, true); err != nil {
+		return nil, err
+	}
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = primitive.NewObjectID()
+	}
+	mc.Data = append(mc.Data, doc)
+
+	return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: doc["_id"]}, nil
+}
+
+// UpdateMany mocks the UpdateMany operation
+func (mc *MockCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	result := &mongo.UpdateResult{}
+	for _, doc := range mc.Data {
+		if matchDocument(doc.(bson.M), filter) {
+			modified, err := applyUpdate(doc.(bson.M), update, false)
+			if err != nil {
+				return nil, err
 			}
-		case *models.Booking:
-			if v.ID == filterMap["_id"] {
-				return mongo.NewSingleResultFromDocument(v, nil, nil)
+			result.MatchedCount++
+			if modified {
+				result.ModifiedCount++
 			}
-		case models.Workshop:
-			if v.ID == filterMap["_id"] {
-				return mongo.NewSingleResultFromDocument(&v, nil, nil)
+		}
+	}
+	return result, nil
+}
+
+// DeleteOne mocks the DeleteOne operation
+func (mc *MockCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for i, doc := range mc.Data {
+		if matchDocument(doc.(bson.M), filter) {
+			mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
+			return &mongo.DeleteResult{DeletedCount: 1}, nil
+		}
+	}
+
+	return &mongo.DeleteResult{DeletedCount: 0}, nil
+}
+
+// DeleteMany mocks the DeleteMany operation
+func (mc *MockCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	kept := mc.Data[:0]
+	var deleted int64
+	for _, doc := range mc.Data {
+		if matchDocument(doc.(bson.M), filter) {
+			deleted++
+		} else {
+			kept = append(kept, doc)
+		}
+	}
+	mc.Data = kept
+	return &mongo.DeleteResult{DeletedCount: deleted}, nil
+}
+
+// CountDocuments mocks the CountDocuments operation
+func (mc *MockCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	var count int64
+	for _, doc := range mc.Data {
+		if matchDocument(doc.(bson.M), filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Find mocks the Find operation
+func (mc *MockCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	o := options.MergeFindOptions(opts...)
+	if o.Projection != nil || o.Collation != nil || o.Hint != nil || o.Max != nil || o.Min != nil {
+		panic("MockCollection: Find supports only the sort, skip and limit options")
+	}
+	var skip, limit int64
+	if o.Skip != nil {
+		skip = *o.Skip
+	}
+	if o.Limit != nil {
+		limit = *o.Limit
+	}
+
+	cursor, _ := mongo.NewCursorFromDocuments(mc.query(filter, o.Sort, skip, limit), nil, nil)
+	return cursor, nil
+}
+
+// query returns the documents matching filter in sort order, skipping the
+// first skip of them and returning at most limit when limit is positive.
+// The caller must hold mc.mu.
+func (mc *MockCollection) query(filter interface{}, sortSpec interface{}, skip, limit int64) []interface{} {
+	matched := []interface{}{}
+	for _, doc := range mc.Data {
+		if matchDocument(doc.(bson.M), filter) {
+			matched = append(matched, doc)
+		}
+	}
+
+	if sortSpec != nil {
+		keys := sortKeys(sortSpec)
+		sort.SliceStable(matched, func(i, j int) bool {
+			return lessDocument(matched[i].(bson.M), matched[j].(bson.M), keys) < 0
+		})
+	}
+
+	if skip >= int64(len(matched)) {
+		return []interface{}{}
+	}
+	matched = matched[skip:]
+	if limit > 0 && limit < int64(len(matched)) {
+		matched = matched[:limit]
+	}
+	return matched
+}
+
+// sortKeys reads a sort specification as an ordered list of field and
+// direction; a bson.M is only accepted with a single key since maps have
+// no order
+func sortKeys(spec interface{}) bson.D {
+	switch s := spec.(type) {
+	case bson.D:
+		return s
+	case bson.M:
+		if len(s) > 1 {
+			panic("MockCollection: sort on several fields must be a bson.D")
+		}
+		keys := bson.D{}
+		for key, dir := range s {
+			keys = append(keys, bson.E{Key: key, Value: dir})
+		}
+		return keys
+	}
+	panic("MockCollection: unsupported sort specification")
+}
+
+// lessDocument compares two documents by the sort keys; missing fields sort
+// before any value, as null does in MongoDB
+func lessDocument(a, b bson.M, keys bson.D) int {
+	for _, key := range keys {
+		dir, _ := toFloat(normalizeValue(key.Value))
+		av := firstOrNil(lookupPath(a, strings.Split(key.Key, ".")))
+		bv := firstOrNil(lookupPath(b, strings.Split(key.Key, ".")))
+
+		var cmp int
+		switch {
+		case av == nil && bv == nil:
+		case av == nil:
+			cmp = -1
+		case bv == nil:
+			cmp = 1
+		default:
+			c, ok := compareValues(av, bv)
+			if !ok {
+				panic("MockCollection: cannot sort mixed types on " + key.Key)
 			}
-		case models.User:
-			if v.ID == filterMap["_id"] || v.Email == filterMap["email"] {
-				return mongo.NewSingleResultFromDocument(&v, nil, nil)
+			cmp = c
+		}
+		if cmp != 0 {
+			if dir < 0 {
+				return -cmp
 			}
-		case models.Craft:
-			if v.ID == filterMap["_id"] {
-				return mongo.NewSingleResultFromDocument(&v, nil, nil)
+			return cmp
+		}
+	}
+	return 0
+}
+
+// snapshot returns a deep copy of the collection's documents
+func (mc *MockCollection) snapshot() []interface{} {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	docs := make([]interface{}, len(mc.Data))
+	for i, doc := range mc.Data {
+		docs[i], _ = toDocument(doc)
+	}
+	return docs
+}
+
+// restore replaces the collection's documents with a snapshot
+func (mc *MockCollection) restore(docs []interface{}) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.Data = docs
+}
+
+// MockTransactor runs units of work one at a time against the mock
+// collections, putting every collection back as it was when the work fails
+type MockTransactor struct {
+	mu sync.Mutex
+}
+
+// WithTransaction mocks a transaction by snapshotting the mock collections
+func (mt *MockTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	collections := []*MockCollection{}
+	fields := reflect.ValueOf(&Collections).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		if mc, ok := fields.Field(i).Interface().(*MockCollection); ok {
+			collections = append(collections, mc)
+		}
+	}
+
+	snapshots := make([][]interface{}, len(collections))
+	for i, mc := range collections {
+		snapshots[i] = mc.snapshot()
+	}
+	if err := fn(ctx); err != nil {
+		for i, mc := range collections {
+			mc.restore(snapshots[i])
+		}
+		return err
+	}
+	return nil
+}
+
+// toDocument converts any BSON-marshalable value to its bson.M form
+func toDocument(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// normalizeValue converts a Go value to the type it has once stored in BSON
+func normalizeValue(v interface{}) interface{} {
+	doc, err := toDocument(bson.M{"v": v})
+	if err != nil {
+		return v
+	}
+	return doc["v"]
+}
+
+// setDocumentID sets the ID field of a pointer to a model, as the driver does
+func setDocumentID(document interface{}, id primitive.ObjectID) {
+	v := reflect.ValueOf(document)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	field := v.Elem().FieldByName("ID")
+	if field.IsValid() && field.CanSet() && field.Type() == reflect.TypeOf(id) {
+		field.Set(reflect.ValueOf(id))
+	}
+}
+
+// toMap flattens a bson.M or bson.D filter into a map
+func toMap(v interface{}) bson.M {
+	switch m := v.(type) {
+	case bson.M:
+		return m
+	case map[string]interface{}:
+		return bson.M(m)
+	case bson.D:
+		out := bson.M{}
+		for _, e := range m {
+			out[e.Key] = e.Value
+		}
+		return out
+	}
+	return nil
+}
+
+func isOperatorDocument(v interface{}) bool {
+	m := toMap(v)
+	if len(m) == 0 {
+		return false
+	}
+	for key := range m {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupPath returns the values at a dotted path, descending into arrays of
+// subdocuments the way MongoDB does
+func lookupPath(value interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{value}
+	}
+	switch v := value.(type) {
+	case bson.M:
+		child, ok := v[path[0]]
+		if !ok {
+			return nil
+		}
+		return lookupPath(child, path[1:])
+	case bson.A:
+		if index, err := strconv.Atoi(path[0]); err == nil {
+			if index < len(v) {
+				return lookupPath(v[index], path[1:])
 			}
-		case models.Craftsman:
-			if v.ID == filterMap["_id"] {
-				return mongo.NewSingleResultFromDocument(&v, nil, nil)
+			return nil
+		}
+		var out []interface{}
+		for _, elem := range v {
+			if _, ok := elem.(bson.M); ok {
+				out = append(out, lookupPath(elem, path)...)
 			}
-		case models.Booking:
-			if v.ID == filterMap["_id"] {
-				return mongo.NewSingleResultFromDocument(&v, nil, nil)
+		}
+		return out
+	}
+	return nil
+}
+
+// compareValues orders two normalized BSON values, reporting false when
+// the types can't be compared
+func compareValues(a, b interface{}) (int, bool) {
+	if af, ok := toFloat(a); ok {
+		if bf, ok := toFloat(b); ok {
+			switch {
+			case af < bf:
+				return -1, true
+			case af > bf:
+				return 1, true
 			}
-		case bson.M:
-			if id, ok := v["_id"].(primitive.ObjectID); ok {
-				if id == filterMap["_id"] {
-					return mongo.NewSingleResultFromDocument(v, nil, nil)
-				}
+			return 0, true
+		}
+		return 0, false
+	}
+
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case primitive.DateTime:
+		if bv, ok := b.(primitive.DateTime); ok {
+			switch {
+			case av < bv:
+				return -1, true
+			case av > bv:
+				return 1, true
 			}
+			return 0, true
+		}
+	case primitive.ObjectID:
+		if bv, ok := b.(primitive.ObjectID); ok {
+			return strings.Compare(av.Hex(), bv.Hex()), true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok && av == bv {
+			return 0, true
+		}
+	case nil:
+		if b == nil {
+			return 0, true
 		}
 	}
+	return 0, false
+}
 
-	// No matching document found
-	return mongo.NewSingleResultFromDocument(nil, mongo.ErrNoDocuments, nil)
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
 }
 
-// UpdateOne mocks the UpdateOne operation
-func (mc *MockCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
-	filterMap, ok := filter.(bson.M)
-	if !ok {
-		return nil, mongo.ErrNoDocuments
+func valuesEqual(a, b interface{}) bool {
+	if cmp, ok := compareValues(a, b); ok {
+		return cmp == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// fieldEquals reports whether any value equals target, including array members
+func fieldEquals(values []interface{}, target interface{}) bool {
+	for _, value := range values {
+		if valuesEqual(value, target) {
+			return true
+		}
+		if arr, ok := value.(bson.A); ok {
+			for _, elem := range arr {
+				if valuesEqual(elem, target) {
+					return true
+				}
+			}
+		}
 	}
+	return false
+}
 
-	updateMap, ok := update.(bson.M)
-	if !ok {
-		return nil, mongo.ErrNoDocuments
+// fieldCompares reports whether any value (or array member) satisfies cmpOK
+func fieldCompares(values []interface{}, target interface{}, cmpOK func(int) bool) bool {
+	for _, value := range values {
+		candidates := []interface{}{value}
+		if arr, ok := value.(bson.A); ok {
+			candidates = arr
+		}
+		for _, candidate := range candidates {
+			if cmp, ok := compareValues(candidate, target); ok && cmpOK(cmp) {
+				return true
+			}
+		}
 	}
+	return false
+}
 
-	// Find and update the document
-	for i, doc := range mc.Data {
-		switch v := doc.(type) {
-		case *models.Workshop:
-			if v.ID == filterMap["_id"] {
-				if inc, ok := updateMap["$inc"].(bson.M); ok {
-					if val, ok := inc["current_students"].(int); ok {
-						v.CurrentStudents += val
-						mc.Data[i] = v
-						return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
-					}
+// matchDocument reports whether a stored document satisfies a filter
+func matchDocument(doc bson.M, filter interface{}) bool {
+	for key, cond := range toMap(filter) {
+		switch key {
+		case "$and":
+			for _, sub := range toArray(cond) {
+				if !matchDocument(doc, sub) {
+					return false
 				}
 			}
-		case models.Workshop:
-			if v.ID == filterMap["_id"] {
-				if inc, ok := updateMap["$inc"].(bson.M); ok {
-					if val, ok := inc["current_students"].(int); ok {
-						v.CurrentStudents += val
-						mc.Data[i] = v
-						return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
-					}
+		case "$or":
+			matched := false
+			for _, sub := range toArray(cond) {
+				if matchDocument(doc, sub) {
+					matched = true
+					break
 				}
 			}
-		case bson.M:
-			if id, ok := v["_id"].(primitive.ObjectID); ok {
-				if id == filterMap["_id"] {
-					if inc, ok := updateMap["$inc"].(bson.M); ok {
-						if val, ok := inc["current_students"].(int); ok {
-							if current, ok := v["current_students"].(int); ok {
-								v["current_students"] = current + val
-								mc.Data[i] = v
-								return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
-							}
-						}
-					}
+			if !matched {
+				return false
+			}
+		case "$nor":
+			for _, sub := range toArray(cond) {
+				if matchDocument(doc, sub) {
+					return false
 				}
 			}
+		case "$expr":
+			if truthy, ok := evalExpr(doc, cond).(bool); !ok || !truthy {
+				return false
+			}
+		default:
+			if !matchField(doc, key, cond) {
+				return false
+			}
 		}
 	}
+	return true
+}
 
-	return &mongo.UpdateResult{MatchedCount: 0, ModifiedCount: 0}, nil
+func toArray(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil
+	}
+	out := make([]interface{}, rv.Len())
+	for i := range out {
+		out[i] = rv.Index(i).Interface()
+	}
+	return out
 }
 
-// DeleteOne mocks the DeleteOne operation
-func (mc *MockCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
-	filterMap, ok := filter.(bson.M)
-	if !ok {
-		return nil, mongo.ErrNoDocuments
+func matchField(doc bson.M, path string, cond interface{}) bool {
+	values := lookupPath(doc, strings.Split(path, "."))
+
+	if !isOperatorDocument(cond) {
+		target := normalizeValue(cond)
+		if target == nil {
+			// {field: nil} matches both missing and null fields
+			return len(values) == 0 || fieldEquals(values, nil)
+		}
+		return fieldEquals(values, target)
 	}
 
-	// Find and delete the document
-	for i, doc := range mc.Data {
-		switch v := doc.(type) {
-		case *models.Workshop:
-			if v.ID == filterMap["_id"] {
-				mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-				return &mongo.DeleteResult{DeletedCount: 1}, nil
-			}
-		case *models.User:
-			if v.ID == filterMap["_id"] {
-				mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-				return &mongo.DeleteResult{DeletedCount: 1}, nil
-			}
-		case *models.Craft:
-			if v.ID == filterMap["_id"] {
-				mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-				return &mongo.DeleteResult{DeletedCount: 1}, nil
+	for op, arg := range toMap(cond) {
+		if !matchOperator(values, op, arg) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchOperator(values []interface{}, op string, arg interface{}) bool {
+	switch op {
+	case "$eq":
+		return fieldEquals(values, normalizeValue(arg))
+	case "$ne":
+		return !fieldEquals(values, normalizeValue(arg))
+	case "$gt":
+		return fieldCompares(values, normalizeValue(arg), func(c int) bool { return c > 0 })
+	case "$gte":
+		return fieldCompares(values, normalizeValue(arg), func(c int) bool { return c >= 0 })
+	case "$lt":
+		return fieldCompares(values, normalizeValue(arg), func(c int) bool { return c < 0 })
+	case "$lte":
+		return fieldCompares(values, normalizeValue(arg), func(c int) bool { return c <= 0 })
+	case "$in":
+		for _, candidate := range toArray(arg) {
+			if fieldEquals(values, normalizeValue(candidate)) {
+				return true
 			}
-		case *models.Craftsman:
-			if v.ID == filterMap["_id"] {
-				mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-				return &mongo.DeleteResult{DeletedCount: 1}, nil
+		}
+		return false
+	case "$nin":
+		return !matchOperator(values, "$in", arg)
+	case "$exists":
+		return (len(values) > 0) == arg.(bool)
+	case "$size":
+		size, _ := toFloat(normalizeValue(arg))
+		for _, value := range values {
+			if arr, ok := value.(bson.A); ok && float64(len(arr)) == size {
+				return true
 			}
-		case *models.Booking:
-			if v.ID == filterMap["_id"] {
-				mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-				return &mongo.DeleteResult{DeletedCount: 1}, nil
+		}
+		return false
+	case "$elemMatch":
+		for _, value := range values {
+			arr, ok := value.(bson.A)
+			if !ok {
+				continue
 			}
-		case models.Workshop:
-			if v.ID == filterMap["_id"] {
-				mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-				return &mongo.DeleteResult{DeletedCount: 1}, nil
+			for _, elem := range arr {
+				if sub, ok := elem.(bson.M); ok && !isOperatorDocument(arg) {
+					if matchDocument(sub, arg) {
+						return true
+					}
+					continue
+				}
+				if matchField(bson.M{"v": elem}, "v", arg) {
+					return true
+				}
 			}
-		case models.User:
-			if v.ID == filterMap["_id"] {
-				mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-				return &mongo.DeleteResult{DeletedCount: 1}, nil
+		}
+		return false
+	case "$not":
+		return !matchField(bson.M{"v": firstOrNil(values)}, "v", arg)
+	}
+	panic("MockCollection: unsupported query operator " + op)
+}
+
+func firstOrNil(values []interface{}) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// evalExpr evaluates the aggregation expressions used inside $expr
+func evalExpr(doc bson.M, expr interface{}) interface{} {
+	if ref, ok := expr.(string); ok && strings.HasPrefix(ref, "$") {
+		return firstOrNil(lookupPath(doc, strings.Split(ref[1:], ".")))
+	}
+	m := toMap(expr)
+	if len(m) != 1 {
+		return normalizeValue(expr)
+	}
+	for op, arg := range m {
+		args := toArray(arg)
+		switch op {
+		case "$and", "$or":
+			result := op == "$and"
+			for _, sub := range args {
+				truthy, _ := evalExpr(doc, sub).(bool)
+				if op == "$and" {
+					result = result && truthy
+				} else {
+					result = result || truthy
+				}
 			}
-		case models.Craft:
-			if v.ID == filterMap["_id"] {
-				mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-				return &mongo.DeleteResult{DeletedCount: 1}, nil
+			return result
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			cmp, ok := compareValues(evalExpr(doc, args[0]), evalExpr(doc, args[1]))
+			if !ok {
+				return op == "$ne"
 			}
-		case models.Craftsman:
-			if v.ID == filterMap["_id"] {
-				mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-				return &mongo.DeleteResult{DeletedCount: 1}, nil
+			switch op {
+			case "$eq":
+				return cmp == 0
+			case "$ne":
+				return cmp != 0
+			case "$gt":
+				return cmp > 0
+			case "$gte":
+				return cmp >= 0
+			case "$lt":
+				return cmp < 0
 			}
-		case models.Booking:
-			if v.ID == filterMap["_id"] {
-				mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-				return &mongo.DeleteResult{DeletedCount: 1}, nil
+			return cmp <= 0
+		}
+		panic("MockCollection: unsupported expression operator " + op)
+	}
+	return nil
+}
+
+// setPath sets a dotted path, creating intermediate documents as needed
+func setPath(doc bson.M, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	current := doc
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(bson.M)
+		if !ok {
+			next = bson.M{}
+			current[part] = next
+		}
+		current = next
+	}
+	current[parts[len(parts)-1]] = value
+}
+
+func unsetPath(doc bson.M, path string) {
+	parts := strings.Split(path, ".")
+	current := doc
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(bson.M)
+		if !ok {
+			return
+		}
+		current = next
+	}
+	delete(current, parts[len(parts)-1])
+}
+
+// eachValues expands {$each: [...]} modifiers used by $push and $addToSet
+func eachValues(arg interface{}) []interface{} {
+	if m := toMap(arg); m != nil {
+		if each, ok := m["$each"]; ok {
+			values := toArray(each)
+			for i := range values {
+				values[i] = normalizeValue(values[i])
 			}
-		case bson.M:
-			if id, ok := v["_id"].(primitive.ObjectID); ok {
-				if id == filterMap["_id"] {
-					mc.Data = append(mc.Data[:i], mc.Data[i+1:]...)
-					return &mongo.DeleteResult{DeletedCount: 1}, nil
+			return values
+		}
+	}
+	return []interface{}{normalizeValue(arg)}
+}
+
+// applyUpdate applies update operators to doc and reports whether it changed
+func applyUpdate(doc bson.M, update interface{}, inserting bool) (bool, error) {
+	before, err := toDocument(doc)
+	if err != nil {
+		return false, err
+	}
+
+	for op, arg := range toMap(update) {
+		fields := toMap(arg)
+		for path, value := range fields {
+			current := firstOrNil(lookupPath(doc, strings.Split(path, ".")))
+			switch op {
+			case "$set":
+				setPath(doc, path, normalizeValue(value))
+			case "$setOnInsert":
+				if inserting {
+					setPath(doc, path, normalizeValue(value))
+				}
+			case "$unset":
+				unsetPath(doc, path)
+			case "$inc":
+				delta := normalizeValue(value)
+				if current == nil {
+					setPath(doc, path, delta)
+					break
+				}
+				a, _ := toFloat(current)
+				b, _ := toFloat(delta)
+				switch current.(type) {
+				case int32:
+					setPath(doc, path, int32(a+b))
+				case int64:
+					setPath(doc, path, int64(a+b))
+				default:
+					setPath(doc, path, a+b)
 				}
+			case "$push", "$addToSet":
+				arr, _ := current.(bson.A)
+				for _, elem := range eachValues(value) {
+					if op == "$addToSet" && fieldEquals([]interface{}{arr}, elem) {
+						continue
+					}
+					arr = append(arr, elem)
+				}
+				setPath(doc, path, arr)
+			case "$pull":
+				arr, _ := current.(bson.A)
+				kept := bson.A{}
+				for _, elem := range arr {
+					var remove bool
+					if sub, ok := elem.(bson.M); ok && toMap(value) != nil && !isOperatorDocument(value) {
+						remove = matchDocument(sub, value)
+					} else {
+						remove = matchField(bson.M{"v": elem}, "v", value)
+					}
+					if !remove {
+						kept = append(kept, elem)
+					}
+				}
+				setPath(doc, path, kept)
+			default:
+				panic("MockCollection: unsupported update operator " + op)
 			}
 		}
 	}
 
-	return &mongo.DeleteResult{DeletedCount: 0}, nil
+	return !reflect.DeepEqual(before, doc), nil
 }
 
-// Find mocks the Find operation
-func (mc *MockCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
-	cursor, _ := mongo.NewCursorFromDocuments(mc.Data, nil, nil)
-	return cursor, nil
+// resetMockCollections points every field of Collections at a new, empty
+// mock collection
+func resetMockCollections() {
+	fields := reflect.ValueOf(&Collections).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		fields.Field(i).Set(reflect.ValueOf(&MockCollection{Data: make([]interface{}, 0)}))
+	}
 }
 
 // SetupTestDB initializes test collections with mock data
 func SetupTestDB(t *testing.T) {
-	Collections = struct {
-		Users     Collection
-		Craftsmen Collection
-		Crafts    Collection
-		Workshops Collection
-		Badges    Collection
-		Auctions  Collection
-		Bids      Collection
-		Bookings  Collection
-	}{
-		Users:     &MockCollection{Data: make([]interface{}, 0)},
-		Craftsmen: &MockCollection{Data: make([]interface{}, 0)},
-		Crafts:    &MockCollection{Data: make([]interface{}, 0)},
-		Workshops: &MockCollection{Data: make([]interface{}, 0)},
-		Badges:    &MockCollection{Data: make([]interface{}, 0)},
-		Auctions:  &MockCollection{Data: make([]interface{}, 0)},
-		Bids:      &MockCollection{Data: make([]interface{}, 0)},
-		Bookings:  &MockCollection{Data: make([]interface{}, 0)},
+	resetMockCollections()
+	Transactions = &MockTransactor{}
+	InitStores(auth.NewMemoryKV(), testKeySet(t))
+	InitMail(services.NewFileMailer(t.TempDir(), "no-reply@example.com"), "http://localhost:8080")
+	ExportDir = t.TempDir()
+}
+
+// testKeySet returns a key set with a fresh Ed25519 signing key
+func testKeySet(t *testing.T) *auth.KeySet {
+	key, err := auth.GenerateKey(auth.AlgEdDSA)
+	require.NoError(t, err)
+	keys, err := auth.NewKeySet(key)
+	require.NoError(t, err)
+	return keys
+}
+
+// sentMail returns every email the test mailer has written, oldest first,
+// with the body decoded
+func sentMail(t *testing.T) []*mail.Message {
+	mailer := Mail.Sender.(*services.FileMailer)
+	paths, err := filepath.Glob(filepath.Join(mailer.Dir(), "*.eml"))
+	require.NoError(t, err)
+	sort.Strings(paths)
+
+	messages := make([]*mail.Message, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		require.NoError(t, err)
+		msg.Body = quotedprintable.NewReader(msg.Body)
+		messages = append(messages, msg)
 	}
+	return messages
+}
+
+// mailBody reads the decoded body of a message returned by sentMail
+func mailBody(t *testing.T, msg *mail.Message) string {
+	body, err := io.ReadAll(msg.Body)
+	require.NoError(t, err)
+	return string(body)
 }
 
 // CreateTestUser creates a test user and returns its ID
@@ -301,25 +922,31 @@ func CreateTestUser(t *testing.T) primitive.ObjectID {
 	return result.InsertedID.(primitive.ObjectID)
 }
 
+// newUser inserts a user with the given name and role
+func newUser(t *testing.T, name string, role models.UserRole) models.User {
+	user := models.User{Name: name, Email: name + "@example.com", Role: role}
+	_, err := Collections.Users.InsertOne(context.Background(), &user)
+	require.NoError(t, err)
+	return user
+}
+
+// newCraftsman inserts a craftsman user with a craftsman profile and returns
+// the user and the profile's ID
+func newCraftsman(t *testing.T, name string) (models.User, primitive.ObjectID) {
+	user := newUser(t, name, models.RoleCraftsman)
+	result, err := Collections.Craftsmen.InsertOne(context.Background(), models.Craftsman{UserID: user.ID})
+	require.NoError(t, err)
+	return user, result.InsertedID.(primitive.ObjectID)
+}
+
+// tokenFor issues an access token for user, as a login would
+func tokenFor(t *testing.T, user models.User) string {
+	pair, err := issueTokenPair(context.Background(), user, auth.Device{})
+	require.NoError(t, err)
+	return pair.AccessToken
+}
+
 // CleanupTestDB cleans up the test database
 func CleanupTestDB(t *testing.T) {
-	Collections = struct {
-		Users     Collection
-		Craftsmen Collection
-		Crafts    Collection
-		Workshops Collection
-		Badges    Collection
-		Auctions  Collection
-		Bids      Collection
-		Bookings  Collection
-	}{
-		Users:     &MockCollection{Data: make([]interface{}, 0)},
-		Craftsmen: &MockCollection{Data: make([]interface{}, 0)},
-		Crafts:    &MockCollection{Data: make([]interface{}, 0)},
-		Workshops: &MockCollection{Data: make([]interface{}, 0)},
-		Badges:    &MockCollection{Data: make([]interface{}, 0)},
-		Auctions:  &MockCollection{Data: make([]interface{}, 0)},
-		Bids:      &MockCollection{Data: make([]interface{}, 0)},
-		Bookings:  &MockCollection{Data: make([]interface{}, 0)},
-	}
+	resetMockCollections()
 }
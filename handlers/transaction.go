@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Transactor runs a unit of work that spans several collections
+type Transactor interface {
+	// WithTransaction runs fn in a transaction. Collection calls made with the
+	// context passed to fn take part in it, and none of their writes are kept
+	// if fn returns an error. fn may be retried and must not have side
+	// effects outside the database.
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// Transactions runs multi-collection writes atomically
+var Transactions Transactor
+
+// mongoTransactor runs units of work as MongoDB multi-document transactions,
+// which need a replica set or sharded cluster
+type mongoTransactor struct {
+	client *mongo.Client
+}
+
+// NewMongoTransactor returns a Transactor backed by client sessions
+func NewMongoTransactor(client *mongo.Client) Transactor {
+	return &mongoTransactor{client: client}
+}
+
+func (t *mongoTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := t.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
@@ -3,7 +3,6 @@ package handlers
 import (
 	"context"
 	"net/http"
-	"os"
 	"time"
 
 	"backend-dragonhak/auth"
@@ -12,6 +11,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // GetUsers handles getting all users
@@ -19,8 +19,8 @@ func GetUsers(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	var users []models.User
-	cursor, err := Collections.Users.Find(ctx, bson.M{})
+	users := []interface{}{}
+	cursor, err := Collections.Users.Find(ctx, bson.M{"deleted_at": bson.M{"$exists": false}})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -33,7 +33,7 @@ func GetUsers(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		users = append(users, user)
+		users = append(users, userView(c, user))
 	}
 
 	c.JSON(http.StatusOK, users)
@@ -52,15 +52,13 @@ func GetUser(c *gin.Context) {
 	}
 
 	var user models.User
-	err = Collections.Users.FindOne(ctx, bson.M{"_id": objID}).Decode(&user)
+	err = Collections.Users.FindOne(ctx, bson.M{"_id": objID, "deleted_at": bson.M{"$exists": false}}).Decode(&user)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	// Don't return the password
-	user.Password = ""
-	c.JSON(http.StatusOK, user)
+	c.JSON(http.StatusOK, userView(c, user))
 }
 
 type CreateUserRequest struct {
@@ -69,7 +67,9 @@ type CreateUserRequest struct {
 	Username string `json:"username" binding:"required"`
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
-	Role     string `json:"role" binding:"required,oneof=customer admin craftsman"`
+	// Role is always customer: craftsmen register at /register/craftsman
+	// and admins aren't created through the public API
+	Role string `json:"role" binding:"omitempty,oneof=customer"`
 }
 
 // CreateUser handles creating a new user
@@ -84,7 +84,7 @@ func CreateUser(c *gin.Context) {
 		case err.Error() == "Key: 'CreateUserRequest.Email' Error:Field validation for 'Email' failed on the 'email' tag":
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email format"})
 		case err.Error() == "Key: 'CreateUserRequest.Role' Error:Field validation for 'Role' failed on the 'oneof' tag":
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role: only customers can register here, craftsmen register at /api/auth/register/craftsman"})
 		default:
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		}
@@ -94,22 +94,7 @@ func CreateUser(c *gin.Context) {
 	// Hash password first to validate password requirements
 	hashedPassword, err := auth.HashPassword(req.Password)
 	if err != nil {
-		switch err {
-		case auth.ErrPasswordTooShort:
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Password must be at least 8 characters long"})
-		case auth.ErrPasswordNoUpper:
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Password must contain at least one uppercase letter"})
-		case auth.ErrPasswordNoLower:
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Password must contain at least one lowercase letter"})
-		case auth.ErrPasswordNoNumber:
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Password must contain at least one number"})
-		case auth.ErrPasswordNoSpecial:
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Password must contain at least one special character"})
-		case auth.ErrPasswordCommon:
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Password is too common or easily guessable"})
-		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
-		}
+		respondPasswordError(c, err)
 		return
 	}
 
@@ -128,12 +113,17 @@ func CreateUser(c *gin.Context) {
 		Username:  req.Username,
 		Email:     req.Email,
 		Password:  hashedPassword,
-		Role:      models.UserRole(req.Role),
+		Role:      models.RoleCustomer,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
 
+	// The unique email index catches a registration racing this one
 	result, err := Collections.Users.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -142,35 +132,32 @@ func CreateUser(c *gin.Context) {
 	user.ID = result.InsertedID.(primitive.ObjectID)
 
 	// Generate token pair
-	tokenPair, err := auth.GenerateTokenPair(
-		user.ID,
-		user.Name,
-		user.Surname,
-		string(user.Role),
-		os.Getenv("JWT_ACCESS_SECRET"),
-		os.Getenv("JWT_REFRESH_SECRET"),
-	)
+	tokenPair, err := issueTokenPair(ctx, user, clientDevice(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
 		return
 	}
 
-	// Don't return the hashed password
-	user.Password = ""
 	c.JSON(http.StatusCreated, gin.H{
 		"access_token":  tokenPair.AccessToken,
 		"refresh_token": tokenPair.RefreshToken,
-		"user": gin.H{
-			"id":      user.ID.Hex(),
-			"name":    user.Name,
-			"surname": user.Surname,
-			"email":   user.Email,
-			"role":    user.Role,
-		},
+		"user":          models.NewProfileView(user),
 	})
 }
 
-// UpdateUser handles updating a user
+// UpdateUserRequest holds the fields a user may change. Omitted fields are
+// left untouched.
+type UpdateUserRequest struct {
+	Name     *string `json:"name" binding:"omitempty,min=1"`
+	Surname  *string `json:"surname" binding:"omitempty,min=1"`
+	Username *string `json:"username" binding:"omitempty,min=1"`
+	Email    *string `json:"email" binding:"omitempty,email"`
+	Password *string `json:"password"`
+	// CurrentPassword is required when changing the password
+	CurrentPassword string `json:"current_password"`
+}
+
+// UpdateUser handles partially updating a user
 func UpdateUser(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -182,17 +169,218 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
-	var user models.User
-	if err := c.ShouldBindJSON(&user); err != nil {
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	var user models.User
+	err = Collections.Users.FindOne(ctx, bson.M{"_id": objID}).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	if req.Name != nil {
+		set["name"] = *req.Name
+	}
+	if req.Surname != nil {
+		set["surname"] = *req.Surname
+	}
+	if req.Username != nil {
+		set["username"] = *req.Username
+	}
+
+	passwordChanged := req.Password != nil
+	if passwordChanged {
+		if auth.ComparePassword(req.CurrentPassword, user.Password) != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+			return
+		}
+
+		hashedPassword, err := auth.HashPassword(*req.Password)
+		if err != nil {
+			respondPasswordError(c, err)
+			return
+		}
+		set["password"] = hashedPassword
+	}
+
+	emailChanged := req.Email != nil && *req.Email != user.Email
+	if emailChanged {
+		var existingUser models.User
+		err = Collections.Users.FindOne(ctx, bson.M{"email": *req.Email}).Decode(&existingUser)
+		if err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
+			return
+		}
+
+		// The new address has to be verified again
+		set["email"] = *req.Email
+		set["email_verified"] = false
+		unset["verified_at"] = ""
+	}
+
+	if len(set) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+	set["updated_at"] = time.Now()
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	result, err := Collections.Users.UpdateOne(ctx, bson.M{"_id": objID}, update)
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Sessions opened with the old password must not outlive it
+	if passwordChanged {
+		if err := revokeUserTokens(ctx, objID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke existing sessions"})
+			return
+		}
+	}
+
+	// The change is saved either way; the user can request another email
+	if emailChanged {
+		user.Email = *req.Email
+		if req.Name != nil {
+			user.Name = *req.Name
+		}
+		sendVerificationEmail(ctx, Stores.Verifications, user)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
+}
+
+// DeleteUser schedules a user's account for erasure. The account is closed
+// straight away and its data purged once AccountDeletionGracePeriod is over,
+// unless it is restored first.
+func DeleteUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id := c.Param("id")
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+		return
+	}
+
+	now := time.Now()
+	result, err := Collections.Users.UpdateOne(ctx,
+		bson.M{"_id": objID, "deleted_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// The craftsman profile goes with the account. It is stamped with the
+	// same time so restoring the account brings it back too.
+	_, err = Collections.Craftsmen.UpdateMany(ctx,
+		bson.M{"user_id": objID, "deleted_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete craftsman profile"})
+		return
+	}
+
+	if err := revokeUserTokens(ctx, objID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "User scheduled for deletion",
+		"purge_after": now.Add(AccountDeletionGracePeriod),
+	})
+}
+
+// RestoreUser undoes the deletion of an account still in its grace period
+func RestoreUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id := c.Param("id")
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+		return
+	}
+
+	var user models.User
+	err = Collections.Users.FindOne(ctx, bson.M{"_id": objID, "deleted_at": bson.M{"$exists": true}}).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deleted user not found"})
+		return
+	}
+
+	if err := restoreUser(ctx, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User restored successfully"})
+}
+
+// restoreUser reopens a deleted account along with the craftsman profile
+// deleted with it
+func restoreUser(ctx context.Context, user models.User) error {
+	update := bson.M{
+		"$unset": bson.M{"deleted_at": "", "purge_started_at": ""},
+		"$set":   bson.M{"updated_at": time.Now()},
+	}
+
+	_, err := Collections.Users.UpdateOne(ctx, bson.M{"_id": user.ID}, update)
+	if err != nil {
+		return err
+	}
+
+	_, err = Collections.Craftsmen.UpdateMany(ctx, bson.M{"user_id": user.ID, "deleted_at": *user.DeletedAt}, update)
+	return err
+}
+
+// SuspendUser bans a user and cuts off all of their tokens immediately
+func SuspendUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id := c.Param("id")
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+		return
+	}
+
 	update := bson.M{
 		"$set": bson.M{
-			"username": user.Username,
-			"email":    user.Email,
-			"password": user.Password,
+			"suspended_at": time.Now(),
+			"updated_at":   time.Now(),
 		},
 	}
 
@@ -207,11 +395,16 @@ func UpdateUser(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
+	if err := revokeUserTokens(ctx, objID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User suspended successfully"})
 }
 
-// DeleteUser handles deleting a user
-func DeleteUser(c *gin.Context) {
+// UnsuspendUser lifts a suspension so the user can log in again
+func UnsuspendUser(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -222,18 +415,51 @@ func DeleteUser(c *gin.Context) {
 		return
 	}
 
-	result, err := Collections.Users.DeleteOne(ctx, bson.M{"_id": objID})
+	update := bson.M{
+		"$unset": bson.M{"suspended_at": ""},
+		"$set":   bson.M{"updated_at": time.Now()},
+	}
+
+	result, err := Collections.Users.UpdateOne(ctx, bson.M{"_id": objID}, update)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if result.DeletedCount == 0 {
+	if result.MatchedCount == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "User unsuspended successfully"})
+}
+
+// UnlockUser clears failed login attempts so a locked out user can log in
+// again straight away
+func UnlockUser(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id := c.Param("id")
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+		return
+	}
+
+	var user models.User
+	err = Collections.Users.FindOne(ctx, bson.M{"_id": objID}).Decode(&user)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := Stores.Logins.Unlock(ctx, user.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked successfully"})
 }
 
 // RegisterUserRoutes registers all user-related routes
@@ -2,14 +2,23 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"backend-dragonhak/auth"
+	"backend-dragonhak/models"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func TestCreateUser(t *testing.T) {
@@ -103,6 +112,19 @@ func TestCreateUser(t *testing.T) {
 			expectedStatus: http.StatusBadRequest,
 			expectedError:  "Invalid role",
 		},
+		{
+			name: "Admins can't register themselves",
+			payload: CreateUserRequest{
+				Name:     "John",
+				Surname:  "Doe",
+				Username: "testuser",
+				Email:    "test@example.com",
+				Password: "StrongP@ss123",
+				Role:     "admin",
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "Invalid role",
+		},
 	}
 
 	for _, tt := range tests {
@@ -146,6 +168,41 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
+// staleLookups is a collection whose lookups miss everything, as if another
+// request inserted the document right after the handler checked for it
+type staleLookups struct {
+	Collection
+}
+
+func (staleLookups) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	return mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+}
+
+func TestCreateUserEmailRace(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	users := &MockCollection{Unique: []string{"email"}}
+	Collections.Users = staleLookups{users}
+	_, err := users.InsertOne(context.Background(), models.User{Email: "test@example.com"})
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.POST("/users", CreateUser)
+
+	// The unique index rejects the insert the lookup didn't catch
+	w := performJSON(router, "POST", "/users", CreateUserRequest{
+		Name:     "John",
+		Surname:  "Doe",
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "StrongP@ss123",
+		Role:     "customer",
+	}, "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Len(t, users.Data, 1)
+}
+
 func TestGetUser(t *testing.T) {
 	// Setup
 	gin.SetMode(gin.TestMode)
@@ -202,13 +259,158 @@ func TestGetUser(t *testing.T) {
 				// Check response fields
 				assert.Equal(t, tt.userID, response["id"])
 				assert.Equal(t, "testuser", response["username"])
-				assert.Equal(t, "test@example.com", response["email"])
+				assert.Nil(t, response["email"])      // Email is only shown to the user and admins
 				assert.Empty(t, response["password"]) // Password should not be returned
 			}
 		})
 	}
 }
 
+func TestUpdateUser(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, user := setupAuthRouter(t)
+	router.PATCH("/api/users/:id", UpdateUser)
+	path := "/api/users/" + user.ID.Hex()
+
+	load := func() models.User {
+		var stored models.User
+		require.NoError(t, Collections.Users.FindOne(context.Background(), bson.M{"_id": user.ID}).Decode(&stored))
+		return stored
+	}
+
+	t.Run("Only supplied fields change", func(t *testing.T) {
+		w := performJSON(router, "PATCH", path, gin.H{"name": "Johnny"}, "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		stored := load()
+		assert.Equal(t, "Johnny", stored.Name)
+		assert.Equal(t, user.Surname, stored.Surname)
+		assert.Equal(t, user.Username, stored.Username)
+		assert.Equal(t, user.Email, stored.Email)
+		assert.Equal(t, user.Password, stored.Password)
+	})
+
+	t.Run("Empty update is rejected", func(t *testing.T) {
+		w := performJSON(router, "PATCH", path, gin.H{}, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Password change requires the current password", func(t *testing.T) {
+		w := performJSON(router, "PATCH", path, gin.H{"password": "N3wStr0ng!Pass"}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w = performJSON(router, "PATCH", path, gin.H{"password": "N3wStr0ng!Pass", "current_password": "wrong"}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w = performJSON(router, "PATCH", path, gin.H{"password": "weak", "current_password": testPassword}, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		assert.Equal(t, user.Password, load().Password)
+	})
+
+	t.Run("Password change re-hashes and logs out other sessions", func(t *testing.T) {
+		tokens := login(t, router, user.Email)
+
+		w := performJSON(router, "PATCH", path, gin.H{"password": "N3wStr0ng!Pass", "current_password": testPassword}, "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		stored := load()
+		assert.NotEqual(t, "N3wStr0ng!Pass", stored.Password)
+		assert.NoError(t, auth.ComparePassword("N3wStr0ng!Pass", stored.Password))
+
+		w = performJSON(router, "POST", "/api/auth/refresh", gin.H{"refresh_token": tokens["refresh_token"]}, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Email change requires re-verification", func(t *testing.T) {
+		_, err := Collections.Users.UpdateOne(context.Background(), bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"email_verified": true}})
+		require.NoError(t, err)
+
+		w := performJSON(router, "PATCH", path, gin.H{"email": "johnny@example.com"}, "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		stored := load()
+		assert.Equal(t, "johnny@example.com", stored.Email)
+		assert.False(t, stored.EmailVerified)
+
+		messages := sentMail(t)
+		require.Len(t, messages, 1)
+		assert.Equal(t, "johnny@example.com", messages[0].Header.Get("To"))
+	})
+
+	t.Run("Email already in use", func(t *testing.T) {
+		other := models.User{Email: "taken@example.com", CreatedAt: time.Now()}
+		_, err := Collections.Users.InsertOne(context.Background(), &other)
+		require.NoError(t, err)
+
+		w := performJSON(router, "PATCH", path, gin.H{"email": "taken@example.com"}, "")
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+}
+
+func TestUserViews(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	userID := createTestUser(t)
+	asCaller := func(c *gin.Context) {
+		c.Set("user_id", c.GetHeader("X-Test-User"))
+		c.Set("role", c.GetHeader("X-Test-Role"))
+	}
+
+	router := gin.New()
+	router.GET("/api/users/", asCaller, GetUsers)
+	router.GET("/api/users/:id", asCaller, GetUser)
+
+	tests := []struct {
+		name        string
+		path        string
+		user        string
+		role        string
+		wantPrivate bool
+	}{
+		{name: "Anonymous sees the public view", path: "/api/users/" + userID.Hex()},
+		{name: "Other users see the public view", path: "/api/users/" + userID.Hex(), user: primitive.NewObjectID().Hex(), role: "customer"},
+		{name: "Users see their own profile", path: "/api/users/" + userID.Hex(), user: userID.Hex(), role: "customer", wantPrivate: true},
+		{name: "Admins see the full profile", path: "/api/users/" + userID.Hex(), user: primitive.NewObjectID().Hex(), role: "admin", wantPrivate: true},
+		{name: "Anonymous listing", path: "/api/users/"},
+		{name: "Admin listing", path: "/api/users/", user: primitive.NewObjectID().Hex(), role: "admin", wantPrivate: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tt.path, nil)
+			req.Header.Set("X-Test-User", tt.user)
+			req.Header.Set("X-Test-Role", tt.role)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			// Password hashes never leave the server
+			assert.NotContains(t, w.Body.String(), "password")
+			assert.NotContains(t, w.Body.String(), "hashedpassword")
+
+			var user map[string]interface{}
+			if tt.path == "/api/users/" {
+				var users []map[string]interface{}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &users))
+				require.Len(t, users, 1)
+				user = users[0]
+			} else {
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &user))
+			}
+
+			assert.Equal(t, "testuser", user["username"])
+			_, hasEmail := user["email"]
+			_, hasVerified := user["email_verified"]
+			assert.Equal(t, tt.wantPrivate, hasEmail)
+			assert.Equal(t, tt.wantPrivate, hasVerified)
+		})
+	}
+}
+
 func TestCreateCraftsmanProfile(t *testing.T) {
 	// Setup
 	gin.SetMode(gin.TestMode)
@@ -303,9 +505,10 @@ func TestCreateCraftsmanProfile(t *testing.T) {
 				assert.NotEmpty(t, craftsman["id"])
 				assert.Equal(t, tt.payload.(map[string]interface{})["bio"], craftsman["bio"])
 				assert.Equal(t, tt.payload.(map[string]interface{})["experience"], int(craftsman["experience"].(float64)))
-				assert.Equal(t, tt.payload.(map[string]interface{})["rating"], craftsman["rating"])
 				assert.Equal(t, tt.payload.(map[string]interface{})["location"], craftsman["location"])
-				assert.Equal(t, tt.payload.(map[string]interface{})["is_verified"], craftsman["is_verified"])
+				// Rating and verification can't be set by the client
+				assert.Equal(t, float64(0), craftsman["rating"])
+				assert.Equal(t, false, craftsman["is_verified"])
 
 				// Check contact info
 				contactInfo := craftsman["contact_info"].(map[string]interface{})
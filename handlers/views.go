@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userView picks the representation of user the caller may see: the full
+// profile for admins and the user themselves, the public view for everyone else
+func userView(c *gin.Context, user models.User) interface{} {
+	if models.UserRole(c.GetString("role")) == models.RoleAdmin || c.GetString("user_id") == user.ID.Hex() {
+		return models.NewProfileView(user)
+	}
+	return models.NewUserView(user)
+}
@@ -0,0 +1,442 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"backend-dragonhak/models"
+	"backend-dragonhak/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WaitlistAcceptanceWindow is how long a customer promoted from the waitlist
+// has to accept their seat before it is offered to the next in line
+var WaitlistAcceptanceWindow = 24 * time.Hour
+
+var (
+	errWaitlistEmpty  = errors.New("nobody is waiting")
+	errAlreadyWaiting = errors.New("already on the waitlist")
+)
+
+// JoinWaitlist puts the caller at the back of a full workshop's waitlist
+func JoinWaitlist(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	workshopID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workshop ID format"})
+		return
+	}
+	customerID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var workshop models.Workshop
+	if err := Collections.Workshops.FindOne(ctx, bson.M{"_id": workshopID}).Decode(&workshop); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workshop not found"})
+		return
+	}
+	if workshop.Status != models.WorkshopStatusUpcoming {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workshop is not open for booking"})
+		return
+	}
+	deleted, err := craftsmanDeleted(ctx, workshop.CraftsmanID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load workshop"})
+		return
+	}
+	if deleted {
+		// The craftsman deleted their profile
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workshop not found"})
+		return
+	}
+	if workshop.CurrentStudents < workshop.MaxParticipants {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workshop has free seats, book it instead"})
+		return
+	}
+
+	entry := models.WaitlistEntry{
+		ID:         primitive.NewObjectID(),
+		WorkshopID: workshopID,
+		CustomerID: customerID,
+		JoinedAt:   time.Now(),
+	}
+	err = Transactions.WithTransaction(ctx, func(ctx context.Context) error {
+		booked, err := Collections.Bookings.CountDocuments(ctx, bson.M{
+			"workshop_id": workshopID,
+			"customer_id": customerID,
+			"status":      bson.M{"$in": activeBookingStatuses},
+		})
+		if err != nil {
+			return err
+		}
+		if booked > 0 {
+			return errAlreadyBooked
+		}
+
+		waiting, err := Collections.Waitlist.CountDocuments(ctx, bson.M{"workshop_id": workshopID, "customer_id": customerID})
+		if err != nil {
+			return err
+		}
+		if waiting > 0 {
+			return errAlreadyWaiting
+		}
+
+		_, err = Collections.Waitlist.InsertOne(ctx, entry)
+		return err
+	})
+	switch {
+	case err == nil:
+	case err == errAlreadyBooked:
+		c.JSON(http.StatusConflict, gin.H{"error": "You have already booked this workshop"})
+		return
+	case err == errAlreadyWaiting || mongo.IsDuplicateKeyError(err):
+		c.JSON(http.StatusConflict, gin.H{"error": "You are already on the waitlist"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join the waitlist"})
+		return
+	}
+
+	ahead, err := Collections.Waitlist.CountDocuments(ctx, bson.M{
+		"workshop_id": workshopID,
+		"$or": bson.A{
+			bson.M{"joined_at": bson.M{"$lt": entry.JoinedAt}},
+			bson.M{"joined_at": entry.JoinedAt, "_id": bson.M{"$lt": entry.ID}},
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read the waitlist"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"entry":    entry,
+		"position": ahead + 1,
+	})
+}
+
+// LeaveWaitlist takes the caller off a workshop's waitlist
+func LeaveWaitlist(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	workshopID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workshop ID format"})
+		return
+	}
+	customerID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	result, err := Collections.Waitlist.DeleteOne(ctx, bson.M{"workshop_id": workshopID, "customer_id": customerID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to leave the waitlist"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "You are not on the waitlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Left the waitlist"})
+}
+
+// AcceptBooking confirms a pending booking offered from the waitlist
+func AcceptBooking(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid booking ID"})
+		return
+	}
+
+	var booking models.Booking
+	if err := Collections.Bookings.FindOne(ctx, bson.M{"_id": objID}).Decode(&booking); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking not found"})
+		return
+	}
+	if booking.Status != models.BookingStatusPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only pending bookings can be accepted"})
+		return
+	}
+	if booking.ExpiresAt != nil && !time.Now().Before(*booking.ExpiresAt) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The offer has expired"})
+		return
+	}
+
+	var workshop models.Workshop
+	if err := Collections.Workshops.FindOne(ctx, bson.M{"_id": booking.WorkshopID}).Decode(&workshop); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workshop not found"})
+		return
+	}
+	if workshop.Status != models.WorkshopStatusUpcoming {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workshop is not open for booking"})
+		return
+	}
+
+	// Guarded by status, so an offer the expiry worker just released can't
+	// be accepted as well
+	err = transitionBooking(ctx, booking, models.BookingStatusConfirmed, nil)
+	if err == errBookingChanged {
+		c.JSON(http.StatusConflict, gin.H{"error": "The offer has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept booking"})
+		return
+	}
+
+	var customer models.User
+	if Collections.Users.FindOne(ctx, bson.M{"_id": booking.CustomerID}).Decode(&customer) == nil {
+		sendMail(ctx, func() (services.Message, error) {
+			return services.BookingConfirmationEmail(customer.Email, customer.Name, workshop.Title, workshop.Location, workshop.Date)
+		})
+	}
+
+	if err := Collections.Bookings.FindOne(ctx, bson.M{"_id": booking.ID}).Decode(&booking); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load booking"})
+		return
+	}
+	c.JSON(http.StatusOK, booking)
+}
+
+// UpdateWorkshopCapacity changes how many people can attend a workshop.
+// Added seats are offered to the waitlist straight away.
+func UpdateWorkshopCapacity(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	workshopID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workshop ID format"})
+		return
+	}
+
+	var request struct {
+		MaxParticipants int `json:"max_participants" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Capacity can't drop below the seats already taken, nor change once
+	// the workshop has started or been cancelled
+	result, err := Collections.Workshops.UpdateOne(ctx,
+		bson.M{
+			"_id":              workshopID,
+			"status":           bson.M{"$in": bson.A{models.WorkshopStatusDraft, models.WorkshopStatusUpcoming}},
+			"current_students": bson.M{"$lte": request.MaxParticipants},
+		},
+		bson.M{"$set": bson.M{"max_participants": request.MaxParticipants, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workshop"})
+		return
+	}
+
+	var workshop models.Workshop
+	if err := Collections.Workshops.FindOne(ctx, bson.M{"_id": workshopID}).Decode(&workshop); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workshop not found"})
+		return
+	}
+	if result.MatchedCount == 0 && !workshop.Status.Editable() {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A %s workshop can't be changed", workshop.Status)})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":            "Capacity can't be lower than the seats already taken",
+			"current_students": workshop.CurrentStudents,
+		})
+		return
+	}
+
+	if err := promoteFromWaitlist(ctx, workshopID); err != nil {
+		log.Printf("Waitlist: failed to promote for workshop %s: %v", workshopID.Hex(), err)
+	}
+
+	if err := Collections.Workshops.FindOne(ctx, bson.M{"_id": workshopID}).Decode(&workshop); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load workshop"})
+		return
+	}
+	c.JSON(http.StatusOK, workshop)
+}
+
+// promoteFromWaitlist fills a workshop's free seats with the customers at the
+// front of its waitlist, offering each a pending booking
+func promoteFromWaitlist(ctx context.Context, workshopID primitive.ObjectID) error {
+	for {
+		booking, err := promoteNext(ctx, workshopID)
+		switch err {
+		case nil:
+			sendWaitlistOffer(ctx, *booking)
+		case errBookingChanged:
+			// Someone else promoted that customer; look again
+		case errWaitlistEmpty, errWorkshopFull:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// promoteNext takes a free seat for the first customer on the waitlist
+func promoteNext(ctx context.Context, workshopID primitive.ObjectID) (*models.Booking, error) {
+	var booking *models.Booking
+	err := Transactions.WithTransaction(ctx, func(ctx context.Context) error {
+		booking = nil
+
+		// The head of the queue, breaking ties within the same millisecond
+		// on the ObjectID
+		var next models.WaitlistEntry
+		err := Collections.Waitlist.FindOne(ctx, bson.M{"workshop_id": workshopID},
+			options.FindOne().SetSort(bson.D{{Key: "joined_at", Value: 1}, {Key: "_id", Value: 1}}),
+		).Decode(&next)
+		if err == mongo.ErrNoDocuments {
+			return errWaitlistEmpty
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := takeSeat(ctx, workshopID); err != nil {
+			return err
+		}
+
+		deleted, err := Collections.Waitlist.DeleteOne(ctx, bson.M{"_id": next.ID})
+		if err != nil {
+			return err
+		}
+		if deleted.DeletedCount == 0 {
+			return errBookingChanged
+		}
+
+		now := time.Now()
+		expiresAt := now.Add(WaitlistAcceptanceWindow)
+		offer := models.Booking{
+			ID:         primitive.NewObjectID(),
+			WorkshopID: workshopID,
+			CustomerID: next.CustomerID,
+			Status:     models.BookingStatusPending,
+			ExpiresAt:  &expiresAt,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+		if _, err := Collections.Bookings.InsertOne(ctx, offer); err != nil {
+			return err
+		}
+		booking = &offer
+		return nil
+	})
+	return booking, err
+}
+
+// sendWaitlistOffer tells a promoted customer their seat is waiting
+func sendWaitlistOffer(ctx context.Context, booking models.Booking) {
+	var workshop models.Workshop
+	var customer models.User
+	if Collections.Workshops.FindOne(ctx, bson.M{"_id": booking.WorkshopID}).Decode(&workshop) != nil ||
+		Collections.Users.FindOne(ctx, bson.M{"_id": booking.CustomerID}).Decode(&customer) != nil {
+		return
+	}
+	sendMail(ctx, func() (services.Message, error) {
+		return services.WaitlistOfferEmail(customer.Email, customer.Name, workshop.Title, workshop.Date,
+			*booking.ExpiresAt, Mail.BaseURL+"/bookings/"+booking.ID.Hex())
+	})
+}
+
+// RunWaitlistWorker expires lapsed waitlist offers every interval until ctx
+// is cancelled
+func RunWaitlistWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		runCtx, cancel := context.WithTimeout(ctx, interval)
+		expired, err := ExpireWaitlistOffers(runCtx, time.Now())
+		cancel()
+		if err != nil {
+			log.Printf("WaitlistWorker: %v", err)
+		} else if expired > 0 {
+			log.Printf("WaitlistWorker: expired %d waitlist offers", expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ExpireWaitlistOffers cancels pending bookings whose acceptance window ended
+// before now and offers their seats to the next in line. It returns how many
+// offers expired.
+func ExpireWaitlistOffers(ctx context.Context, now time.Time) (int, error) {
+	var lapsed []models.Booking
+	err := findAll(ctx, Collections.Bookings, bson.M{
+		"status":     models.BookingStatusPending,
+		"expires_at": bson.M{"$lte": now},
+	}, &lapsed)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, booking := range lapsed {
+		err := releaseSeat(ctx, booking, bson.M{"cancelled_at": now}, nil)
+		if err == errBookingChanged {
+			// Accepted or cancelled in the meantime
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+
+		if err := promoteFromWaitlist(ctx, booking.WorkshopID); err != nil {
+			return expired, err
+		}
+	}
+	return expired, nil
+}
+
+// withdrawOffers cancels the pending offers of a workshop that is no longer
+// open for booking, freeing their seats
+func withdrawOffers(ctx context.Context, workshopID primitive.ObjectID, now time.Time) error {
+	var pending []models.Booking
+	err := findAll(ctx, Collections.Bookings, bson.M{
+		"workshop_id": workshopID,
+		"status":      models.BookingStatusPending,
+	}, &pending)
+	if err != nil {
+		return err
+	}
+
+	for _, booking := range pending {
+		err := releaseSeat(ctx, booking, bson.M{"cancelled_at": now}, nil)
+		if err != nil && err != errBookingChanged {
+			return err
+		}
+	}
+	return nil
+}
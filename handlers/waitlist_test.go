@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWorkshopWaitlist(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, john := setupAuthRouter(t)
+	authorized := router.Group("/api", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), RoutePolicies.Enforce())
+	authorized.POST("/customers/workshops/:id/book", BookWorkshop)
+	authorized.POST("/customers/workshops/:id/waitlist", JoinWaitlist)
+	authorized.DELETE("/customers/workshops/:id/waitlist", LeaveWaitlist)
+	authorized.POST("/customers/bookings/:id/cancel", CancelBooking)
+	authorized.POST("/customers/bookings/:id/accept", AcceptBooking)
+	authorized.PATCH("/workshops/:id/capacity", UpdateWorkshopCapacity)
+
+	ctx := context.Background()
+	johnToken := tokenFor(t, john)
+	alice := newUser(t, "alice", models.RoleCustomer)
+	aliceToken := tokenFor(t, alice)
+	bob := newUser(t, "bob", models.RoleCustomer)
+	bobToken := tokenFor(t, bob)
+	carol := newUser(t, "carol", models.RoleCustomer)
+	carolToken := tokenFor(t, carol)
+	potter, potterID := newCraftsman(t, "potter")
+	potterToken := tokenFor(t, potter)
+
+	result, err := Collections.Workshops.InsertOne(ctx, models.Workshop{
+		Title:           "Raku firing",
+		Status:          models.WorkshopStatusUpcoming,
+		Date:            time.Now().Add(72 * time.Hour),
+		MaxParticipants: 1,
+		Price:           50,
+		CraftsmanID:     potterID,
+	})
+	require.NoError(t, err)
+	workshopID := result.InsertedID.(primitive.ObjectID)
+	workshopPath := "/api/customers/workshops/" + workshopID.Hex()
+
+	joinWaitlist := func(token string) (int, float64) {
+		w := performJSON(router, "POST", workshopPath+"/waitlist", nil, token)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		position, _ := response["position"].(float64)
+		return w.Code, position
+	}
+	pendingBooking := func(customer primitive.ObjectID) models.Booking {
+		var booking models.Booking
+		require.NoError(t, Collections.Bookings.FindOne(ctx, bson.M{
+			"workshop_id": workshopID,
+			"customer_id": customer,
+			"status":      models.BookingStatusPending,
+		}).Decode(&booking))
+		return booking
+	}
+	seatsTaken := func() int {
+		var workshop models.Workshop
+		require.NoError(t, Collections.Workshops.FindOne(ctx, bson.M{"_id": workshopID}).Decode(&workshop))
+		return workshop.CurrentStudents
+	}
+
+	// John takes the only seat
+	w := performJSON(router, "POST", workshopPath+"/book", nil, johnToken)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var johnsBooking map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &johnsBooking))
+
+	t.Run("Customers queue in the order they join", func(t *testing.T) {
+		w := performJSON(router, "POST", workshopPath+"/book", nil, aliceToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		status, position := joinWaitlist(aliceToken)
+		require.Equal(t, http.StatusCreated, status)
+		assert.Equal(t, 1.0, position)
+
+		status, position = joinWaitlist(bobToken)
+		require.Equal(t, http.StatusCreated, status)
+		assert.Equal(t, 2.0, position)
+
+		status, _ = joinWaitlist(aliceToken)
+		assert.Equal(t, http.StatusConflict, status)
+		status, _ = joinWaitlist(johnToken)
+		assert.Equal(t, http.StatusConflict, status, "John already has a seat")
+	})
+
+	t.Run("Customers can leave the waitlist", func(t *testing.T) {
+		w := performJSON(router, "DELETE", workshopPath+"/waitlist", nil, bobToken)
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = performJSON(router, "DELETE", workshopPath+"/waitlist", nil, bobToken)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		status, position := joinWaitlist(bobToken)
+		require.Equal(t, http.StatusCreated, status)
+		assert.Equal(t, 2.0, position)
+	})
+
+	t.Run("A cancellation promotes the next in line", func(t *testing.T) {
+		w := performJSON(router, "POST", "/api/customers/bookings/"+johnsBooking["id"].(string)+"/cancel", nil, johnToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		offer := pendingBooking(alice.ID)
+		require.NotNil(t, offer.ExpiresAt)
+		assert.WithinDuration(t, time.Now().Add(WaitlistAcceptanceWindow), *offer.ExpiresAt, time.Minute)
+		assert.Equal(t, 1, seatsTaken())
+
+		messages := sentMail(t)
+		require.NotEmpty(t, messages)
+		offerMail := messages[len(messages)-1]
+		assert.Equal(t, "alice@example.com", offerMail.Header.Get("To"))
+		assert.Contains(t, mailBody(t, offerMail), offer.ID.Hex())
+
+		// Only Alice can accept her offer
+		w = performJSON(router, "POST", "/api/customers/bookings/"+offer.ID.Hex()+"/accept", nil, bobToken)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Expired offers go to the next in line", func(t *testing.T) {
+		aliceOffer := pendingBooking(alice.ID)
+
+		expired, err := ExpireWaitlistOffers(ctx, time.Now())
+		require.NoError(t, err)
+		assert.Zero(t, expired)
+
+		expired, err = ExpireWaitlistOffers(ctx, time.Now().Add(WaitlistAcceptanceWindow+time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, 1, expired)
+		assert.Equal(t, 1, seatsTaken())
+
+		w := performJSON(router, "POST", "/api/customers/bookings/"+aliceOffer.ID.Hex()+"/accept", nil, aliceToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		bobsOffer := pendingBooking(bob.ID)
+		w = performJSON(router, "POST", "/api/customers/bookings/"+bobsOffer.ID.Hex()+"/accept", nil, bobToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var accepted models.Booking
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &accepted))
+		assert.Equal(t, models.BookingStatusConfirmed, accepted.Status)
+
+		w = performJSON(router, "POST", "/api/customers/bookings/"+bobsOffer.ID.Hex()+"/accept", nil, bobToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Raising capacity promotes the waitlist", func(t *testing.T) {
+		status, position := joinWaitlist(carolToken)
+		require.Equal(t, http.StatusCreated, status)
+		assert.Equal(t, 1.0, position)
+
+		capacityPath := "/api/workshops/" + workshopID.Hex() + "/capacity"
+		w := performJSON(router, "PATCH", capacityPath, gin.H{"max_participants": 2}, aliceToken)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = performJSON(router, "PATCH", capacityPath, gin.H{"max_participants": 2}, potterToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, 2, seatsTaken())
+		count, err := Collections.Waitlist.CountDocuments(ctx, bson.M{"workshop_id": workshopID})
+		require.NoError(t, err)
+		assert.Zero(t, count)
+
+		w = performJSON(router, "PATCH", capacityPath, gin.H{"max_participants": 1}, potterToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Offers lapse when the workshop starts", func(t *testing.T) {
+		offer := pendingBooking(carol.ID)
+		acceptPath := "/api/customers/bookings/" + offer.ID.Hex() + "/accept"
+		setStatus := func(status models.WorkshopStatus) {
+			_, err := Collections.Workshops.UpdateOne(ctx, bson.M{"_id": workshopID}, bson.M{"$set": bson.M{"status": status}})
+			require.NoError(t, err)
+		}
+
+		// Accepting checks the workshop is still open
+		setStatus(models.WorkshopStatusOngoing)
+		w := performJSON(router, "POST", acceptPath, nil, carolToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		setStatus(models.WorkshopStatusUpcoming)
+
+		started, _, err := AdvanceWorkshops(ctx, time.Now().Add(73*time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, started)
+
+		var booking models.Booking
+		require.NoError(t, Collections.Bookings.FindOne(ctx, bson.M{"_id": offer.ID}).Decode(&booking))
+		assert.Equal(t, models.BookingStatusCancelled, booking.Status)
+		assert.NotNil(t, booking.CancelledAt)
+		assert.Equal(t, 1, seatsTaken())
+
+		w = performJSON(router, "POST", acceptPath, nil, carolToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+}
+
+func TestPromoteNextFollowsQueueOrder(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	ctx := context.Background()
+	result, err := Collections.Workshops.InsertOne(ctx, models.Workshop{
+		Title:           "Enamelling",
+		Status:          models.WorkshopStatusUpcoming,
+		MaxParticipants: 3,
+	})
+	require.NoError(t, err)
+	workshopID := result.InsertedID.(primitive.ObjectID)
+
+	// Stored out of queue order, with two customers joining in the same
+	// millisecond
+	joined := time.Now().Truncate(time.Millisecond)
+	first, second, third := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	entries := []models.WaitlistEntry{
+		{ID: third, WorkshopID: workshopID, CustomerID: third, JoinedAt: joined.Add(time.Second)},
+		{ID: second, WorkshopID: workshopID, CustomerID: second, JoinedAt: joined},
+		{ID: first, WorkshopID: workshopID, CustomerID: first, JoinedAt: joined},
+	}
+	for _, entry := range entries {
+		_, err := Collections.Waitlist.InsertOne(ctx, entry)
+		require.NoError(t, err)
+	}
+
+	for _, want := range []primitive.ObjectID{first, second, third} {
+		booking, err := promoteNext(ctx, workshopID)
+		require.NoError(t, err)
+		assert.Equal(t, want, booking.CustomerID)
+	}
+	_, err = promoteNext(ctx, workshopID)
+	assert.Equal(t, errWaitlistEmpty, err)
+}
@@ -0,0 +1,570 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"backend-dragonhak/models"
+	"backend-dragonhak/services"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	errWorkshopChanged = errors.New("workshop was changed concurrently")
+	errUnknownCraft    = errors.New("craft not found")
+)
+
+// CreateWorkshop creates a draft workshop run by the caller's craftsman
+// profile. It can't be booked until it is published.
+func CreateWorkshop(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var workshop models.Workshop
+	if err := c.ShouldBindJSON(&workshop); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workshop data: " + err.Error()})
+		return
+	}
+
+	craftsman, err := callerCraftsman(ctx, c)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only craftsmen with a profile can create workshops"})
+		return
+	}
+
+	// The lifecycle and seat count are managed by the server, and only a
+	// series creates its occurrences
+	now := time.Now()
+	workshop.ID = primitive.NewObjectID()
+	workshop.CraftsmanID = craftsman.ID
+	workshop.Status = models.WorkshopStatusDraft
+	workshop.CurrentStudents = 0
+	workshop.CancelledAt = nil
+	workshop.SeriesID = primitive.NilObjectID
+	workshop.OccurrenceDate = nil
+	workshop.CreatedAt = now
+	workshop.UpdatedAt = now
+
+	if err := applyCraft(ctx, &workshop); err != nil {
+		respondWorkshopError(c, err)
+		return
+	}
+	if problem := validateWorkshop(workshop, now); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	if _, err := Collections.Workshops.InsertOne(ctx, workshop); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workshop: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, workshop)
+}
+
+// UpdateWorkshop replaces the details of a draft or upcoming workshop.
+// Seats added to a published workshop are offered to its waitlist. With
+// ?scope=following, the change also applies to the later occurrences of the
+// workshop's series.
+func UpdateWorkshop(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	existing, ok := loadWorkshop(ctx, c)
+	if !ok {
+		return
+	}
+	scope, ok := workshopScope(c, existing)
+	if !ok {
+		return
+	}
+	if !existing.Status.Editable() {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A %s workshop can't be changed", existing.Status)})
+		return
+	}
+
+	var workshop models.Workshop
+	if err := c.ShouldBindJSON(&workshop); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workshop data: " + err.Error()})
+		return
+	}
+	workshop.CraftsmanID = existing.CraftsmanID
+	workshop.SeriesID, workshop.OccurrenceDate = primitive.NilObjectID, nil
+
+	now := time.Now()
+	if err := applyCraft(ctx, &workshop); err != nil {
+		respondWorkshopError(c, err)
+		return
+	}
+	if problem := validateWorkshop(workshop, now); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	if scope == scopeFollowing {
+		series, err := updateFollowing(ctx, existing, workshop, now)
+		if err != nil {
+			respondWorkshopError(c, err)
+			return
+		}
+		respondSeries(ctx, c, http.StatusOK, series)
+		return
+	}
+
+	if workshop.MaxParticipants < existing.CurrentStudents {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":            "Capacity can't be lower than the seats already taken",
+			"current_students": existing.CurrentStudents,
+		})
+		return
+	}
+
+	// Applies only if nobody changed the status or took the remaining seats
+	// since the workshop was loaded
+	result, err := Collections.Workshops.UpdateOne(ctx,
+		bson.M{
+			"_id":              existing.ID,
+			"status":           existing.Status,
+			"current_students": bson.M{"$lte": workshop.MaxParticipants},
+		},
+		workshopUpdate(workshop, nil),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workshop"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		respondWorkshopError(c, errWorkshopChanged)
+		return
+	}
+
+	if existing.Status == models.WorkshopStatusUpcoming && workshop.MaxParticipants > existing.MaxParticipants {
+		if err := promoteFromWaitlist(ctx, existing.ID); err != nil {
+			log.Printf("Waitlist: failed to promote for workshop %s: %v", existing.ID.Hex(), err)
+		}
+	}
+
+	if err := Collections.Workshops.FindOne(ctx, bson.M{"_id": existing.ID}).Decode(&workshop); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load workshop"})
+		return
+	}
+	c.JSON(http.StatusOK, workshop)
+}
+
+// PublishWorkshop opens a draft workshop for booking
+func PublishWorkshop(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	workshop, ok := loadWorkshop(ctx, c)
+	if !ok {
+		return
+	}
+	if !time.Now().Before(workshop.Date) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A workshop can't be published after it has started"})
+		return
+	}
+
+	if err := transitionWorkshop(ctx, workshop, models.WorkshopStatusUpcoming, nil); err != nil {
+		respondWorkshopError(c, err)
+		return
+	}
+
+	workshop.Status = models.WorkshopStatusUpcoming
+	c.JSON(http.StatusOK, workshop)
+}
+
+// CancelWorkshop cancels a workshop that hasn't started yet. Its bookings
+// are cancelled with a full refund and its waitlist is cleared. Cancelling
+// a cancelled workshop again retries any bookings left over. With
+// ?scope=following, the workshop's series ends and its later occurrences
+// are cancelled too.
+func CancelWorkshop(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	workshop, ok := loadWorkshop(ctx, c)
+	if !ok {
+		return
+	}
+	scope, ok := workshopScope(c, workshop)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if scope == scopeFollowing {
+		workshops, bookings, err := cancelFollowing(ctx, workshop, now)
+		if err == errSeriesNotOwned {
+			respondWorkshopError(c, err)
+			return
+		}
+		if err != nil {
+			log.Printf("Workshops: failed to cancel series %s: %v", workshop.SeriesID.Hex(), err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":               "Not all of the occurrences were cancelled; try again",
+				"cancelled_workshops": workshops,
+				"cancelled_bookings":  bookings,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"cancelled_workshops": workshops,
+			"cancelled_bookings":  bookings,
+		})
+		return
+	}
+
+	if workshop.Status != models.WorkshopStatusCancelled {
+		if err := transitionWorkshop(ctx, workshop, models.WorkshopStatusCancelled, bson.M{"cancelled_at": now}); err != nil {
+			respondWorkshopError(c, err)
+			return
+		}
+		workshop.Status = models.WorkshopStatusCancelled
+		workshop.CancelledAt = &now
+	}
+
+	cancelled, err := cancelWorkshopBookings(ctx, workshop, now)
+	if err != nil {
+		log.Printf("Workshops: failed to cancel bookings of workshop %s: %v", workshop.ID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":              "The workshop was cancelled but not all of its bookings were; try again",
+			"cancelled_bookings": cancelled,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"workshop":           workshop,
+		"cancelled_bookings": cancelled,
+	})
+}
+
+// cancelWorkshopBookings cancels every active booking of a cancelled
+// workshop, refunding paid ones in full, and empties its waitlist
+func cancelWorkshopBookings(ctx context.Context, workshop models.Workshop, now time.Time) (int, error) {
+	var bookings []models.Booking
+	err := findAll(ctx, Collections.Bookings, bson.M{
+		"workshop_id": workshop.ID,
+		"status":      bson.M{"$in": activeBookingStatuses},
+	}, &bookings)
+	if err != nil {
+		return 0, err
+	}
+
+	cancelled := 0
+	for _, booking := range bookings {
+		set := bson.M{"cancelled_at": now}
+		var refund *models.Transaction
+		if booking.Status == models.BookingStatusConfirmed && workshop.Price > 0 {
+			refund = &models.Transaction{
+				ID:          primitive.NewObjectID(),
+				UserID:      booking.CustomerID,
+				Amount:      workshop.Price,
+				Currency:    models.DefaultCurrency,
+				Status:      models.TransactionStatusRefunded,
+				Description: "Refund for cancelled workshop " + workshop.Title,
+				ReferenceID: booking.ID.Hex(),
+				CreatedAt:   now,
+				UpdatedAt:   now,
+			}
+			set["payment_status"] = models.PaymentStatusRefunded
+		}
+
+		err := releaseSeat(ctx, booking, set, refund)
+		if err == errBookingChanged {
+			// Cancelled by the customer in the meantime
+			continue
+		}
+		if err != nil {
+			return cancelled, err
+		}
+		cancelled++
+		sendWorkshopCancellation(ctx, workshop, booking, refund)
+	}
+
+	_, err = Collections.Waitlist.DeleteMany(ctx, bson.M{"workshop_id": workshop.ID})
+	return cancelled, err
+}
+
+// sendWorkshopCancellation tells a customer their workshop was called off
+func sendWorkshopCancellation(ctx context.Context, workshop models.Workshop, booking models.Booking, refund *models.Transaction) {
+	var customer models.User
+	if Collections.Users.FindOne(ctx, bson.M{"_id": booking.CustomerID}).Decode(&customer) != nil {
+		return
+	}
+	refunded := ""
+	if refund != nil {
+		refunded = fmt.Sprintf("%.2f %s", refund.Amount, refund.Currency)
+	}
+	sendMail(ctx, func() (services.Message, error) {
+		return services.WorkshopCancelledEmail(customer.Email, customer.Name, workshop.Title, workshop.Date, refunded)
+	})
+}
+
+// transitionWorkshop moves a workshop to next, setting any extra fields in
+// set. Like transitionBooking it only applies if the workshop still has the
+// status it was loaded with.
+func transitionWorkshop(ctx context.Context, workshop models.Workshop, next models.WorkshopStatus, set bson.M) error {
+	if !workshop.Status.CanTransitionTo(next) {
+		return errInvalidTransition
+	}
+
+	fields := bson.M{"status": next, "updated_at": time.Now()}
+	for key, value := range set {
+		fields[key] = value
+	}
+	result, err := Collections.Workshops.UpdateOne(ctx,
+		bson.M{"_id": workshop.ID, "status": workshop.Status},
+		bson.M{"$set": fields},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errWorkshopChanged
+	}
+	return nil
+}
+
+// RunWorkshopScheduler moves workshops through their lifecycle and creates
+// the upcoming occurrences of workshop series every interval until ctx is
+// cancelled
+func RunWorkshopScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		runCtx, cancel := context.WithTimeout(ctx, interval)
+		started, completed, err := AdvanceWorkshops(runCtx, time.Now())
+		if err != nil {
+			log.Printf("WorkshopScheduler: %v", err)
+		} else if started > 0 || completed > 0 {
+			log.Printf("WorkshopScheduler: started %d and completed %d workshops", started, completed)
+		}
+		created, err := MaterializeSeries(runCtx, time.Now())
+		cancel()
+		if err != nil {
+			log.Printf("WorkshopScheduler: %v", err)
+		} else if created > 0 {
+			log.Printf("WorkshopScheduler: created %d workshops from series", created)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// AdvanceWorkshops starts upcoming workshops whose date has come by now and
+// completes ongoing ones that have run their duration. A started workshop's
+// waitlist and unanswered offers are dropped; a completed workshop's
+// confirmed bookings complete with it.
+func AdvanceWorkshops(ctx context.Context, now time.Time) (started, completed int, err error) {
+	var upcoming []models.Workshop
+	err = findAll(ctx, Collections.Workshops, bson.M{
+		"status": models.WorkshopStatusUpcoming,
+		"date":   bson.M{"$lte": now},
+	}, &upcoming)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, workshop := range upcoming {
+		err := transitionWorkshop(ctx, workshop, models.WorkshopStatusOngoing, nil)
+		if err == errWorkshopChanged {
+			continue
+		}
+		if err != nil {
+			return started, completed, err
+		}
+		started++
+
+		if _, err := Collections.Waitlist.DeleteMany(ctx, bson.M{"workshop_id": workshop.ID}); err != nil {
+			return started, completed, err
+		}
+		if err := withdrawOffers(ctx, workshop.ID, now); err != nil {
+			return started, completed, err
+		}
+	}
+
+	var ongoing []models.Workshop
+	if err := findAll(ctx, Collections.Workshops, bson.M{"status": models.WorkshopStatusOngoing}, &ongoing); err != nil {
+		return started, completed, err
+	}
+	for _, workshop := range ongoing {
+		if workshop.EndsAt().After(now) {
+			continue
+		}
+		err := transitionWorkshop(ctx, workshop, models.WorkshopStatusCompleted, nil)
+		if err == errWorkshopChanged {
+			continue
+		}
+		if err != nil {
+			return started, completed, err
+		}
+		completed++
+
+		_, err = Collections.Bookings.UpdateMany(ctx,
+			bson.M{"workshop_id": workshop.ID, "status": models.BookingStatusConfirmed},
+			bson.M{"$set": bson.M{"status": models.BookingStatusCompleted, "updated_at": now}},
+		)
+		if err != nil {
+			return started, completed, err
+		}
+	}
+	return started, completed, nil
+}
+
+// workshopUpdate builds the update applying a workshop's editable details,
+// plus any extra fields in set
+func workshopUpdate(workshop models.Workshop, set bson.M) bson.M {
+	fields := bson.M{
+		"title":               workshop.Title,
+		"description":         workshop.Description,
+		"category":            workshop.Category,
+		"difficulty":          workshop.Difficulty,
+		"date":                workshop.Date,
+		"duration":            workshop.Duration,
+		"max_participants":    workshop.MaxParticipants,
+		"price":               workshop.Price,
+		"location":            workshop.Location,
+		"cancellation_policy": workshop.CancellationPolicy,
+		"updated_at":          time.Now(),
+	}
+	for key, value := range set {
+		fields[key] = value
+	}
+
+	update := bson.M{"$set": fields}
+	if workshop.CraftID.IsZero() {
+		update["$unset"] = bson.M{"craft_id": ""}
+	} else {
+		fields["craft_id"] = workshop.CraftID
+	}
+	return update
+}
+
+// workshopScope reads which occurrences of a series a change applies to,
+// responding with an error if the scope is invalid for the workshop
+func workshopScope(c *gin.Context, workshop models.Workshop) (string, bool) {
+	scope := c.DefaultQuery("scope", scopeOccurrence)
+	switch {
+	case scope != scopeOccurrence && scope != scopeFollowing:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Scope must be occurrence or following"})
+		return "", false
+	case scope == scopeFollowing && (workshop.SeriesID.IsZero() || workshop.OccurrenceDate == nil):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only workshops in a series have following occurrences"})
+		return "", false
+	}
+	return scope, true
+}
+
+// loadWorkshop loads the workshop in :id, responding with an error if it
+// can't
+func loadWorkshop(ctx context.Context, c *gin.Context) (models.Workshop, bool) {
+	var workshop models.Workshop
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workshop ID format"})
+		return workshop, false
+	}
+
+	err = Collections.Workshops.FindOne(ctx, bson.M{"_id": objID}).Decode(&workshop)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workshop not found"})
+		return workshop, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load workshop"})
+		return workshop, false
+	}
+	return workshop, true
+}
+
+// callerCraftsman loads the authenticated user's craftsman profile
+func callerCraftsman(ctx context.Context, c *gin.Context) (models.Craftsman, error) {
+	var craftsman models.Craftsman
+	userID, err := primitive.ObjectIDFromHex(c.GetString("user_id"))
+	if err != nil {
+		return craftsman, err
+	}
+	err = Collections.Craftsmen.FindOne(ctx, bson.M{"user_id": userID, "deleted_at": bson.M{"$exists": false}}).Decode(&craftsman)
+	return craftsman, err
+}
+
+// applyCraft checks that a linked craft belongs to the workshop's craftsman
+// and fills in the category and difficulty from it when they are left out
+func applyCraft(ctx context.Context, workshop *models.Workshop) error {
+	if workshop.CraftID.IsZero() {
+		return nil
+	}
+
+	var craft models.Craft
+	err := Collections.Crafts.FindOne(ctx, bson.M{"_id": workshop.CraftID, "craftsman_id": workshop.CraftsmanID}).Decode(&craft)
+	if err == mongo.ErrNoDocuments {
+		return errUnknownCraft
+	}
+	if err != nil {
+		return err
+	}
+
+	if workshop.Category == "" {
+		workshop.Category = craft.Category
+	}
+	if workshop.Difficulty == "" {
+		workshop.Difficulty = craft.Difficulty
+	}
+	return nil
+}
+
+// validateWorkshop checks the details a craftsman provides for a workshop,
+// returning what is wrong with them or "" if nothing is
+func validateWorkshop(workshop models.Workshop, now time.Time) string {
+	switch {
+	case workshop.Title == "":
+		return "Workshop title is required"
+	case workshop.Description == "":
+		return "Workshop description is required"
+	case workshop.Category == "":
+		return "Workshop category is required"
+	case !models.ValidDifficulty(workshop.Difficulty):
+		return "Difficulty must be beginner, intermediate or advanced"
+	case !workshop.Date.After(now):
+		return "Workshop date must be in the future"
+	case workshop.MaxParticipants <= 0:
+		return "Maximum number of participants must be greater than 0"
+	case workshop.Price < 0:
+		return "Price cannot be negative"
+	case workshop.Duration <= 0:
+		return "Duration must be greater than 0"
+	}
+	return ""
+}
+
+// respondWorkshopError maps workshop lifecycle errors to responses
+func respondWorkshopError(c *gin.Context, err error) {
+	switch err {
+	case errUnknownCraft:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Craft not found among your crafts"})
+	case errInvalidTransition:
+		c.JSON(http.StatusConflict, gin.H{"error": "The workshop's status doesn't allow that"})
+	case errWorkshopChanged:
+		c.JSON(http.StatusConflict, gin.H{"error": "The workshop was changed by another request"})
+	case errSeatsTaken:
+		c.JSON(http.StatusConflict, gin.H{"error": "Capacity can't be lower than the seats already taken"})
+	case errSeriesNotOwned:
+		c.JSON(http.StatusForbidden, gin.H{"error": "The workshop's series belongs to another craftsman"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workshop"})
+	}
+}
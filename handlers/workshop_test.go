@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"backend-dragonhak/middleware"
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWorkshopLifecycle(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	router, john := setupAuthRouter(t)
+	router.GET("/api/customers/search/workshops", SearchWorkshops)
+	authorized := router.Group("/api", middleware.AuthMiddleware(Stores.Keys, Stores.Denylist), RoutePolicies.Enforce())
+	authorized.POST("/customers/workshops/:id/book", BookWorkshop)
+	authorized.POST("/workshops", CreateWorkshop)
+	authorized.PUT("/workshops/:id", UpdateWorkshop)
+	authorized.POST("/workshops/:id/publish", PublishWorkshop)
+	authorized.POST("/workshops/:id/cancel", CancelWorkshop)
+
+	ctx := context.Background()
+	johnToken := tokenFor(t, john)
+	potter, potterID := newCraftsman(t, "potter")
+	potterToken := tokenFor(t, potter)
+	weaver, weaverID := newCraftsman(t, "weaver")
+	weaverToken := tokenFor(t, weaver)
+
+	result, err := Collections.Crafts.InsertOne(ctx, models.Craft{Name: "Pottery", Category: "ceramics", Difficulty: models.DifficultyBeginner, CraftsmanID: potterID})
+	require.NoError(t, err)
+	potteryID := result.InsertedID.(primitive.ObjectID)
+	result, err = Collections.Crafts.InsertOne(ctx, models.Craft{Name: "Weaving", Category: "textiles", Difficulty: models.DifficultyAdvanced, CraftsmanID: weaverID})
+	require.NoError(t, err)
+	weavingID := result.InsertedID.(primitive.ObjectID)
+
+	details := func(changes gin.H) gin.H {
+		body := gin.H{
+			"title":            "Wheel throwing",
+			"description":      "Throw your first bowl",
+			"category":         "ceramics",
+			"difficulty":       models.DifficultyBeginner,
+			"date":             time.Now().Add(72 * time.Hour),
+			"duration":         3,
+			"max_participants": 6,
+			"price":            40,
+			"location":         "Ljubljana",
+		}
+		for key, value := range changes {
+			body[key] = value
+		}
+		return body
+	}
+
+	t.Run("Creation is validated", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			token      string
+			body       gin.H
+			wantStatus int
+		}{
+			{"Customer", johnToken, details(nil), http.StatusForbidden},
+			{"Missing category", potterToken, details(gin.H{"category": ""}), http.StatusBadRequest},
+			{"Unknown difficulty", potterToken, details(gin.H{"difficulty": "expert"}), http.StatusBadRequest},
+			{"In the past", potterToken, details(gin.H{"date": time.Now().Add(-time.Hour)}), http.StatusBadRequest},
+			{"Someone else's craft", potterToken, details(gin.H{"craft_id": weavingID.Hex()}), http.StatusBadRequest},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				w := performJSON(router, "POST", "/api/workshops", tt.body, tt.token)
+				assert.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			})
+		}
+	})
+
+	// Category and difficulty come from the craft, and the server owns the
+	// status, the craftsman and the seat count
+	w := performJSON(router, "POST", "/api/workshops", details(gin.H{
+		"craft_id":         potteryID.Hex(),
+		"category":         "",
+		"difficulty":       "",
+		"status":           models.WorkshopStatusUpcoming,
+		"craftsman_id":     weaverID.Hex(),
+		"current_students": 6,
+	}), potterToken)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var workshop models.Workshop
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &workshop))
+	assert.Equal(t, models.WorkshopStatusDraft, workshop.Status)
+	assert.Equal(t, potterID, workshop.CraftsmanID)
+	assert.Equal(t, "ceramics", workshop.Category)
+	assert.Equal(t, models.DifficultyBeginner, workshop.Difficulty)
+	assert.Zero(t, workshop.CurrentStudents)
+	workshopPath := "/api/workshops/" + workshop.ID.Hex()
+
+	search := func() []models.Workshop {
+		w := performJSON(router, "GET", "/api/customers/search/workshops?category=ceramics&difficulty=intermediate", nil, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var found []models.Workshop
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+		return found
+	}
+
+	t.Run("Drafts can be edited but not booked", func(t *testing.T) {
+		w := performJSON(router, "POST", "/api/customers/workshops/"+workshop.ID.Hex()+"/book", nil, johnToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = performJSON(router, "PUT", workshopPath, details(gin.H{"difficulty": models.DifficultyIntermediate}), weaverToken)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = performJSON(router, "PUT", workshopPath, details(gin.H{"difficulty": models.DifficultyIntermediate}), potterToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var updated models.Workshop
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated))
+		assert.Equal(t, models.DifficultyIntermediate, updated.Difficulty)
+		assert.Equal(t, models.WorkshopStatusDraft, updated.Status)
+		assert.True(t, updated.CraftID.IsZero(), "the craft link was left out of the update")
+
+		assert.Empty(t, search())
+	})
+
+	t.Run("Published workshops can be found and booked", func(t *testing.T) {
+		w := performJSON(router, "POST", workshopPath+"/publish", nil, potterToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = performJSON(router, "POST", workshopPath+"/publish", nil, potterToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		found := search()
+		require.Len(t, found, 1)
+		assert.Equal(t, workshop.ID, found[0].ID)
+
+		w = performJSON(router, "POST", "/api/customers/workshops/"+workshop.ID.Hex()+"/book", nil, johnToken)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	})
+
+	t.Run("Cancelling refunds every booking", func(t *testing.T) {
+		w := performJSON(router, "POST", workshopPath+"/cancel", nil, potterToken)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response struct {
+			Workshop          models.Workshop `json:"workshop"`
+			CancelledBookings int             `json:"cancelled_bookings"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, models.WorkshopStatusCancelled, response.Workshop.Status)
+		assert.Equal(t, 1, response.CancelledBookings)
+
+		var booking models.Booking
+		require.NoError(t, Collections.Bookings.FindOne(ctx, bson.M{"workshop_id": workshop.ID, "customer_id": john.ID}).Decode(&booking))
+		assert.Equal(t, models.BookingStatusCancelled, booking.Status)
+		assert.Equal(t, models.PaymentStatusRefunded, booking.PaymentStatus)
+
+		var refund models.Transaction
+		require.NoError(t, Collections.Transactions.FindOne(ctx, bson.M{"reference_id": booking.ID.Hex()}).Decode(&refund))
+		assert.Equal(t, 40.0, refund.Amount)
+
+		messages := sentMail(t)
+		require.NotEmpty(t, messages)
+		assert.Equal(t, john.Email, messages[len(messages)-1].Header.Get("To"))
+		assert.Contains(t, mailBody(t, messages[len(messages)-1]), "40.00 USD has been refunded")
+
+		assert.Empty(t, search())
+
+		w = performJSON(router, "PUT", workshopPath, details(nil), potterToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		w = performJSON(router, "POST", workshopPath+"/publish", nil, potterToken)
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		// Cancelling again finds nothing left to cancel
+		w = performJSON(router, "POST", workshopPath+"/cancel", nil, potterToken)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Zero(t, response.CancelledBookings)
+	})
+}
+
+func TestAdvanceWorkshops(t *testing.T) {
+	SetupTestDB(t)
+	defer CleanupTestDB(t)
+
+	ctx := context.Background()
+	now := time.Now()
+	insert := func(status models.WorkshopStatus, startedAgo time.Duration, hours int) primitive.ObjectID {
+		result, err := Collections.Workshops.InsertOne(ctx, models.Workshop{
+			Status:   status,
+			Date:     now.Add(-startedAgo),
+			Duration: hours,
+		})
+		require.NoError(t, err)
+		return result.InsertedID.(primitive.ObjectID)
+	}
+
+	future := insert(models.WorkshopStatusUpcoming, -time.Hour, 2)
+	running := insert(models.WorkshopStatusUpcoming, time.Hour, 2)
+	finished := insert(models.WorkshopStatusUpcoming, 3*time.Hour, 2)
+	draft := insert(models.WorkshopStatusDraft, 3*time.Hour, 2)
+
+	_, err := Collections.Bookings.InsertOne(ctx, models.Booking{WorkshopID: finished, Status: models.BookingStatusConfirmed})
+	require.NoError(t, err)
+	_, err = Collections.Waitlist.InsertOne(ctx, models.WaitlistEntry{WorkshopID: running, JoinedAt: now})
+	require.NoError(t, err)
+
+	started, completed, err := AdvanceWorkshops(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, started)
+	assert.Equal(t, 1, completed)
+
+	status := func(id primitive.ObjectID) models.WorkshopStatus {
+		var workshop models.Workshop
+		require.NoError(t, Collections.Workshops.FindOne(ctx, bson.M{"_id": id}).Decode(&workshop))
+		return workshop.Status
+	}
+	assert.Equal(t, models.WorkshopStatusUpcoming, status(future))
+	assert.Equal(t, models.WorkshopStatusOngoing, status(running))
+	assert.Equal(t, models.WorkshopStatusCompleted, status(finished))
+	assert.Equal(t, models.WorkshopStatusDraft, status(draft), "drafts are never started")
+
+	var booking models.Booking
+	require.NoError(t, Collections.Bookings.FindOne(ctx, bson.M{"workshop_id": finished}).Decode(&booking))
+	assert.Equal(t, models.BookingStatusCompleted, booking.Status)
+
+	waiting, err := Collections.Waitlist.CountDocuments(ctx, bson.M{"workshop_id": running})
+	require.NoError(t, err)
+	assert.Zero(t, waiting)
+
+	// Nothing more to do until the running workshop ends
+	started, completed, err = AdvanceWorkshops(ctx, now)
+	require.NoError(t, err)
+	assert.Zero(t, started+completed)
+
+	_, completed, err = AdvanceWorkshops(ctx, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, completed)
+	assert.Equal(t, models.WorkshopStatusCompleted, status(running))
+}
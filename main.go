@@ -6,11 +6,14 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"backend-dragonhak/auth"
 	"backend-dragonhak/config"
 	"backend-dragonhak/handlers"
 	"backend-dragonhak/middleware"
+	"backend-dragonhak/services"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -22,6 +25,7 @@ import (
 
 var (
 	client        *mongo.Client
+	db            *mongo.Database
 	rateLimiter   *middleware.RateLimiter
 	emailVerifier *handlers.EmailVerifier
 )
@@ -91,29 +95,120 @@ func init() {
 	}
 
 	// Initialize collections with database name from environment
-	db := client.Database(dbName)
-	handlers.Collections.Users = db.Collection("users")
-	handlers.Collections.Craftsmen = db.Collection("craftsmen")
-	handlers.Collections.Crafts = db.Collection("crafts")
-	handlers.Collections.Workshops = db.Collection("workshops")
-	handlers.Collections.Auctions = db.Collection("auctions")
-	handlers.Collections.Bids = db.Collection("bids")
+	db = client.Database(dbName)
+	handlers.InitCollections(db)
+
+	if days := os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid ACCOUNT_DELETION_GRACE_DAYS: %q", days)
+		}
+		handlers.AccountDeletionGracePeriod = time.Duration(n) * 24 * time.Hour
+	}
+	if hours := os.Getenv("WAITLIST_ACCEPTANCE_HOURS"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid WAITLIST_ACCEPTANCE_HOURS: %q", hours)
+		}
+		handlers.WaitlistAcceptanceWindow = time.Duration(n) * time.Hour
+	}
+	if dir := os.Getenv("EXPORT_DIR"); dir != "" {
+		handlers.ExportDir = dir
+	}
 
 	// Get Redis address from environment
+	var kv auth.KV
 	redisAddr := os.Getenv("REDIS_ADDR")
 	if redisAddr == "" {
-		log.Println("REDIS_ADDR not set, rate limiting and email verification will be disabled")
+		log.Println("REDIS_ADDR not set, rate limiting will be disabled, tokens and sessions kept in memory")
 		rateLimiter = middleware.NewDummyRateLimiter()
-		emailVerifier = handlers.NewDummyEmailVerifier()
-		return
+		kv = auth.NewMemoryKV()
+	} else {
+		rateLimiter = middleware.NewRateLimiter(redisAddr)
+		kv = auth.NewRedisKV(redisAddr)
+	}
+
+	// Load the JWT signing key, plus any previous keys that tokens still in
+	// circulation were signed with
+	var keys *auth.KeySet
+	if signingKeyFile := os.Getenv("JWT_SIGNING_KEY_FILE"); signingKeyFile != "" {
+		var verificationKeyFiles []string
+		if files := os.Getenv("JWT_VERIFICATION_KEY_FILES"); files != "" {
+			verificationKeyFiles = strings.Split(files, ",")
+		}
+		keys, err = auth.LoadKeySet(signingKeyFile, verificationKeyFiles)
+		if err != nil {
+			log.Fatalf("Failed to load JWT keys: %v", err)
+		}
+	} else {
+		log.Println("JWT_SIGNING_KEY_FILE not set, signing tokens with a temporary key; tokens won't survive a restart")
+		key, err := auth.GenerateKey(auth.AlgEdDSA)
+		if err != nil {
+			log.Fatalf("Failed to generate JWT signing key: %v", err)
+		}
+		keys, _ = auth.NewKeySet(key)
 	}
 
-	// Try to initialize rate limiter and email verifier
-	rateLimiter = middleware.NewRateLimiter(redisAddr)
-	emailVerifier = handlers.NewEmailVerifier(redisAddr)
+	// Initialize email verifier and token stores
+	emailVerifier = handlers.NewEmailVerifier(kv)
+	handlers.InitStores(kv, keys)
+
+	// Send email over SMTP when configured, otherwise drop it in a local directory
+	mailFrom := os.Getenv("MAIL_FROM")
+	if mailFrom == "" {
+		mailFrom = "no-reply@localhost"
+	}
+	var mailer services.Mailer
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		smtpPort := os.Getenv("SMTP_PORT")
+		if smtpPort == "" {
+			smtpPort = "587"
+		}
+		mailer = services.NewSMTPMailer(smtpHost, smtpPort, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), mailFrom)
+	} else {
+		mailDir := os.Getenv("MAIL_DROP_DIR")
+		if mailDir == "" {
+			mailDir = "mail"
+		}
+		log.Printf("SMTP_HOST not set, writing outgoing email to %s", mailDir)
+		mailer = services.NewFileMailer(mailDir, mailFrom)
+	}
+	handlers.InitMail(mailer, os.Getenv("APP_BASE_URL"))
+
+	// Social login providers are enabled by configuring their client credentials
+	callbackURL := func(provider string) string {
+		return strings.TrimRight(os.Getenv("APP_BASE_URL"), "/") + "/api/auth/oauth/" + provider + "/callback"
+	}
+	if clientID := os.Getenv("GOOGLE_CLIENT_ID"); clientID != "" {
+		google, err := auth.NewOIDCProvider(ctx, "google", "https://accounts.google.com", clientID, os.Getenv("GOOGLE_CLIENT_SECRET"), callbackURL("google"))
+		if err != nil {
+			log.Printf("Google login disabled: %v", err)
+		} else {
+			handlers.OAuthProviders["google"] = google
+		}
+	}
+	if clientID := os.Getenv("GITHUB_CLIENT_ID"); clientID != "" {
+		handlers.OAuthProviders["github"] = auth.NewGitHubProvider(clientID, os.Getenv("GITHUB_CLIENT_SECRET"), callbackURL("github"))
+	}
 }
 
 func main() {
+	// `migrate up|status` manages the schema instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+
+	// The handlers rely on the indexes the migrations create
+	if os.Getenv("MIGRATE_ON_START") != "false" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		err := applyMigrations(ctx)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Set release mode in production
 	if os.Getenv("GIN_MODE") == "release" {
 		gin.SetMode(gin.ReleaseMode)
@@ -131,17 +226,20 @@ func main() {
 
 	// Add security middleware
 	router.Use(gin.Recovery())
-	router.Use(gin.Logger())
+	router.Use(middleware.Logger())
 
 	// Configure CORS
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"*"} // Allow all origins in production
-	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
 	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Requested-With"}
 	config.ExposeHeaders = []string{"Content-Length"}
 	config.AllowCredentials = true
 	router.Use(cors.New(config))
 
+	// Public keys for verifying our tokens
+	router.GET("/.well-known/jwks.json", handlers.JWKS)
+
 	// Health check endpoints
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -176,6 +274,13 @@ func main() {
 	window, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_WINDOW"))
 	maxRequests, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_MAX_REQUESTS"))
 
+	// Every authenticated route checks the token signature and the denylist
+	authRequired := middleware.AuthMiddleware(handlers.Stores.Keys, handlers.Stores.Denylist)
+
+	// Role and ownership rules for each authenticated route, see handlers.RoutePolicies
+	optionalAuth := middleware.OptionalAuthMiddleware(handlers.Stores.Keys, handlers.Stores.Denylist)
+	authorize := handlers.RoutePolicies.Enforce()
+
 	// Auth routes with rate limiting
 	authRoutes := router.Group("/api/auth")
 	authRoutes.Use(rateLimiter.Limit(maxRequests, time.Duration(window)*time.Second))
@@ -184,23 +289,59 @@ func main() {
 		authRoutes.POST("/register", handlers.CreateUser)
 		authRoutes.POST("/register/craftsman", handlers.CreateCraftsmanProfile)
 		authRoutes.POST("/refresh", handlers.RefreshToken)
-		authRoutes.POST("/logout", middleware.AuthMiddleware(os.Getenv("JWT_ACCESS_SECRET")), handlers.Logout)
+		authRoutes.POST("/login/mfa", handlers.VerifyMFALogin)
+		authRoutes.GET("/oauth/:provider/start", handlers.StartOAuthLogin)
+		authRoutes.GET("/oauth/:provider/callback", handlers.OAuthCallback)
+		authRoutes.POST("/password/forgot", handlers.ForgotPassword)
+		authRoutes.POST("/password/reset", handlers.ResetPassword)
+		authRoutes.POST("/restore", handlers.RestoreAccount)
+		authRoutes.POST("/logout", authRequired, handlers.Logout)
 	}
 
 	// User routes
 	userRoutes := router.Group("/api/users")
 	{
-		userRoutes.GET("/", handlers.GetUsers)
-		userRoutes.GET("/:id", handlers.GetUser)
-		userRoutes.Use(middleware.AuthMiddleware(os.Getenv("JWT_ACCESS_SECRET")))
+		userRoutes.GET("/", optionalAuth, handlers.GetUsers)
+		userRoutes.GET("/:id", optionalAuth, handlers.GetUser)
+
+		// Opened from the emailed link, so the token in the query is the credential
+		userRoutes.GET("/verify", emailVerifier.VerifyEmail)
+		userRoutes.Use(authRequired, authorize)
 		{
+			// The authenticated user's own account
+			userRoutes.GET("/me", handlers.GetMe)
+			userRoutes.PUT("/me", handlers.AsCurrentUser, handlers.UpdateUser)
+			userRoutes.PATCH("/me", handlers.AsCurrentUser, handlers.UpdateUser)
+			userRoutes.DELETE("/me", handlers.AsCurrentUser, handlers.DeleteUser)
+			userRoutes.GET("/me/badges", handlers.AsCurrentUser, handlers.GetUserBadges)
+
 			userRoutes.PUT("/:id", handlers.UpdateUser)
+			userRoutes.PATCH("/:id", handlers.UpdateUser)
 			userRoutes.DELETE("/:id", handlers.DeleteUser)
+
+			// Two-factor authentication
+			userRoutes.POST("/me/mfa/enroll", handlers.EnrollMFA)
+			userRoutes.POST("/me/mfa/confirm", handlers.ConfirmMFA)
+
+			// Social login
+			userRoutes.DELETE("/me/identities/:provider", handlers.UnlinkIdentity)
+
+			// Logged in devices
+			userRoutes.GET("/me/sessions", handlers.GetSessions)
+			userRoutes.DELETE("/me/sessions/:id", handlers.DeleteSession)
+
+			// Personal data export
+			userRoutes.POST("/me/export", handlers.RequestDataExport)
+			userRoutes.GET("/me/export", handlers.GetDataExport)
+			userRoutes.GET("/me/export/download", handlers.DownloadDataExport)
+
+			// Calendar feed URLs
+			userRoutes.POST("/me/calendar", handlers.EnableCalendarFeeds)
+			userRoutes.DELETE("/me/calendar", handlers.DisableCalendarFeeds)
 			userRoutes.GET("/:id/badges", handlers.GetUserBadges)
 
 			// Email verification routes
 			userRoutes.POST("/verify/send", emailVerifier.SendVerificationEmail)
-			userRoutes.GET("/verify", emailVerifier.VerifyEmail)
 		}
 	}
 
@@ -208,11 +349,12 @@ func main() {
 	craftsmanRoutes := router.Group("/api/craftsmen")
 	{
 		craftsmanRoutes.GET("", handlers.GetCraftsmen)
-		craftsmanRoutes.Use(middleware.AuthMiddleware(os.Getenv("JWT_ACCESS_SECRET")))
+		craftsmanRoutes.Use(authRequired, authorize)
 		{
 			craftsmanRoutes.GET("/:id", handlers.GetCraftsman)
 			craftsmanRoutes.PUT("/:id", handlers.UpdateCraftsman)
 			craftsmanRoutes.DELETE("/:id", handlers.DeleteCraftsman)
+			craftsmanRoutes.POST("/:id/restore", handlers.RestoreCraftsman)
 		}
 	}
 
@@ -221,27 +363,56 @@ func main() {
 	{
 		customerRoutes.GET("/search/craftsmen", handlers.SearchCraftsmen)
 		customerRoutes.GET("/search/workshops", handlers.SearchWorkshops)
-		customerRoutes.Use(middleware.AuthMiddleware(os.Getenv("JWT_ACCESS_SECRET")))
+		customerRoutes.Use(authRequired, authorize)
 		{
-			customerRoutes.POST("/bookings", handlers.BookWorkshop)
+			customerRoutes.POST("/workshops/:id/book", handlers.BookWorkshop)
 			customerRoutes.GET("/:id/bookings", handlers.GetCustomerBookings)
+			customerRoutes.POST("/bookings/:id/cancel", handlers.CancelBooking)
+			customerRoutes.POST("/bookings/:id/accept", handlers.AcceptBooking)
+			customerRoutes.GET("/bookings/:id/calendar.ics", handlers.GetBookingCalendar)
+			customerRoutes.POST("/workshops/:id/waitlist", handlers.JoinWaitlist)
+			customerRoutes.DELETE("/workshops/:id/waitlist", handlers.LeaveWaitlist)
 		}
 	}
 
 	// Badge routes
 	badgeRoutes := router.Group("/api/badges")
-	badgeRoutes.Use(middleware.AuthMiddleware(os.Getenv("JWT_ACCESS_SECRET")))
+	badgeRoutes.Use(authRequired, authorize)
 	{
 		badgeRoutes.POST("/", handlers.CreateBadge)
 		badgeRoutes.GET("/", handlers.GetBadges)
 		badgeRoutes.POST("/:badgeId/award/:userId", handlers.AwardBadge)
 	}
 
+	// Workshop routes
+	workshopRoutes := router.Group("/api/workshops")
+	workshopRoutes.Use(authRequired, authorize)
+	{
+		workshopRoutes.POST("", handlers.CreateWorkshop)
+		workshopRoutes.PUT("/:id", handlers.UpdateWorkshop)
+		workshopRoutes.POST("/:id/publish", handlers.PublishWorkshop)
+		workshopRoutes.POST("/:id/cancel", handlers.CancelWorkshop)
+		workshopRoutes.PATCH("/:id/capacity", handlers.UpdateWorkshopCapacity)
+
+		// Recurring workshops
+		workshopRoutes.POST("/series", handlers.CreateWorkshopSeries)
+		workshopRoutes.GET("/series/:id", handlers.GetWorkshopSeries)
+		workshopRoutes.POST("/series/:id/publish", handlers.PublishWorkshopSeries)
+	}
+
+	// Calendar feeds, authenticated by the token in the URL since calendar
+	// apps can't send a bearer token
+	calendarRoutes := router.Group("/api/calendar")
+	{
+		calendarRoutes.GET("/:token/bookings.ics", handlers.GetBookingsFeed)
+		calendarRoutes.GET("/:token/teaching.ics", handlers.GetTeachingFeed)
+	}
+
 	// Image routes
 	imageRoutes := router.Group("/api/images")
 	{
 		imageRoutes.GET("/:public_id", handlers.GetImage)
-		imageRoutes.Use(middleware.AuthMiddleware(os.Getenv("JWT_ACCESS_SECRET")))
+		imageRoutes.Use(authRequired, authorize)
 		{
 			imageRoutes.POST("/upload", handlers.UploadImage)
 			imageRoutes.DELETE("/:public_id", handlers.DeleteImage)
@@ -253,7 +424,7 @@ func main() {
 	{
 		auctionRoutes.GET("/", handlers.GetAuctions)
 		auctionRoutes.GET("/:id", handlers.GetAuction)
-		auctionRoutes.Use(middleware.AuthMiddleware(os.Getenv("JWT_ACCESS_SECRET")))
+		auctionRoutes.Use(authRequired, authorize)
 		{
 			auctionRoutes.POST("/", handlers.CreateAuction)
 			auctionRoutes.POST("/:id/bids", handlers.PlaceBid)
@@ -261,6 +432,23 @@ func main() {
 		}
 	}
 
+	// Admin routes
+	adminRoutes := router.Group("/api/admin")
+	adminRoutes.Use(authRequired, authorize)
+	{
+		adminRoutes.POST("/users/:id/suspend", handlers.SuspendUser)
+		adminRoutes.POST("/users/:id/unsuspend", handlers.UnsuspendUser)
+		adminRoutes.POST("/users/:id/unlock", handlers.UnlockUser)
+		adminRoutes.POST("/users/:id/restore", handlers.RestoreUser)
+		adminRoutes.GET("/erasures", handlers.GetErasureReceipts)
+		adminRoutes.PATCH("/craftsmen/:id", handlers.ModerateCraftsman)
+	}
+
+	// Erase accounts whose deletion grace period is over
+	go handlers.RunPurgeWorker(context.Background(), time.Hour)
+	go handlers.RunWaitlistWorker(context.Background(), time.Minute)
+	go handlers.RunWorkshopScheduler(context.Background(), time.Minute)
+
 	// Get port from environment variable or use default
 	port := os.Getenv("PORT")
 	if port == "" {
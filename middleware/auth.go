@@ -10,7 +10,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func AuthMiddleware(secretKey string) gin.HandlerFunc {
+func AuthMiddleware(keys *auth.KeySet, denylist *auth.Denylist) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -29,8 +29,8 @@ func AuthMiddleware(secretKey string) gin.HandlerFunc {
 		// Extract the token
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-		// Validate the token
-		claims, err := auth.ValidateToken(tokenString, secretKey)
+		// Validate the token against the key named in its kid header
+		claims, err := auth.ValidateToken(keys, tokenString, auth.TokenTypeAccess)
 		if err != nil {
 			if err == auth.ErrExpiredToken {
 				c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has expired"})
@@ -41,17 +41,43 @@ func AuthMiddleware(secretKey string) gin.HandlerFunc {
 			return
 		}
 
+		// Reject tokens revoked by logout, password changes or bans
+		if err := denylist.Check(c, claims); err != nil {
+			if err == auth.ErrTokenBlacklisted {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check token status"})
+			}
+			c.Abort()
+			return
+		}
+
 		// Log the user ID before setting it
 		log.Printf("AuthMiddleware: Setting user_id to %s", claims.UserID.Hex())
 
 		// Add the claims to the context
 		c.Set("user_id", claims.UserID.Hex())
 		c.Set("role", claims.Role)
+		c.Set("session_id", claims.SessionID)
 
 		c.Next()
 	}
 }
 
+// OptionalAuthMiddleware authenticates the request when it carries a token
+// and lets anonymous requests through, for public routes whose response
+// depends on who is asking
+func OptionalAuthMiddleware(keys *auth.KeySet, denylist *auth.Denylist) gin.HandlerFunc {
+	authenticate := AuthMiddleware(keys, denylist)
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Next()
+			return
+		}
+		authenticate(c)
+	}
+}
+
 func RoleMiddleware(roles ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		role, exists := c.Get("role")
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redactedPaths match the parts of request paths that are credentials, such
+// as the token in a calendar feed URL or in an emailed link
+var redactedPaths = []*regexp.Regexp{
+	regexp.MustCompile(`^(/api/calendar/)[^/?]+`),
+	regexp.MustCompile(`([?&]token=)[^&]*`),
+}
+
+// redactPath replaces the credentials in a request path
+func redactPath(path string) string {
+	for _, re := range redactedPaths {
+		path = re.ReplaceAllString(path, "${1}REDACTED")
+	}
+	return path
+}
+
+// Logger logs requests in the same format as gin.Logger, with credentials
+// carried in the URL left out so the access log doesn't collect them
+func Logger() gin.HandlerFunc {
+	return gin.LoggerWithConfig(gin.LoggerConfig{
+		Formatter: func(param gin.LogFormatterParams) string {
+			var statusColor, methodColor, resetColor string
+			if param.IsOutputColor() {
+				statusColor = param.StatusCodeColor()
+				methodColor = param.MethodColor()
+				resetColor = param.ResetColor()
+			}
+
+			return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+				param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+				statusColor, param.StatusCode, resetColor,
+				param.Latency,
+				param.ClientIP,
+				methodColor, param.Method, resetColor,
+				redactPath(param.Path),
+				param.ErrorMessage,
+			)
+		},
+	})
+}
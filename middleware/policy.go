@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"backend-dragonhak/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// OwnerResolver returns the ID of the user owning the resource a request targets
+type OwnerResolver func(c *gin.Context) (primitive.ObjectID, error)
+
+// Policy declares who may call a route
+type Policy struct {
+	// Roles allowed to call the route at all
+	Roles []models.UserRole
+	// Owner, when set, restricts non-admins to resources they own
+	Owner OwnerResolver
+}
+
+// Policies maps "METHOD /full/route/path" to the policy guarding that route
+type Policies map[string]Policy
+
+// Enforce authorizes requests against the policy registered for the matched
+// route. It must run after AuthMiddleware. Mutating routes without a policy
+// are refused, so forgetting to declare one fails closed.
+func (p Policies) Enforce() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy, ok := p[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			if isMutating(c.Request.Method) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		role := models.UserRole(c.GetString("role"))
+		if !policy.allows(role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+
+		// Admins may act on anyone's resources
+		if policy.Owner == nil || role == models.RoleAdmin {
+			c.Next()
+			return
+		}
+
+		ownerID, err := policy.Owner(c)
+		if err != nil {
+			switch {
+			case errors.Is(err, mongo.ErrNoDocuments):
+				c.JSON(http.StatusNotFound, gin.H{"error": "Resource not found"})
+			case errors.Is(err, primitive.ErrInvalidHex):
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID format"})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check resource ownership"})
+			}
+			c.Abort()
+			return
+		}
+
+		if ownerID.Hex() != c.GetString("user_id") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func (p Policy) allows(role models.UserRole) bool {
+	for _, allowed := range p.Roles {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"backend-dragonhak/migrations"
+)
+
+// runMigrateCommand handles `migrate up` and `migrate status`
+func runMigrateCommand(args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		if err := applyMigrations(ctx); err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		statuses, err := migrations.Statuses(ctx, db)
+		if err != nil {
+			log.Fatalf("Failed to read migration status: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tAPPLIED AT\tDESCRIPTION")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, appliedAt, status.Description)
+		}
+		w.Flush()
+	default:
+		fmt.Fprintln(os.Stderr, "usage: backend-dragonhak migrate [up|status]")
+		os.Exit(2)
+	}
+}
+
+// applyMigrations brings the database schema up to date
+func applyMigrations(ctx context.Context) error {
+	applied, err := migrations.Up(ctx, db)
+	for _, m := range applied {
+		log.Printf("Applied migration %d: %s", m.Version, m.Description)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply migrations: %w", err)
+	}
+	return nil
+}
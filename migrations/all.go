@@ -0,0 +1,118 @@
+package migrations
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// All lists every migration in the order it is applied. Append new
+// migrations with the next version; never change or reorder applied ones.
+var All = []Migration{
+	{
+		Version:     1,
+		Description: "Unique user emails and linked identities",
+		Up: createIndexes("users",
+			unique(index("email_unique", "email", 1)),
+			partial(unique(index("identities_provider_subject", "identities.provider", 1, "identities.subject", 1)),
+				bson.M{"identities.subject": bson.M{"$exists": true}}),
+		),
+	},
+	{
+		Version:     2,
+		Description: "One craftsman profile per user and workshops by craftsman",
+		Up: sequence(
+			createIndexes("craftsmen", unique(index("user_id_unique", "user_id", 1))),
+			createIndexes("workshops", index("craftsman_id", "craftsman_id", 1)),
+		),
+	},
+	{
+		Version:     3,
+		Description: "Bookings by customer and by workshop and status",
+		Up: createIndexes("bookings",
+			index("customer_id", "customer_id", 1),
+			index("workshop_id_status", "workshop_id", 1, "status", 1),
+		),
+	},
+	{
+		Version:     4,
+		Description: "Bids by auction ordered by amount, auctions by seller",
+		Up: sequence(
+			createIndexes("bids",
+				index("auction_id_amount", "auction_id", 1, "amount", -1),
+				index("bidder_id", "bidder_id", 1),
+			),
+			createIndexes("auctions", index("seller_id", "seller_id", 1)),
+		),
+	},
+	{
+		Version:     5,
+		Description: "Lookups of images, reviews, exports and erasure receipts by owner",
+		Up: sequence(
+			createIndexes("images",
+				unique(index("public_id_unique", "public_id", 1)),
+				index("owner_id", "owner_id", 1),
+			),
+			createIndexes("reviews", index("user_id", "user_id", 1)),
+			createIndexes("exports", unique(index("user_id_unique", "user_id", 1))),
+			createIndexes("erasures", index("subject_id", "subject_id", 1)),
+		),
+	},
+	{
+		Version:     6,
+		Description: "Soft-deleted users and craftsmen for the purge worker",
+		Up: sequence(
+			createIndexes("users", partial(index("deleted_at", "deleted_at", 1), bson.M{"deleted_at": bson.M{"$exists": true}})),
+			createIndexes("craftsmen", partial(index("deleted_at", "deleted_at", 1), bson.M{"deleted_at": bson.M{"$exists": true}})),
+		),
+	},
+	{
+		Version:     7,
+		Description: "One active booking per customer and workshop",
+		Up: createIndexes("bookings", partial(unique(index("workshop_id_customer_id_active_unique", "workshop_id", 1, "customer_id", 1)),
+			bson.M{"status": bson.M{"$in": bson.A{"pending", "confirmed"}}})),
+	},
+	{
+		Version:     8,
+		Description: "Payment and refund transactions by user and by booking",
+		Up: createIndexes("transactions",
+			index("user_id", "user_id", 1),
+			index("reference_id", "reference_id", 1),
+		),
+	},
+	{
+		Version:     9,
+		Description: "Workshop waitlists in joining order and expiring waitlist offers",
+		Up: sequence(
+			createIndexes("waitlist",
+				unique(index("workshop_id_customer_id_unique", "workshop_id", 1, "customer_id", 1)),
+				index("workshop_id_joined_at_id", "workshop_id", 1, "joined_at", 1, "_id", 1),
+				index("customer_id", "customer_id", 1),
+			),
+			createIndexes("bookings", partial(index("pending_expires_at", "expires_at", 1),
+				bson.M{"status": "pending"})),
+		),
+	},
+	{
+		Version:     10,
+		Description: "Workshop lifecycle status, with existing workshops open for booking",
+		Up: sequence(
+			updateMany("workshops", bson.M{"status": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"status": "upcoming"}}),
+			createIndexes("workshops", index("status_date", "status", 1, "date", 1)),
+		),
+	},
+	{
+		Version:     11,
+		Description: "Workshop series and one workshop per series occurrence",
+		Up: sequence(
+			createIndexes("workshop_series", index("craftsman_id", "craftsman_id", 1)),
+			createIndexes("workshops", partial(unique(index("series_id_occurrence_date_unique", "series_id", 1, "occurrence_date", 1)),
+				bson.M{"series_id": bson.M{"$exists": true}})),
+		),
+	},
+	{
+		Version:     12,
+		Description: "Calendar feed tokens",
+		Up: createIndexes("users", partial(unique(index("calendar_token_hash_unique", "calendar_token_hash", 1)),
+			bson.M{"calendar_token_hash": bson.M{"$exists": true}})),
+	},
+}
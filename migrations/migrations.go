@@ -0,0 +1,147 @@
+// Package migrations applies versioned changes to the database schema, such
+// as the indexes the handlers rely on. Migrations run in version order and
+// each is recorded in the migrations collection once it has been applied.
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CollectionName is the collection recording applied migrations
+const CollectionName = "migrations"
+
+// Migration is a single schema change. Up must be safe to run again, since a
+// crash after it finishes but before it is recorded runs it a second time.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// Record marks a migration as applied
+type Record struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+// Status describes a migration and when it was applied, if it has been
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Up applies every migration that hasn't run yet, in order, and returns the
+// ones it applied. It stops at the first migration that fails.
+func Up(ctx context.Context, db *mongo.Database) ([]Migration, error) {
+	statuses, err := Statuses(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []Migration{}
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			continue
+		}
+
+		m := status.Migration
+		if err := m.Up(ctx, db); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+
+		record := Record{Version: m.Version, Description: m.Description, AppliedAt: time.Now()}
+		_, err := db.Collection(CollectionName).ReplaceOne(ctx,
+			bson.M{"_id": m.Version}, record, options.Replace().SetUpsert(true))
+		if err != nil {
+			return applied, fmt.Errorf("recording migration %d: %w", m.Version, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// Statuses lists every migration in order along with when it was applied
+func Statuses(ctx context.Context, db *mongo.Database) ([]Status, error) {
+	cursor, err := db.Collection(CollectionName).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	appliedAt := map[int]time.Time{}
+	for _, record := range records {
+		appliedAt[record.Version] = record.AppliedAt
+	}
+
+	statuses := make([]Status, 0, len(All))
+	for _, m := range All {
+		status := Status{Migration: m}
+		if at, ok := appliedAt[m.Version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// step is one part of a migration
+type step = func(ctx context.Context, db *mongo.Database) error
+
+// sequence runs steps in order, stopping at the first that fails
+func sequence(steps ...step) step {
+	return func(ctx context.Context, db *mongo.Database) error {
+		for _, s := range steps {
+			if err := s(ctx, db); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// createIndexes returns a migration step creating indexes on a collection.
+// Creating an index that already exists with the same options is a no-op.
+func createIndexes(collection string, indexes ...mongo.IndexModel) step {
+	return func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection(collection).Indexes().CreateMany(ctx, indexes)
+		return err
+	}
+}
+
+// index describes an index on keys, given as field name and direction pairs
+func index(name string, keys ...interface{}) mongo.IndexModel {
+	doc := bson.D{}
+	for i := 0; i+1 < len(keys); i += 2 {
+		doc = append(doc, bson.E{Key: keys[i].(string), Value: keys[i+1]})
+	}
+	return mongo.IndexModel{Keys: doc, Options: options.Index().SetName(name)}
+}
+
+// unique marks an index as unique
+func unique(model mongo.IndexModel) mongo.IndexModel {
+	model.Options.SetUnique(true)
+	return model
+}
+
+// partial limits an index to the documents matching filter
+func partial(model mongo.IndexModel, filter bson.M) mongo.IndexModel {
+	model.Options.SetPartialFilterExpression(filter)
+	return model
+}
+
+// updateMany applies update to every document in collection matching filter
+func updateMany(collection string, filter, update bson.M) step {
+	return func(ctx context.Context, db *mongo.Database) error {
+		_, err := db.Collection(collection).UpdateMany(ctx, filter, update)
+		return err
+	}
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"math"
+	"time"
+)
+
+// bookingTransitions lists the statuses each booking status may move to.
+// Cancelled and completed bookings are final.
+var bookingTransitions = map[BookingStatus][]BookingStatus{
+	BookingStatusPending:   {BookingStatusConfirmed, BookingStatusCancelled},
+	BookingStatusConfirmed: {BookingStatusCancelled, BookingStatusCompleted},
+}
+
+// CanTransitionTo reports whether a booking may move from s to next
+func (s BookingStatus) CanTransitionTo(next BookingStatus) bool {
+	for _, allowed := range bookingTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Payment statuses of a booking after cancellation
+const (
+	PaymentStatusRefunded          = "refunded"
+	PaymentStatusPartiallyRefunded = "partially_refunded"
+)
+
+// DefaultCurrency is the currency workshop prices are charged in
+const DefaultCurrency = "USD"
+
+// CancellationPolicy decides how much of the price is refunded when a
+// booking is cancelled, depending on how long before the workshop it is
+type CancellationPolicy struct {
+	// Full refund when cancelled at least this many hours before the workshop
+	FullRefundHours int `json:"full_refund_hours" bson:"full_refund_hours"`
+	// Partial refund when cancelled at least this many hours before
+	PartialRefundHours   int `json:"partial_refund_hours,omitempty" bson:"partial_refund_hours,omitempty"`
+	PartialRefundPercent int `json:"partial_refund_percent,omitempty" bson:"partial_refund_percent,omitempty" binding:"omitempty,min=0,max=100"`
+}
+
+// DefaultCancellationPolicy applies to workshops without their own policy
+var DefaultCancellationPolicy = CancellationPolicy{FullRefundHours: 48}
+
+// RefundPercent returns the percentage of the price refunded for a
+// cancellation at the given time of a workshop starting at start
+func (p CancellationPolicy) RefundPercent(start, cancelledAt time.Time) int {
+	notice := start.Sub(cancelledAt)
+	switch {
+	case notice >= time.Duration(p.FullRefundHours)*time.Hour:
+		return 100
+	case p.PartialRefundHours > 0 && notice >= time.Duration(p.PartialRefundHours)*time.Hour:
+		return p.PartialRefundPercent
+	}
+	return 0
+}
+
+// Refund returns the amount refunded out of price, rounded to cents
+func (p CancellationPolicy) Refund(price float64, start, cancelledAt time.Time) float64 {
+	return math.Round(price*float64(p.RefundPercent(start, cancelledAt))) / 100
+}
@@ -25,6 +25,8 @@ type Craftsman struct {
 	IsVerified  bool                  `json:"is_verified" bson:"is_verified"`
 	CreatedAt   time.Time             `json:"created_at" bson:"created_at"`
 	UpdatedAt   time.Time             `json:"updated_at" bson:"updated_at"`
+	// Set when the profile is deleted; it is purged after a grace period
+	DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
 }
 
 // ContactInformation represents contact details
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Erasure subjects
+const (
+	ErasureSubjectUser      = "user"
+	ErasureSubjectCraftsman = "craftsman"
+)
+
+// ErasureReceipt records that a deleted account or craftsman profile was
+// purged and what was done to its data. It deliberately holds no personal
+// data, only IDs and counts.
+type ErasureReceipt struct {
+	ID          primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Subject     string             `json:"subject" bson:"subject"`
+	SubjectID   primitive.ObjectID `json:"subject_id" bson:"subject_id"`
+	RequestedAt time.Time          `json:"requested_at" bson:"requested_at"`
+	PurgedAt    time.Time          `json:"purged_at" bson:"purged_at"`
+	// Documents deleted, anonymized or cancelled, e.g. "workshops_deleted"
+	Actions map[string]int64 `json:"actions" bson:"actions"`
+	// Steps that failed and need manual follow-up, such as images that
+	// could not be deleted from Cloudinary
+	Failures []string `json:"failures,omitempty" bson:"failures,omitempty"`
+}
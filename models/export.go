@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ExportStatus string
+
+const (
+	ExportStatusPending ExportStatus = "pending"
+	ExportStatusRunning ExportStatus = "running"
+	ExportStatusReady   ExportStatus = "ready"
+	ExportStatusFailed  ExportStatus = "failed"
+)
+
+// DataExport is a user's request for a copy of their personal data. Users
+// have at most one export; requesting a new one replaces it.
+type DataExport struct {
+	ID          primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID      primitive.ObjectID `json:"-" bson:"user_id"`
+	Status      ExportStatus       `json:"status" bson:"status"`
+	RequestedAt time.Time          `json:"requested_at" bson:"requested_at"`
+	CompletedAt *time.Time         `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+	ExpiresAt   *time.Time         `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	Error       string             `json:"error,omitempty" bson:"error,omitempty"`
+	// Path of the ZIP file on the server once the export is ready
+	File string `json:"-" bson:"file,omitempty"`
+	// Set in responses once the export can be downloaded
+	DownloadURL string `json:"download_url,omitempty" bson:"-"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Image is an uploaded Cloudinary image and the user who uploaded it
+type Image struct {
+	ID        primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	PublicID  string             `json:"public_id" bson:"public_id"`
+	URL       string             `json:"url" bson:"url"`
+	OwnerID   primitive.ObjectID `json:"owner_id" bson:"owner_id"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
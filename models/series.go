@@ -0,0 +1,186 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RecurrenceFrequency is how often a workshop series repeats
+type RecurrenceFrequency string
+
+const (
+	FrequencyWeekly  RecurrenceFrequency = "weekly"
+	FrequencyMonthly RecurrenceFrequency = "monthly"
+)
+
+// Recurrence is an RRULE-style rule for when the workshops of a series take
+// place. As in RFC 5545, Count and Until are exclusive, Count includes the
+// excepted occurrences, and monthly rules skip months without the start's
+// day. Count is capped at ten years of weekly workshops.
+type Recurrence struct {
+	Frequency RecurrenceFrequency `json:"frequency" bson:"frequency" binding:"required,oneof=weekly monthly"`
+	// Interval repeats every Interval weeks or months; 0 means 1
+	Interval int        `json:"interval,omitempty" bson:"interval,omitempty" binding:"omitempty,min=1,max=12"`
+	Count    int        `json:"count,omitempty" bson:"count,omitempty" binding:"omitempty,min=1,max=520"`
+	Until    *time.Time `json:"until,omitempty" bson:"until,omitempty"`
+	// Exceptions are occurrence start times that are skipped
+	Exceptions []time.Time `json:"exceptions,omitempty" bson:"exceptions,omitempty" binding:"omitempty,max=520"`
+}
+
+// Occurrences returns the start times the rule generates from start up to
+// and including through, without the exceptions
+func (r Recurrence) Occurrences(start, through time.Time) []time.Time {
+	times, _ := r.generate(start, through, 0)
+	return times
+}
+
+// First returns the first start time the rule generates from start up to
+// through that isn't an exception, and false if there is none
+func (r Recurrence) First(start, through time.Time) (time.Time, bool) {
+	times, _ := r.generate(start, through, 1)
+	if len(times) == 0 {
+		return time.Time{}, false
+	}
+	return times[0], true
+}
+
+// Split divides r at the occurrence at, returning a rule for the
+// occurrences before it, still counted from start, and a rule for it and
+// the ones after, to be counted from at
+func (r Recurrence) Split(start, at time.Time) (before, after Recurrence) {
+	_, generated := r.generate(start, at.Add(-time.Nanosecond), 0)
+
+	before, after = r, r
+	until := at.Add(-time.Second)
+	before.Until = &until
+	before.Count = 0
+	if r.Count > 0 {
+		after.Count = r.Count - generated
+	}
+	return before, after
+}
+
+// generate walks the rule, returning the occurrences up to through, or only
+// the first limit of them when limit is positive, and how many it generated
+// including the excepted ones
+func (r Recurrence) generate(start, through time.Time, limit int) ([]time.Time, int) {
+	interval := r.Interval
+	if interval < 1 {
+		interval = 1
+	}
+
+	times := []time.Time{}
+	generated := 0
+	for n := 0; ; n++ {
+		var next time.Time
+		switch r.Frequency {
+		case FrequencyWeekly:
+			next = start.AddDate(0, 0, 7*interval*n)
+		case FrequencyMonthly:
+			next = start.AddDate(0, interval*n, 0)
+		default:
+			return times, generated
+		}
+		if next.After(through) || (r.Until != nil && next.After(*r.Until)) ||
+			(r.Count > 0 && generated >= r.Count) || (limit > 0 && len(times) >= limit) {
+			return times, generated
+		}
+		// AddDate overflows into the next month when the day is missing
+		if r.Frequency == FrequencyMonthly && next.Day() != start.Day() {
+			continue
+		}
+
+		generated++
+		if !r.excepts(next) {
+			times = append(times, next)
+		}
+	}
+}
+
+func (r Recurrence) excepts(t time.Time) bool {
+	for _, exception := range r.Exceptions {
+		if exception.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkshopSeries is a workshop that repeats. Its details are the template
+// each occurrence is created from; occurrences are ordinary workshops with
+// their own capacity and bookings.
+type WorkshopSeries struct {
+	ID                 primitive.ObjectID  `json:"id,omitempty" bson:"_id,omitempty"`
+	CraftsmanID        primitive.ObjectID  `json:"craftsman_id" bson:"craftsman_id"`
+	Title              string              `json:"title" bson:"title"`
+	Description        string              `json:"description" bson:"description"`
+	Category           string              `json:"category" bson:"category"`
+	Difficulty         string              `json:"difficulty" bson:"difficulty"`
+	CraftID            primitive.ObjectID  `json:"craft_id,omitempty" bson:"craft_id,omitempty"`
+	Duration           int                 `json:"duration" bson:"duration"` // in hours
+	MaxParticipants    int                 `json:"max_participants" bson:"max_participants"`
+	Price              float64             `json:"price" bson:"price"`
+	Location           string              `json:"location" bson:"location"`
+	CancellationPolicy *CancellationPolicy `json:"cancellation_policy,omitempty" bson:"cancellation_policy,omitempty"`
+	// Start is the first occurrence; later ones keep its wall clock time in
+	// Timezone, an IANA name defaulting to UTC
+	Start      time.Time  `json:"start" bson:"start" binding:"required"`
+	Timezone   string     `json:"timezone,omitempty" bson:"timezone,omitempty"`
+	Recurrence Recurrence `json:"recurrence" bson:"recurrence" binding:"required"`
+	// Status is given to new occurrences: draft until the series is
+	// published, then upcoming
+	Status WorkshopStatus `json:"status" bson:"status"`
+	// EndedAt is set once every occurrence of a series ending after Count
+	// has been created, so the scheduler no longer looks at it
+	EndedAt   *time.Time `json:"ended_at,omitempty" bson:"ended_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" bson:"updated_at"`
+}
+
+// Zone returns the series' time zone
+func (s WorkshopSeries) Zone() (*time.Location, error) {
+	return time.LoadLocation(s.Timezone)
+}
+
+// Occurrences returns the start times of the series up to through
+func (s WorkshopSeries) Occurrences(through time.Time) []time.Time {
+	loc, err := s.Zone()
+	if err != nil {
+		loc = time.UTC
+	}
+	return s.Recurrence.Occurrences(s.Start.In(loc), through)
+}
+
+// EndsBy reports whether the series has no occurrences after through. Only
+// series ending after Count are checked; the others may go on.
+func (s WorkshopSeries) EndsBy(through time.Time) bool {
+	if s.Recurrence.Count == 0 {
+		return false
+	}
+	// Count bounds the walk, so asking for every occurrence is cheap
+	all := s.Occurrences(time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC))
+	return len(all) == 0 || !all[len(all)-1].After(through)
+}
+
+// Occurrence builds the workshop taking place at start
+func (s WorkshopSeries) Occurrence(start time.Time) Workshop {
+	occurrence := start
+	return Workshop{
+		Title:              s.Title,
+		Description:        s.Description,
+		Status:             s.Status,
+		Category:           s.Category,
+		Difficulty:         s.Difficulty,
+		CraftID:            s.CraftID,
+		SeriesID:           s.ID,
+		OccurrenceDate:     &occurrence,
+		Date:               start,
+		Duration:           s.Duration,
+		MaxParticipants:    s.MaxParticipants,
+		Price:              s.Price,
+		Location:           s.Location,
+		CraftsmanID:        s.CraftsmanID,
+		CancellationPolicy: s.CancellationPolicy,
+	}
+}
@@ -29,7 +29,7 @@ type User struct {
 	Surname   string             `json:"surname" bson:"surname"`
 	Username  string             `json:"username" bson:"username"`
 	Email     string             `json:"email" bson:"email"`
-	Password  string             `json:"password" bson:"password"`
+	Password  string             `json:"-" bson:"password"`
 	Role      UserRole           `json:"role" bson:"role"`
 	Badges    []Badge            `json:"badges,omitempty" bson:"badges,omitempty"` // Only for craftsmen and customers
 	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
@@ -37,6 +37,38 @@ type User struct {
 	// Email verification fields
 	EmailVerified bool      `json:"email_verified" bson:"email_verified"`
 	VerifiedAt    time.Time `json:"verified_at,omitempty" bson:"verified_at,omitempty"`
+	// Set when an admin suspends the account
+	SuspendedAt *time.Time `json:"suspended_at,omitempty" bson:"suspended_at,omitempty"`
+	// Set when the account is deleted; its data is purged after a grace period
+	DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+	// Two-factor authentication, set once the user starts enrolling
+	MFA *MFASettings `json:"mfa,omitempty" bson:"mfa,omitempty"`
+	// External accounts (Google, GitHub, ...) the user can log in with
+	Identities []ExternalIdentity `json:"identities,omitempty" bson:"identities,omitempty"`
+	// Bumped whenever the user's tokens are revoked; tokens carrying an
+	// older version are no longer accepted
+	TokenVersion int `json:"-" bson:"token_version"`
+	// Hash of the token in the user's calendar feed URLs, once they have asked for one
+	CalendarTokenHash string `json:"-" bson:"calendar_token_hash,omitempty"`
+}
+
+// ExternalIdentity links a user to an account at an OAuth/OIDC provider
+type ExternalIdentity struct {
+	Provider string    `json:"provider" bson:"provider"`
+	Subject  string    `json:"-" bson:"subject"`
+	Email    string    `json:"email" bson:"email"`
+	LinkedAt time.Time `json:"linked_at" bson:"linked_at"`
+}
+
+// MFASettings holds a user's TOTP second factor. Secrets and recovery code
+// hashes never leave the server.
+type MFASettings struct {
+	Enabled bool   `json:"enabled" bson:"enabled"`
+	Secret  string `json:"-" bson:"secret,omitempty"`
+	// PendingSecret is set during enrollment until the first code is confirmed
+	PendingSecret string     `json:"-" bson:"pending_secret,omitempty"`
+	RecoveryCodes []string   `json:"-" bson:"recovery_codes,omitempty"`
+	EnabledAt     *time.Time `json:"enabled_at,omitempty" bson:"enabled_at,omitempty"`
 }
 
 type Speciality struct {
@@ -66,8 +98,10 @@ type Booking struct {
 	ID            primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
 	WorkshopID    primitive.ObjectID `json:"workshop_id" bson:"workshop_id"`
 	CustomerID    primitive.ObjectID `json:"customer_id" bson:"customer_id"`
-	Status        BookingStatus      `json:"status" bson:"status"` // confirmed, cancelled, completed
+	Status        BookingStatus      `json:"status" bson:"status"` // see BookingStatus.CanTransitionTo
 	PaymentStatus string             `json:"payment_status" bson:"payment_status"`
+	CancelledAt   *time.Time         `json:"cancelled_at,omitempty" bson:"cancelled_at,omitempty"`
+	ExpiresAt     *time.Time         `json:"expires_at,omitempty" bson:"expires_at,omitempty"` // when a waitlist offer lapses
 	CreatedAt     time.Time          `json:"created_at" bson:"created_at"`
 	UpdatedAt     time.Time          `json:"updated_at" bson:"updated_at"`
 }
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UserView is the public representation of a user, safe to show to anyone
+type UserView struct {
+	ID        primitive.ObjectID `json:"id"`
+	Name      string             `json:"name"`
+	Surname   string             `json:"surname"`
+	Username  string             `json:"username"`
+	Role      UserRole           `json:"role"`
+	Badges    []Badge            `json:"badges,omitempty"`
+	CreatedAt time.Time          `json:"created_at"`
+}
+
+// ProfileView adds account details only the user themselves and admins may see
+type ProfileView struct {
+	UserView
+	Email         string     `json:"email"`
+	EmailVerified bool       `json:"email_verified"`
+	VerifiedAt    *time.Time `json:"verified_at,omitempty"`
+	SuspendedAt   *time.Time `json:"suspended_at,omitempty"`
+	MFAEnabled    bool       `json:"mfa_enabled"`
+	// Providers the user can log in with besides their password
+	LinkedProviders []string  `json:"linked_providers,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// AccountView is the logged in user's own account: their profile together
+// with everything attached to it
+type AccountView struct {
+	User          ProfileView      `json:"user"`
+	Craftsman     *Craftsman       `json:"craftsman,omitempty"`
+	Badges        []Badge          `json:"badges"`
+	BookingsCount int64            `json:"bookings_count"`
+	Verification  VerificationView `json:"verification"`
+}
+
+// VerificationView is the state of the user's email verification
+type VerificationView struct {
+	EmailVerified bool       `json:"email_verified"`
+	VerifiedAt    *time.Time `json:"verified_at,omitempty"`
+}
+
+func NewUserView(u User) UserView {
+	return UserView{
+		ID:        u.ID,
+		Name:      u.Name,
+		Surname:   u.Surname,
+		Username:  u.Username,
+		Role:      u.Role,
+		Badges:    u.Badges,
+		CreatedAt: u.CreatedAt,
+	}
+}
+
+func NewProfileView(u User) ProfileView {
+	view := ProfileView{
+		UserView:      NewUserView(u),
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		SuspendedAt:   u.SuspendedAt,
+		MFAEnabled:    u.MFA != nil && u.MFA.Enabled,
+		UpdatedAt:     u.UpdatedAt,
+	}
+	for _, identity := range u.Identities {
+		view.LinkedProviders = append(view.LinkedProviders, identity.Provider)
+	}
+	if !u.VerifiedAt.IsZero() {
+		verifiedAt := u.VerifiedAt
+		view.VerifiedAt = &verifiedAt
+	}
+	return view
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WaitlistEntry is a customer waiting for a seat in a full workshop. Entries
+// are served in the order customers joined and removed once promoted.
+type WaitlistEntry struct {
+	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	WorkshopID primitive.ObjectID `json:"workshop_id" bson:"workshop_id"`
+	CustomerID primitive.ObjectID `json:"customer_id" bson:"customer_id"`
+	JoinedAt   time.Time          `json:"joined_at" bson:"joined_at"`
+}
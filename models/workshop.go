@@ -17,18 +17,79 @@ type WorkshopBooking struct {
 	UpdatedAt     time.Time          `json:"updated_at" bson:"updated_at"`
 }
 
+// WorkshopStatus is where a workshop is in its lifecycle
+type WorkshopStatus string
+
+const (
+	WorkshopStatusDraft     WorkshopStatus = "draft"
+	WorkshopStatusUpcoming  WorkshopStatus = "upcoming"
+	WorkshopStatusOngoing   WorkshopStatus = "ongoing"
+	WorkshopStatusCompleted WorkshopStatus = "completed"
+	WorkshopStatusCancelled WorkshopStatus = "cancelled"
+)
+
+// workshopTransitions lists the statuses each workshop status may move to.
+// Drafts are published to upcoming; the scheduler moves upcoming workshops
+// on by their date. Completed and cancelled workshops are final.
+var workshopTransitions = map[WorkshopStatus][]WorkshopStatus{
+	WorkshopStatusDraft:    {WorkshopStatusUpcoming, WorkshopStatusCancelled},
+	WorkshopStatusUpcoming: {WorkshopStatusOngoing, WorkshopStatusCancelled},
+	WorkshopStatusOngoing:  {WorkshopStatusCompleted},
+}
+
+// CanTransitionTo reports whether a workshop may move from s to next
+func (s WorkshopStatus) CanTransitionTo(next WorkshopStatus) bool {
+	for _, allowed := range workshopTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Editable reports whether a workshop's details may still be changed
+func (s WorkshopStatus) Editable() bool {
+	return s == WorkshopStatusDraft || s == WorkshopStatusUpcoming
+}
+
+// Workshop and craft difficulty levels
+const (
+	DifficultyBeginner     = "beginner"
+	DifficultyIntermediate = "intermediate"
+	DifficultyAdvanced     = "advanced"
+)
+
+// ValidDifficulty reports whether d is one of the difficulty levels
+func ValidDifficulty(d string) bool {
+	return d == DifficultyBeginner || d == DifficultyIntermediate || d == DifficultyAdvanced
+}
+
 // Workshop represents a workshop event
 type Workshop struct {
 	ID              primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
 	Title           string             `json:"title" bson:"title"`
 	Description     string             `json:"description" bson:"description"`
+	Status          WorkshopStatus     `json:"status" bson:"status"`
+	Category        string             `json:"category" bson:"category"`
+	Difficulty      string             `json:"difficulty" bson:"difficulty"` // beginner, intermediate, advanced
+	CraftID         primitive.ObjectID `json:"craft_id,omitempty" bson:"craft_id,omitempty"`
+	SeriesID        primitive.ObjectID `json:"series_id,omitempty" bson:"series_id,omitempty"`
+	OccurrenceDate  *time.Time         `json:"occurrence_date,omitempty" bson:"occurrence_date,omitempty"` // start the series scheduled it for
 	Date            time.Time          `json:"date" bson:"date"`
-	Duration        int                `json:"duration" bson:"duration"`
+	Duration        int                `json:"duration" bson:"duration"` // in hours
 	MaxParticipants int                `json:"max_participants" bson:"max_participants"`
 	CurrentStudents int                `json:"current_students" bson:"current_students"`
 	Price           float64            `json:"price" bson:"price"`
 	Location        string             `json:"location" bson:"location"`
 	CraftsmanID     primitive.ObjectID `json:"craftsman_id" bson:"craftsman_id"`
-	CreatedAt       time.Time          `json:"created_at" bson:"created_at"`
-	UpdatedAt       time.Time          `json:"updated_at" bson:"updated_at"`
+	// CancellationPolicy overrides DefaultCancellationPolicy when set
+	CancellationPolicy *CancellationPolicy `json:"cancellation_policy,omitempty" bson:"cancellation_policy,omitempty"`
+	CancelledAt        *time.Time          `json:"cancelled_at,omitempty" bson:"cancelled_at,omitempty"`
+	CreatedAt          time.Time           `json:"created_at" bson:"created_at"`
+	UpdatedAt          time.Time           `json:"updated_at" bson:"updated_at"`
+}
+
+// EndsAt returns when the workshop finishes
+func (w Workshop) EndsAt() time.Time {
+	return w.Date.Add(time.Duration(w.Duration) * time.Hour)
 }
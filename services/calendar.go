@@ -0,0 +1,115 @@
+package services
+
+import (
+	"bytes"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Event statuses, as in the STATUS property of RFC 5545
+const (
+	EventTentative = "TENTATIVE"
+	EventConfirmed = "CONFIRMED"
+	EventCancelled = "CANCELLED"
+)
+
+// CalendarEvent is a single event in a calendar
+type CalendarEvent struct {
+	// UID identifies the event across feeds and updates; it must not change
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	URL         string
+	Start       time.Time
+	End         time.Time
+	Status      string
+	// Updated is when the event last changed
+	Updated time.Time
+}
+
+// Calendar is an iCalendar document of events
+type Calendar struct {
+	// Name is shown by calendar apps that subscribe to the feed
+	Name   string
+	Events []CalendarEvent
+}
+
+// calendarEscaper escapes TEXT values as RFC 5545 section 3.3.11 requires
+var calendarEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+// Bytes renders the calendar in iCalendar (RFC 5545) format
+func (c Calendar) Bytes() []byte {
+	var buf bytes.Buffer
+	line := func(name, value string) {
+		writeFolded(&buf, name+":"+value)
+	}
+	text := func(name, value string) {
+		if value != "" {
+			line(name, calendarEscaper.Replace(value))
+		}
+	}
+
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//Dragonhak//Workshops//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	text("X-WR-CALNAME", c.Name)
+	for _, event := range c.Events {
+		line("BEGIN", "VEVENT")
+		text("UID", event.UID)
+		line("DTSTAMP", calendarTime(event.Updated))
+		line("DTSTART", calendarTime(event.Start))
+		line("DTEND", calendarTime(event.End))
+		text("SUMMARY", event.Summary)
+		text("DESCRIPTION", event.Description)
+		text("LOCATION", event.Location)
+		if event.URL != "" {
+			line("URL", event.URL)
+		}
+		if event.Status != "" {
+			line("STATUS", event.Status)
+		}
+		line("END", "VEVENT")
+	}
+	if len(c.Events) == 0 {
+		// A calendar needs at least one component, so an empty feed
+		// describes the UTC time zone its events would use
+		line("BEGIN", "VTIMEZONE")
+		line("TZID", "UTC")
+		line("BEGIN", "STANDARD")
+		line("DTSTART", "19700101T000000")
+		line("TZOFFSETFROM", "+0000")
+		line("TZOFFSETTO", "+0000")
+		line("END", "STANDARD")
+		line("END", "VTIMEZONE")
+	}
+	line("END", "VCALENDAR")
+	return buf.Bytes()
+}
+
+// calendarTime formats t as a UTC DATE-TIME
+func calendarTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// writeFolded writes a content line, folding it so no line is longer than
+// 75 octets without splitting a UTF-8 character
+func writeFolded(buf *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// Continuation lines start with the folding space
+		limit = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"strings"
+	"text/template"
+	"time"
+)
+
+var mailTemplates = template.Must(template.New("mail").Parse(`
+{{define "verification"}}Hi {{.Name}},
+
+Please confirm your email address by opening the link below:
+
+{{.Link}}
+
+The link expires in 24 hours. If you didn't create an account, you can ignore this email.
+{{end}}
+
+{{define "password_reset"}}Hi {{.Name}},
+
+We received a request to reset your password. Open the link below to choose a new one:
+
+{{.Link}}
+
+The link expires in 1 hour. If you didn't request a reset, you can ignore this email and your password will stay the same.
+{{end}}
+
+{{define "booking_confirmation"}}Hi {{.Name}},
+
+Your booking for "{{.Workshop}}" is confirmed.
+
+Date: {{.Date}}
+Location: {{.Location}}
+
+See you there!
+{{end}}
+
+{{define "waitlist_offer"}}Hi {{.Name}},
+
+A seat has opened up in "{{.Workshop}}" on {{.Date}} and it's being held for you.
+
+Accept it before {{.Deadline}}, or it goes to the next person on the waitlist:
+
+{{.Link}}
+{{end}}
+
+{{define "workshop_cancelled"}}Hi {{.Name}},
+
+We're sorry, "{{.Workshop}}" on {{.Date}} has been cancelled by the craftsman and your booking with it.
+{{if .Refund}}
+{{.Refund}} has been refunded to you.
+{{end}}{{end}}
+
+{{define "data_export"}}Hi {{.Name}},
+
+The copy of your data you asked for is ready. Log in and download it from your account settings:
+
+{{.Link}}
+
+The download is available for 7 days.
+{{end}}
+`))
+
+func renderMail(name string, data interface{}) (string, error) {
+	var body strings.Builder
+	if err := mailTemplates.ExecuteTemplate(&body, name, data); err != nil {
+		return "", err
+	}
+	return body.String(), nil
+}
+
+// VerificationEmail builds the email asking a user to confirm their address
+func VerificationEmail(to, name, link string) (Message, error) {
+	body, err := renderMail("verification", map[string]string{"Name": name, "Link": link})
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{To: to, Subject: "Confirm your email address", Body: body}, nil
+}
+
+// PasswordResetEmail builds the email carrying a password reset link
+func PasswordResetEmail(to, name, link string) (Message, error) {
+	body, err := renderMail("password_reset", map[string]string{"Name": name, "Link": link})
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{To: to, Subject: "Reset your password", Body: body}, nil
+}
+
+// BookingConfirmationEmail builds the email sent after a workshop is booked
+func BookingConfirmationEmail(to, name, workshop, location string, date time.Time) (Message, error) {
+	body, err := renderMail("booking_confirmation", map[string]string{
+		"Name":     name,
+		"Workshop": workshop,
+		"Location": location,
+		"Date":     date.Format("Monday, 2 January 2006 at 15:04 MST"),
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{To: to, Subject: "Booking confirmed: " + workshop, Body: body}, nil
+}
+
+// WaitlistOfferEmail offers a waitlisted customer a seat that has opened up
+func WaitlistOfferEmail(to, name, workshop string, date, deadline time.Time, link string) (Message, error) {
+	body, err := renderMail("waitlist_offer", map[string]string{
+		"Name":     name,
+		"Workshop": workshop,
+		"Date":     date.Format("Monday, 2 January 2006 at 15:04 MST"),
+		"Deadline": deadline.Format("Monday, 2 January 2006 at 15:04 MST"),
+		"Link":     link,
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{To: to, Subject: "A seat is waiting for you: " + workshop, Body: body}, nil
+}
+
+// WorkshopCancelledEmail tells a customer the workshop they booked was
+// cancelled, with the amount refunded if any
+func WorkshopCancelledEmail(to, name, workshop string, date time.Time, refund string) (Message, error) {
+	body, err := renderMail("workshop_cancelled", map[string]string{
+		"Name":     name,
+		"Workshop": workshop,
+		"Date":     date.Format("Monday, 2 January 2006 at 15:04 MST"),
+		"Refund":   refund,
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{To: to, Subject: "Workshop cancelled: " + workshop, Body: body}, nil
+}
+
+// DataExportEmail tells a user their personal data export can be downloaded
+func DataExportEmail(to, name, link string) (Message, error) {
+	body, err := renderMail("data_export", map[string]string{"Name": name, "Link": link})
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{To: to, Subject: "Your data export is ready", Body: body}, nil
+}